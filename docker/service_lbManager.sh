@@ -1,3 +1,3 @@
 #!/bin/sh
 
-exec /go/bin/lbManager -etcd-host=$ETCD_HOST -aws-access-key=$AWS_ACCESS_KEY -aws-secret-key=$AWS_SECRET_KEY
\ No newline at end of file
+exec /go/bin/lbManager -etcd-host=$ETCD_HOST $LBMANAGER_FLAGS
\ No newline at end of file
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Take over a load balancer already in use, writing its current members in AWS to the config:
+//
+//	adopt [-class=C] [-hold=D] elb REGION LB_NAME
+//	adopt [-class=C] [-hold=D] route53 REGION HOSTED_ZONE FQDN
+//	adopt [-class=C] [-hold=D] haproxy BACKEND
+//	adopt [-class=C] [-hold=D] nginx UPSTREAM
+//	adopt [-class=C] [-hold=D] webhook NAME
+func runAdopt(m *Manager, args []string) int {
+	flags := newCommandFlagSet("adopt", memberKeysUsage(false, false))
+	class := flags.String("class", "multiple", "Load balancer class used for the members written (single|multiple)")
+	hold := flags.Duration("hold", 30*time.Second, "Maximum time the load balancer syncs are paused while adopting it")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	key, err := parseMemberKey(flags.Args(), false, false)
+	if err != nil {
+		return commandFailed(err)
+	}
+	key.class = *class
+	if err := key.validate(); err != nil {
+		return commandFailed(err)
+	}
+
+	// Get members in AWS and in the config
+	if err := m.loadOptions(); err != nil {
+		return commandFailed(err)
+	}
+	lb := m.getLoadBalancer(&configEntry{
+		lbType:     key.lbType,
+		lbId:       key.lbId(),
+		lbMetadata: key.metadata(),
+	})
+	diff, err := lb.Diff()
+	if err != nil {
+		return commandFailed(fmt.Errorf("%s: error getting members in AWS: %s", key.lbId(), err))
+	}
+	if len(diff.Actual) == 0 {
+		return commandFailed(fmt.Errorf("%s: no members found in AWS, nothing to adopt", key.lbId()))
+	}
+	if key.class == "single" && len(diff.Actual) > 1 {
+		return commandFailed(fmt.Errorf("%s: %d members found in AWS, a single class load balancer can only have one", key.lbId(), len(diff.Actual)))
+	}
+	configMembers := map[string]bool{}
+	entries, err := readConfigEntries(m)
+	if err != nil {
+		return commandFailed(err)
+	}
+	for _, entry := range entries {
+		if entry.lbId != key.lbId() {
+			continue
+		}
+		if entry.lbMetadata["class"] != key.class {
+			return commandFailed(fmt.Errorf("%s: member %s already in config using the %s class", key.lbId(), entry.memberId, entry.lbMetadata["class"]))
+		}
+		configMembers[entry.memberId] = true
+	}
+	keys := []*memberKey{}
+	for _, member := range diff.Actual {
+		memberKey := *key
+		memberKey.member = member
+		if err := memberKey.validate(); err != nil {
+			return commandFailed(fmt.Errorf("%s: can't adopt member in AWS: %s", key.lbId(), err))
+		}
+		if !configMembers[member] {
+			keys = append(keys, &memberKey)
+		}
+	}
+	for member := range configMembers {
+		if !containsMember(diff.Actual, member) {
+			fmt.Printf("%s: member %s in config but not in AWS, it will be added by lbManager\n", key.lbId(), member)
+		}
+	}
+	if len(keys) == 0 {
+		fmt.Printf("%s: all members in AWS already in config, nothing to adopt\n", key.lbId())
+		return 0
+	}
+
+	// Hold the load balancer while its members are written, so that a running lbManager doesn't sync it
+	// with just some of them
+	seconds := uint64(hold.Seconds())
+	if seconds == 0 {
+		seconds = 1
+	}
+	if err := m.store.Set(key.holdPath(m.configPath), "adopt", seconds); err != nil {
+		return commandFailed(fmt.Errorf("%s: error holding load balancer: %s", key.lbId(), err))
+	}
+	defer m.store.Delete(key.holdPath(m.configPath), false)
+	deadline := time.Now().Add(*hold)
+	for _, memberKey := range keys {
+		if time.Now().After(deadline) {
+			return commandFailed(fmt.Errorf("%s: hold expired before all members were written, run adopt again", key.lbId()))
+		}
+		if err := m.store.Set(memberKey.path(m.configPath), "", 0); err != nil {
+			return commandFailed(fmt.Errorf("%s: error writing member %s: %s", key.lbId(), memberKey.member, err))
+		}
+		fmt.Printf("%s: member %s adopted (%s)\n", key.lbId(), memberKey.member, memberKey.class)
+	}
+	return 0
+}
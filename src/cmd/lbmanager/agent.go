@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	sdkaws "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Prefix of the container labels setting the load balancers a container belongs to, followed by the
+// load balancer type
+const agentLabelPrefix = "lbmanager."
+
+// Time to wait before reconnecting to the Docker events API
+const agentRetryDelay = 5 * time.Second
+
+// Registers the containers running in the local Docker daemon as members of the load balancers set in
+// their labels, while they are running. Member keys are set with a ttl and refreshed periodically, so
+// they are removed if the agent stops.
+type Agent struct {
+	configPath string
+	containers map[string][]string
+	docker     *dockerClient
+	instanceId string
+	ip         string
+	keys       map[string]*agentKey
+	store      ConfigStore
+	ttl        time.Duration
+}
+
+// Member key registered by the agent, along with the number of containers registering it
+type agentKey struct {
+	key     *memberKey
+	refs    int
+	removed bool
+	set     bool
+}
+
+// Run the agent registering the local containers in the load balancers:
+//
+//	agent [-docker-socket=PATH] [-ttl=D]
+func runAgent(m *Manager, args []string) int {
+	flags := newCommandFlagSet("agent", "")
+	socket := flags.String("docker-socket", "/var/run/docker.sock", "Docker daemon unix socket")
+	ttl := flags.Duration("ttl", time.Minute, "TTL of the member keys, refreshed every third of it while the containers are running")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return 2
+	}
+	if *ttl < 3*time.Second {
+		return commandFailed(fmt.Errorf("invalid ttl: %s (minimum 3s)", *ttl))
+	}
+	if _, ok := m.store.(*fileStore); ok {
+		return commandFailed(errFileStoreReadOnly)
+	}
+
+	// Get the members used in the load balancers from the instance metadata
+	metadata := ec2metadata.New(session.New(), &sdkaws.Config{Endpoint: sdkaws.String(config.awsMetadataUrl)})
+	instanceId, err := metadata.GetMetadata("instance-id")
+	if err != nil {
+		return commandFailed(fmt.Errorf("error getting instance id from the instance metadata: %s", err))
+	}
+	ip, err := metadata.GetMetadata("local-ipv4")
+	if err != nil {
+		return commandFailed(fmt.Errorf("error getting IP address from the instance metadata: %s", err))
+	}
+
+	agent := &Agent{
+		configPath: m.configPath,
+		containers: make(map[string][]string),
+		docker:     newDockerClient(*socket),
+		instanceId: instanceId,
+		ip:         ip,
+		keys:       make(map[string]*agentKey),
+		store:      m.store,
+		ttl:        *ttl,
+	}
+	stopCh := make(chan bool)
+	signalsCh := make(chan os.Signal, 1)
+	signal.Notify(signalsCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signalsCh
+		logger.Info("signal received, stopping agent, member keys will expire", "action", "shutdown", "signal", sig.String())
+		close(stopCh)
+	}()
+	logger.Info("running agent", "action", "start", "instance", instanceId, "ip", ip)
+	agent.Run(stopCh)
+	return 0
+}
+
+// Register the running containers and follow the Docker events until stopCh is closed. Besides the
+// events, running containers are checked on every refresh, so that no changes are missed while
+// reconnecting.
+func (a *Agent) Run(stopCh chan bool) {
+	ticker := time.NewTicker(a.ttl / 3)
+	defer ticker.Stop()
+	for {
+		eventsCh, errCh := make(chan *dockerEvent), make(chan error, 1)
+		go func() {
+			errCh <- a.docker.events(eventsCh, stopCh)
+		}()
+		a.sync()
+		for connected := true; connected; {
+			select {
+			case <-stopCh:
+				return
+			case event, ok := <-eventsCh:
+				if ok {
+					a.processEvent(event)
+					continue
+				}
+				if err := <-errCh; err != nil {
+					logger.Error("error reading docker events", "action", "watchEvents", "error", err.Error())
+				}
+				select {
+				case <-stopCh:
+					return
+				case <-time.After(agentRetryDelay):
+				}
+				connected = false
+			case <-ticker.C:
+				a.sync()
+				a.refresh()
+			}
+		}
+	}
+}
+
+// Register a container when it starts and unregister it when it dies
+func (a *Agent) processEvent(event *dockerEvent) {
+	switch event.Status {
+	case "start":
+		labels, err := a.docker.containerLabels(event.Id)
+		if err != nil {
+			logger.Error("error getting container labels", "action", "register", "container", shortContainerId(event.Id), "error", err.Error())
+			return
+		}
+		a.register(event.Id, labels)
+	case "die":
+		a.unregister(event.Id)
+	}
+}
+
+// Register the running containers not registered yet, and unregister the ones no longer running
+func (a *Agent) sync() {
+	containers, err := a.docker.containers()
+	if err != nil {
+		logger.Error("error listing containers", "action", "sync", "error", err.Error())
+		return
+	}
+	running := make(map[string]bool)
+	for _, container := range containers {
+		running[container.Id] = true
+		a.register(container.Id, container.Labels)
+	}
+	for id := range a.containers {
+		if !running[id] {
+			a.unregister(id)
+		}
+	}
+}
+
+// Set the member keys of the load balancers in the labels of a container, unless it's registered already
+func (a *Agent) register(id string, labels map[string]string) {
+	if _, registered := a.containers[id]; registered {
+		return
+	}
+	paths := []string{}
+	for _, key := range a.memberKeys(id, labels) {
+		path := key.path(a.configPath)
+		paths = append(paths, path)
+		if a.keys[path] == nil {
+			a.keys[path] = &agentKey{key: key}
+			a.setKey(path)
+		}
+		a.keys[path].refs++
+	}
+	a.containers[id] = paths
+	if len(paths) > 0 {
+		logger.Info("container registered", "action", "register", "container", shortContainerId(id), "keys", len(paths))
+	}
+}
+
+// Delete the member keys of a container no longer registered by other containers
+func (a *Agent) unregister(id string) {
+	paths, registered := a.containers[id]
+	if !registered {
+		return
+	}
+	delete(a.containers, id)
+	for _, path := range paths {
+		if a.keys[path].refs--; a.keys[path].refs > 0 {
+			continue
+		}
+		delete(a.keys, path)
+		if err := a.store.Delete(path, false); err != nil && err != errKeyNotFound {
+			logger.Error("error deleting member key", "action", "unregister", "key", path, "error", err.Error())
+			continue
+		}
+		logger.Info("member key deleted", "action", "unregister", "container", shortContainerId(id), "key", path)
+	}
+}
+
+// Refresh the ttl of the member keys. Keys removed from a multiple class load balancer are set again,
+// while keys removed from a single class one aren't, as that means another member was switched in.
+func (a *Agent) refresh() {
+	paths := []string{}
+	for path := range a.keys {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		key := a.keys[path]
+		if key.removed {
+			continue
+		}
+		if !key.set {
+			a.setKey(path)
+			continue
+		}
+		refresher, ok := a.store.(refreshingStore)
+		if !ok {
+			a.setKey(path)
+			continue
+		}
+		err := refresher.Refresh(path, uint64(a.ttl.Seconds()))
+		switch {
+		case err == errKeyNotFound && key.key.class == "single":
+			key.removed = true
+			logger.Warn("member key removed from single class load balancer, not setting it again until the container restarts", "action", "refresh", "key", path)
+		case err == errKeyNotFound:
+			logger.Warn("member key removed, setting it again", "action", "refresh", "key", path)
+			a.setKey(path)
+		case err != nil:
+			logger.Error("error refreshing member key", "action", "refresh", "key", path, "error", err.Error())
+		}
+	}
+}
+
+// Set a member key with the agent's ttl
+func (a *Agent) setKey(path string) {
+	key := a.keys[path]
+	if err := a.store.Set(path, "", uint64(a.ttl.Seconds())); err != nil {
+		logger.Error("error setting member key", "action", "register", "key", path, "error", err.Error())
+		return
+	}
+	key.set = true
+	logger.Info("member key set", "action", "register", "key", path)
+}
+
+// Get the member keys set in the labels of a container, as comma separated lists of load balancers:
+//
+//	lbmanager.elb=REGION/LB_NAME/LB_CLASS
+//	lbmanager.route53=REGION/HOSTED_ZONE/FQDN/LB_CLASS
+func (a *Agent) memberKeys(id string, labels map[string]string) []*memberKey {
+	keys := []*memberKey{}
+	for _, lbType := range []string{"elb", "route53"} {
+		value := labels[agentLabelPrefix+lbType]
+		if value == "" {
+			continue
+		}
+		member := a.instanceId
+		if lbType == "route53" {
+			member = a.ip
+		}
+		for _, lb := range strings.Split(value, ",") {
+			args := append([]string{lbType}, strings.Split(strings.TrimSpace(lb), "/")...)
+			key, err := parseMemberKey(append(args, member), true, true)
+			if err != nil {
+				logger.Error("invalid container label", "action", "register", "container", shortContainerId(id), "label", agentLabelPrefix+lbType, "error", err.Error())
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Get the short form of a container id, as shown by docker ps
+func shortContainerId(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type ApiServer struct {
+	Addr    string
+	Manager *Manager
+}
+
+// Start serving the admin api
+func (s *ApiServer) Start() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/loadbalancers", s.handleLoadBalancers)
+	mux.HandleFunc("/loadbalancers/", s.handleLoadBalancer)
+	mux.HandleFunc("/zoneupdaters", s.handleZoneUpdaters)
+	mux.HandleFunc("/sync", s.handleSyncAll)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+
+	logger.Info("admin api listening", "action", "startApi", "addr", s.Addr)
+	if err := http.ListenAndServe(s.Addr, mux); err != nil {
+		logger.Error("error serving admin api", "action", "startApi", "error", err.Error())
+	}
+}
+
+// List all the load balancers managed
+func (s *ApiServer) handleLoadBalancers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	s.writeJSON(w, http.StatusOK, s.Manager.LoadBalancersStatus())
+}
+
+// Handle requests for a single load balancer: /loadbalancers/ID[/sync|/diff]
+func (s *ApiServer) handleLoadBalancer(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/loadbalancers/"), "/")
+	id, action := parts[0], ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	if id == "" || len(parts) > 2 {
+		s.writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		lb, err := s.Manager.findLoadBalancer(id)
+		if err != nil {
+			s.writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		s.writeJSON(w, http.StatusOK, lb.Status())
+	case action == "diff" && r.Method == "GET":
+		if _, err := s.Manager.findLoadBalancer(id); err != nil {
+			s.writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		diff, err := s.Manager.Diff(id)
+		if err != nil {
+			s.writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		s.writeJSON(w, http.StatusOK, diff)
+	case action == "sync" && r.Method == "POST":
+		if err := s.Manager.SyncLoadBalancer(id); err != nil {
+			s.writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		s.writeJSON(w, http.StatusAccepted, map[string]string{"id": id, "status": "syncTriggered"})
+	case action == "" || action == "diff" || action == "sync":
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		s.writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// List the zone updaters and their queues
+func (s *ApiServer) handleZoneUpdaters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	s.writeJSON(w, http.StatusOK, s.Manager.ZoneUpdatersStatus())
+}
+
+// Trigger a sync in all the load balancers managed
+func (s *ApiServer) handleSyncAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	go s.Manager.SyncAll()
+	s.writeJSON(w, http.StatusAccepted, map[string]string{"status": "syncTriggered"})
+}
+
+// Expose metrics in Prometheus text format
+func (s *ApiServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.Manager.updateMetrics()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := metrics.WriteTo(w); err != nil {
+		logger.Warn("error writing metrics", "action", "writeMetrics", "error", err.Error())
+	}
+}
+
+// Write a JSON encoded response
+func (s *ApiServer) writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		logger.Warn("error writing api response", "action", "writeResponse", "error", err.Error())
+	}
+}
+
+// Write a JSON encoded error response
+func (s *ApiServer) writeError(w http.ResponseWriter, code int, message string) {
+	s.writeJSON(w, code, map[string]string{"error": message})
+}
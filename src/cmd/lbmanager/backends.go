@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Valid plugin names, so that the directories lbManager uses in the configuration tree aren't taken as
+// plugins
+var pluginNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Load balancer backend, managing the load balancers under its type directory in the configuration tree.
+// Backends register themselves with registerBackend, declaring their key layout:
+//
+//	/lbManager/TYPE/FIELD.../LB_CLASS/MEMBER
+type lbBackend struct {
+	// Segments of the member keys after the type, the last two ones being "class" and "member". The others
+	// are set in the load balancer metadata under the same names (region, hostedZone or name).
+	fields []string
+	// Names of the fields shown in the usage of the commands, as in INSTANCE_ID
+	usage []string
+	// Fields identifying a load balancer of the type, joined with "_" after the type to build its id
+	idFields []string
+	// Fields of the option scopes applying to the load balancers, from the most specific scope
+	optionsScopes [][]string
+	// Validate the type specific segments of a member key
+	validate func(k *memberKey) error
+	// Build the load balancer of a config entry
+	build func(m *Manager, configEntry *configEntry) LoadBalancer
+}
+
+var (
+	// Backends of the built in load balancer types, by type
+	backends = make(map[string]*lbBackend)
+
+	// Built in load balancer types, as used in the configuration tree
+	lbTypes = []string{}
+)
+
+// Register the backend of a built in load balancer type
+func registerBackend(lbType string, backend *lbBackend) {
+	n := len(backend.fields)
+	if n < 2 || backend.fields[n-2] != "class" || backend.fields[n-1] != "member" || len(backend.usage) != n {
+		panic(fmt.Sprintf("invalid key layout for %s backend: %s", lbType, strings.Join(backend.fields, "/")))
+	}
+	if _, exists := backends[lbType]; exists {
+		panic("backend registered twice: " + lbType)
+	}
+	backends[lbType] = backend
+	lbTypes = append(lbTypes, lbType)
+	sort.Strings(lbTypes)
+}
+
+// Get the backend of a load balancer type: a built in one, or the exec backend if there's a plugin
+// with the name of the type. Returns nil if there's none.
+func lookupBackend(lbType string) *lbBackend {
+	if backend, exists := backends[lbType]; exists {
+		return backend
+	}
+	if isPlugin(lbType) {
+		return execBackend
+	}
+	return nil
+}
+
+// Parse a member key of the configuration tree, relative to the config path, into a config entry.
+// Returns nil if the key isn't a member key of a load balancer type having a backend.
+func (b *lbBackend) parseKey(segments []string) *configEntry {
+	if len(segments)-1 != len(b.fields) {
+		return nil
+	}
+	entry := &configEntry{lbType: segments[0], lbMetadata: make(map[string]string)}
+	for i, field := range b.fields {
+		if field == "member" {
+			entry.memberId = segments[i+1]
+		} else {
+			entry.lbMetadata[field] = segments[i+1]
+		}
+	}
+	entry.lbId = b.lbId(entry.lbType, entry.lbMetadata)
+	return entry
+}
+
+// Build the id of a load balancer of the backend given its metadata
+func (b *lbBackend) lbId(lbType string, meta map[string]string) string {
+	id := []string{lbType}
+	for _, field := range b.idFields {
+		id = append(id, meta[field])
+	}
+	return strings.Join(id, "_")
+}
+
+// Get the paths in the configuration tree whose options apply to a load balancer of the backend
+func (b *lbBackend) scopes(configPath string, lbType string, meta map[string]string) []string {
+	scopes := []string{}
+	for _, fields := range b.optionsScopes {
+		scope := configPath + "/" + lbType
+		for _, field := range fields {
+			scope += "/" + meta[field]
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes
+}
+
+// Check if a load balancer type is run by a plugin, that is, an executable file with its name in the
+// plugins directory
+func isPlugin(lbType string) bool {
+	if backends[lbType] != nil || execSettings.dir == "" || !pluginNameRe.MatchString(lbType) {
+		return false
+	}
+	info, err := os.Stat(pluginPath(lbType))
+	return err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
+}
+
+// Get the path of the plugin running a load balancer type
+func pluginPath(lbType string) string {
+	return filepath.Join(execSettings.dir, lbType)
+}
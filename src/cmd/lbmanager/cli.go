@@ -0,0 +1,351 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Interval between checks while waiting for changes to reach the load balancers
+const waitInterval = 2 * time.Second
+
+type command struct {
+	description string
+	run         func(m *Manager, args []string) int
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"add":    {"Add a member to a load balancer", runAdd},
+		"adopt":  {"Write the members of a load balancer in AWS to the config", runAdopt},
+		"agent":  {"Register the local Docker containers in the load balancers set in their labels", runAgent},
+		"drain":  {"Remove a member from all the load balancers it belongs to", runDrain},
+		"list":   {"List load balancers and their members in the config", runList},
+		"plan":   {"Print the changes needed in the load balancers without applying them", runPlan},
+		"remove": {"Remove a member from a load balancer", runRemove},
+		"status": {"Show the members of a load balancer in the config and in AWS", runStatus},
+		"switch": {"Set the only member of a single class load balancer", runSwitch},
+	}
+}
+
+// Build the flag set of a command, printing the arguments expected on usage
+func newCommandFlagSet(name string, args string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] %s [command flags] %s\n\n%s\n", os.Args[0], name, args, commands[name].description)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// Print an error and return the exit code for failed commands
+func commandFailed(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+	return 1
+}
+
+// Print the changes needed in the load balancers and exit
+func runPlan(m *Manager, args []string) int {
+	flags := newCommandFlagSet("plan", "")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return 2
+	}
+	diffs, err := m.Plan(m.configPath)
+	if err != nil {
+		return commandFailed(err)
+	}
+	printPlan(os.Stdout, m, diffs)
+	return 0
+}
+
+// Add a member to a load balancer:
+//
+//	add [-wait=D] [-create] [-ttl=D] elb REGION LB_NAME LB_CLASS INSTANCE_ID
+//	add [-wait=D] [-create] [-ttl=D] route53 REGION HOSTED_ZONE FQDN LB_CLASS IP
+//	add [-wait=D] [-create] [-ttl=D] haproxy BACKEND LB_CLASS IP:PORT
+//	add [-wait=D] [-create] [-ttl=D] nginx UPSTREAM LB_CLASS IP:PORT
+//	add [-wait=D] [-create] [-ttl=D] webhook NAME LB_CLASS MEMBER
+func runAdd(m *Manager, args []string) int {
+	flags := newCommandFlagSet("add", memberKeysUsage(true, true))
+	wait := flags.Duration("wait", 0, "Wait until the member is in the load balancer in AWS (0 to not wait)")
+	create := flags.Bool("create", false, "Allow adding a member to a load balancer not present in the config yet")
+	ttl := flags.Duration("ttl", 0, "Remove the member automatically unless it's added again within this time (0 to keep it)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	key, err := parseMemberKey(flags.Args(), true, true)
+	if err != nil {
+		return commandFailed(err)
+	}
+	return addMember(m, key, *create, *ttl, *wait)
+}
+
+// Set the only member of a single class load balancer:
+//
+//	switch [-wait=D] [-create] [-ttl=D] elb REGION LB_NAME INSTANCE_ID
+//	switch [-wait=D] [-create] [-ttl=D] route53 REGION HOSTED_ZONE FQDN IP
+//	switch [-wait=D] [-create] [-ttl=D] haproxy BACKEND IP:PORT
+//	switch [-wait=D] [-create] [-ttl=D] nginx UPSTREAM IP:PORT
+//	switch [-wait=D] [-create] [-ttl=D] webhook NAME MEMBER
+func runSwitch(m *Manager, args []string) int {
+	flags := newCommandFlagSet("switch", memberKeysUsage(false, true))
+	wait := flags.Duration("wait", 0, "Wait until the member is the only one in the load balancer in AWS (0 to not wait)")
+	create := flags.Bool("create", false, "Allow switching a load balancer not present in the config yet")
+	ttl := flags.Duration("ttl", 0, "Remove the member automatically unless it's switched again within this time (0 to keep it)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	key, err := parseMemberKey(flags.Args(), false, true)
+	if err != nil {
+		return commandFailed(err)
+	}
+	key.class = "single"
+	// Serialize switches of the same load balancer when the config store supports locks
+	if locker, ok := m.store.(lockingStore); ok {
+		lockKey := m.configPath + "/" + locksDir + "/" + key.lbId()
+		if _, err := locker.Lock(lockKey, nil); err != nil {
+			return commandFailed(fmt.Errorf("%s: error acquiring lock: %s", key.lbId(), err))
+		}
+		defer locker.Unlock(lockKey)
+	}
+	return addMember(m, key, *create, *ttl, *wait)
+}
+
+// Add a member key to the config, checking first that the load balancer already exists in it. Keys with
+// a ttl are removed from the config store when it expires (etcd v3 attaches them to a lease).
+func addMember(m *Manager, key *memberKey, create bool, ttl time.Duration, wait time.Duration) int {
+	if _, err := m.store.List(key.lbPath(m.configPath)); err != nil && !create {
+		return commandFailed(fmt.Errorf("load balancer %s not found in config (%s), use -create to add it", key.lbId(), err))
+	}
+	if ttl > 0 && ttl < time.Second {
+		return commandFailed(fmt.Errorf("invalid ttl: %s (minimum 1s)", ttl))
+	}
+	if err := m.store.Set(key.path(m.configPath), "", uint64(ttl.Seconds())); err != nil {
+		return commandFailed(err)
+	}
+	fmt.Printf("%s: member %s added (%s)\n", key.lbId(), key.member, key.class)
+	if wait > 0 {
+		if err := waitForMember(m, key, true, wait); err != nil {
+			return commandFailed(err)
+		}
+	}
+	return 0
+}
+
+// Remove a member from a load balancer:
+//
+//	remove [-wait=D] elb REGION LB_NAME LB_CLASS INSTANCE_ID
+//	remove [-wait=D] route53 REGION HOSTED_ZONE FQDN LB_CLASS IP
+//	remove [-wait=D] haproxy BACKEND LB_CLASS IP:PORT
+//	remove [-wait=D] nginx UPSTREAM LB_CLASS IP:PORT
+//	remove [-wait=D] webhook NAME LB_CLASS MEMBER
+func runRemove(m *Manager, args []string) int {
+	flags := newCommandFlagSet("remove", memberKeysUsage(true, true))
+	wait := flags.Duration("wait", 0, "Wait until the member is not in the load balancer in AWS (0 to not wait)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	key, err := parseMemberKey(flags.Args(), true, true)
+	if err != nil {
+		return commandFailed(err)
+	}
+	return removeMembers(m, []*memberKey{key}, *wait)
+}
+
+// Remove a member from all the load balancers it belongs to:
+//
+//	drain [-wait=D] MEMBER
+func runDrain(m *Manager, args []string) int {
+	flags := newCommandFlagSet("drain", "INSTANCE_ID|IP")
+	wait := flags.Duration("wait", 0, "Wait until the member is not in any of the load balancers in AWS (0 to not wait)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	entries, err := readConfigEntries(m)
+	if err != nil {
+		return commandFailed(err)
+	}
+	keys := []*memberKey{}
+	for _, entry := range entries {
+		if entry.memberId == flags.Arg(0) {
+			keys = append(keys, memberKeyFromEntry(entry))
+		}
+	}
+	if len(keys) == 0 {
+		return commandFailed(fmt.Errorf("member %s not found in any load balancer", flags.Arg(0)))
+	}
+	return removeMembers(m, keys, *wait)
+}
+
+// Remove member keys from the config
+func removeMembers(m *Manager, keys []*memberKey, wait time.Duration) int {
+	for _, key := range keys {
+		if err := m.store.Delete(key.path(m.configPath), false); err != nil {
+			return commandFailed(fmt.Errorf("%s: error removing member %s: %s", key.lbId(), key.member, err))
+		}
+		fmt.Printf("%s: member %s removed\n", key.lbId(), key.member)
+	}
+	if wait > 0 {
+		deadline := time.Now().Add(wait)
+		for _, key := range keys {
+			if err := waitForMember(m, key, false, deadline.Sub(time.Now())); err != nil {
+				return commandFailed(err)
+			}
+		}
+	}
+	return 0
+}
+
+// List load balancers and their members in the config:
+//
+//	list [elb|route53|haproxy|nginx|webhook]
+func runList(m *Manager, args []string) int {
+	flags := newCommandFlagSet("list", "["+strings.Join(lbTypes, "|")+"]")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+		return 2
+	}
+	entries, err := readConfigEntries(m)
+	if err != nil {
+		return commandFailed(err)
+	}
+	lbs := map[string][]string{}
+	ids := []string{}
+	for _, entry := range entries {
+		if flags.NArg() == 1 && entry.lbType != flags.Arg(0) {
+			continue
+		}
+		if _, exists := lbs[entry.lbId]; !exists {
+			ids = append(ids, entry.lbId)
+		}
+		lbs[entry.lbId] = append(lbs[entry.lbId], entry.memberId+" ("+entry.lbMetadata["class"]+")")
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		fmt.Printf("%s: %s\n", id, strings.Join(lbs[id], ", "))
+	}
+	return 0
+}
+
+// Show the members of a load balancer in the config and in AWS:
+//
+//	status elb REGION LB_NAME
+//	status route53 REGION HOSTED_ZONE FQDN
+//	status haproxy BACKEND
+//	status nginx UPSTREAM
+//	status webhook NAME
+func runStatus(m *Manager, args []string) int {
+	flags := newCommandFlagSet("status", memberKeysUsage(false, false))
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	key, err := parseMemberKey(flags.Args(), false, false)
+	if err != nil {
+		return commandFailed(err)
+	}
+	diffs, err := m.Plan(key.lbPath(m.configPath))
+	if err != nil {
+		return commandFailed(fmt.Errorf("load balancer %s not found in config (%s)", key.lbId(), err))
+	}
+	for _, diff := range diffs {
+		if diff.Id == key.lbId() {
+			fmt.Printf("id:       %s\n", diff.Id)
+			fmt.Printf("config:   %s\n", strings.Join(diff.Desired, " "))
+			fmt.Printf("aws:      %s\n", strings.Join(diff.Actual, " "))
+			fmt.Printf("toAdd:    %s\n", strings.Join(diff.ToAdd, " "))
+			fmt.Printf("toRemove: %s\n", strings.Join(diff.ToRemove, " "))
+			if len(diff.ToAdd) > 0 || len(diff.ToRemove) > 0 {
+				return 1
+			}
+			return 0
+		}
+	}
+	return commandFailed(fmt.Errorf("load balancer %s has no members in config", key.lbId()))
+}
+
+// Read all the config entries in the config tree
+func readConfigEntries(m *Manager) ([]*configEntry, error) {
+	entries := []*configEntry{}
+	readConfigCh, readConfigDoneCh := m.readConfig(m.configPath)
+	for {
+		select {
+		case entry := <-readConfigCh:
+			entries = append(entries, entry)
+		case err := <-readConfigDoneCh:
+			return entries, err
+		}
+	}
+}
+
+// Load balancers whose members may be set in the config in a different form than in the real service
+type memberResolver interface {
+	resolveMember(member string) (string, error)
+}
+
+// Check if a member is in the list of members provided
+func containsMember(members []string, member string) bool {
+	for _, m := range members {
+		if m == member {
+			return true
+		}
+	}
+	return false
+}
+
+// Build the member key corresponding to a config entry
+func memberKeyFromEntry(entry *configEntry) *memberKey {
+	return &memberKey{
+		class:      entry.lbMetadata["class"],
+		hostedZone: entry.lbMetadata["hostedZone"],
+		lbType:     entry.lbType,
+		member:     entry.memberId,
+		name:       entry.lbMetadata["name"],
+		region:     entry.lbMetadata["region"],
+	}
+}
+
+// Wait until the member is present in (or absent from) the load balancer in AWS. Members of single class
+// load balancers must also be the only member present.
+func waitForMember(m *Manager, key *memberKey, present bool, timeout time.Duration) error {
+	if err := m.loadOptions(); err != nil {
+		return err
+	}
+	lb := m.getLoadBalancer(&configEntry{
+		lbType:     key.lbType,
+		lbId:       key.lbId(),
+		lbMetadata: key.metadata(),
+	})
+	deadline := time.Now().Add(timeout)
+	for {
+		member := key.member
+		var err error
+		if resolver, ok := lb.(memberResolver); ok {
+			member, err = resolver.resolveMember(key.member)
+		}
+		var diff *LBDiff
+		if err == nil {
+			diff, err = lb.Diff()
+		}
+		if err == nil {
+			if containsMember(diff.Actual, member) == present && (!present || key.class != "single" || len(diff.Actual) == 1) {
+				fmt.Printf("%s: member %s synced in AWS\n", key.lbId(), key.member)
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("%s: timeout waiting for member %s to sync in AWS: %s", key.lbId(), key.member, err)
+			}
+			return fmt.Errorf("%s: timeout waiting for member %s to sync in AWS (members in AWS: %s)", key.lbId(), key.member, strings.Join(diff.Actual, " "))
+		}
+		time.Sleep(waitInterval)
+	}
+}
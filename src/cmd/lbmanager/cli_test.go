@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Run a function returning the output it printed
+func captureStdout(t *testing.T, run func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	run()
+	w.Close()
+	output, _ := ioutil.ReadAll(r)
+	return string(output)
+}
+
+func TestCliWithOptionsAndHolds(t *testing.T) {
+	fake := newFakeConsul(t)
+	fake.set("lbManager/elb/us-east-1/_options", `{"profile": "prod"}`)
+	fake.set("lbManager/_holds/elb_us-east-1_web", "")
+	fake.set("lbManager/elb/us-east-1/web/multiple/i-11111111", "")
+	fake.set("lbManager/route53/us-east-1/Z1/www.example.com/multiple/10.0.0.1", "")
+	m := &Manager{configPath: "/lbManager", store: fake.store(t)}
+
+	var code int
+	output := captureStdout(t, func() { code = runList(m, nil) })
+	want := "elb_us-east-1_web: i-11111111 (multiple)\nroute53_Z1_www.example.com: 10.0.0.1 (multiple)\n"
+	if code != 0 || output != want {
+		t.Errorf("list: got exit code %d and output:\n%s\nwant:\n%s", code, output, want)
+	}
+
+	output = captureStdout(t, func() { code = runDrain(m, []string{"i-11111111"}) })
+	if want := "elb_us-east-1_web: member i-11111111 removed\n"; code != 0 || output != want {
+		t.Errorf("drain: got exit code %d and output %q, want %q", code, output, want)
+	}
+	if fake.kvs["lbManager/elb/us-east-1/web/multiple/i-11111111"] != nil {
+		t.Error("drain: got the member key kept")
+	}
+	if fake.kvs["lbManager/elb/us-east-1/_options"] == nil || fake.kvs["lbManager/_holds/elb_us-east-1_web"] == nil {
+		t.Error("drain: got the options or the hold removed")
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum time a blocking query waits for changes
+	consulWatchWait = 5 * time.Minute
+	// Time to wait before returning when a watch fails, so that it isn't retried in a tight loop
+	consulWatchRetryDelay = time.Second
+	// TTL of the sessions holding locks, renewed while they are held
+	consulLockTTL = 15 * time.Second
+	// Time between attempts to acquire a lock held by someone else
+	consulLockRetryDelay = 5 * time.Second
+	// Minimum TTL of a Consul session
+	consulMinSessionTTL = 10 * time.Second
+)
+
+// Config store using the Consul KV HTTP API. Keys are stored without the leading slash. Changes are
+// watched using blocking queries on the config prefix, resuming from the last index seen, and keys
+// with a ttl and locks are held by sessions.
+type consulStore struct {
+	address     string
+	client      *http.Client
+	locks       map[string]*consulLock
+	mu          sync.Mutex
+	token       string
+	watchClient *http.Client
+	watchIndex  uint64
+	watchKeys   map[string]*consulKeyValue
+}
+
+type consulKeyValue struct {
+	Key         string
+	ModifyIndex uint64
+	Session     string
+	Value       []byte
+}
+
+// Lock held by a session, renewed until released
+type consulLock struct {
+	releaseCh chan bool
+	session   string
+}
+
+// Create a Consul config store
+func newConsulStore(options *storeOptions) (*consulStore, error) {
+	if len(options.machines) == 0 || options.machines[0] == "" {
+		return nil, fmt.Errorf("consul address missing")
+	}
+	return &consulStore{
+		address:     strings.TrimSuffix(options.machines[0], "/"),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		locks:       make(map[string]*consulLock),
+		token:       options.token,
+		watchClient: &http.Client{Timeout: consulWatchWait + 30*time.Second},
+	}, nil
+}
+
+// Get all the keys under a path
+func (s *consulStore) List(path string) ([]*storeNode, error) {
+	kvs, _, err := s.list(path, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return consulNodes(kvs)
+}
+
+// Get all the keys under a path, comparing the changes seen by the next watch with them
+func (s *consulStore) Snapshot(path string) ([]*storeNode, error) {
+	kvs, index, err := s.list(path, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]*consulKeyValue)
+	for _, kv := range kvs {
+		current[kv.Key] = kv
+	}
+	s.mu.Lock()
+	s.watchIndex, s.watchKeys = index, current
+	s.mu.Unlock()
+	return consulNodes(kvs)
+}
+
+// Build the store nodes of the keys read, or errKeyNotFound if there are none
+func consulNodes(kvs []*consulKeyValue) ([]*storeNode, error) {
+	if len(kvs) == 0 {
+		return nil, errKeyNotFound
+	}
+	nodes := []*storeNode{}
+	for _, kv := range kvs {
+		nodes = append(nodes, kv.node("get"))
+	}
+	return nodes, nil
+}
+
+// Set a key, holding it with a session that deletes it on expiration when a ttl is provided. The
+// session holding the key from a previous set is released and destroyed, so that they don't pile up.
+func (s *consulStore) Set(key string, value string, ttl uint64) error {
+	if err := s.releaseHolder(key); err != nil {
+		return err
+	}
+	params := url.Values{}
+	session := ""
+	if ttl > 0 {
+		sessionTTL := time.Duration(ttl) * time.Second
+		if sessionTTL < consulMinSessionTTL {
+			sessionTTL = consulMinSessionTTL
+		}
+		var err error
+		if session, err = s.createSession(sessionTTL, "delete"); err != nil {
+			return err
+		}
+		params.Set("acquire", session)
+	}
+	var ok bool
+	err := s.request("PUT", "/v1/kv/"+consulKey(key), params, []byte(value), &ok)
+	if err == nil && !ok {
+		err = fmt.Errorf("error setting %s: key locked by another session", key)
+	}
+	if err != nil && session != "" {
+		s.request("PUT", "/v1/session/destroy/"+session, nil, nil, nil)
+	}
+	return err
+}
+
+// Release a key from the session holding it, if any, destroying the session
+func (s *consulStore) releaseHolder(key string) error {
+	kvs := []*consulKeyValue{}
+	if err := s.request("GET", "/v1/kv/"+consulKey(key), nil, nil, &kvs); err != nil && err != errKeyNotFound {
+		return err
+	}
+	if len(kvs) == 0 || kvs[0].Session == "" {
+		return nil
+	}
+	if err := s.request("PUT", "/v1/kv/"+consulKey(key), url.Values{"release": {kvs[0].Session}}, kvs[0].Value, nil); err != nil {
+		return err
+	}
+	return s.request("PUT", "/v1/session/destroy/"+kvs[0].Session, nil, nil, nil)
+}
+
+// Refresh the ttl of a key, renewing the session holding it
+func (s *consulStore) Refresh(key string, ttl uint64) error {
+	kvs := []*consulKeyValue{}
+	if err := s.request("GET", "/v1/kv/"+consulKey(key), nil, nil, &kvs); err != nil {
+		return err
+	}
+	if len(kvs) == 0 {
+		return errKeyNotFound
+	}
+	if kvs[0].Session == "" {
+		return nil
+	}
+	return s.request("PUT", "/v1/session/renew/"+kvs[0].Session, nil, nil, nil)
+}
+
+// Delete a key, along with the keys under its path when recursive
+func (s *consulStore) Delete(key string, recursive bool) error {
+	if err := s.request("DELETE", "/v1/kv/"+consulKey(key), nil, nil, nil); err != nil {
+		return err
+	}
+	if recursive {
+		return s.request("DELETE", "/v1/kv/"+consulKey(key)+"/", url.Values{"recurse": {""}}, nil, nil)
+	}
+	return nil
+}
+
+// Watch the changes under a path using blocking queries. As they return all the keys under the path,
+// changes are found comparing them with the keys returned by the previous query, or by Snapshot.
+func (s *consulStore) Watch(path string, nodesCh chan *storeNode, stopCh chan bool) error {
+	defer close(nodesCh)
+	s.mu.Lock()
+	index, previous := s.watchIndex, s.watchKeys
+	s.mu.Unlock()
+	for {
+		var (
+			kvs []*consulKeyValue
+			err error
+		)
+		if previous == nil {
+			// Get the current keys to compare the following changes with
+			kvs, index, err = s.list(path, 0, stopCh)
+		} else {
+			kvs, index, err = s.list(path, index, stopCh)
+		}
+		if err != nil {
+			select {
+			case <-stopCh:
+				return nil
+			case <-time.After(consulWatchRetryDelay):
+			}
+			return err
+		}
+		current := make(map[string]*consulKeyValue)
+		for _, kv := range kvs {
+			current[kv.Key] = kv
+		}
+		if previous != nil {
+			for _, node := range consulChanges(previous, current) {
+				select {
+				case nodesCh <- node:
+				case <-stopCh:
+					return nil
+				}
+			}
+		}
+		previous = current
+		s.mu.Lock()
+		s.watchIndex, s.watchKeys = index, current
+		s.mu.Unlock()
+	}
+}
+
+// Acquire a lock, using a session renewed until the lock is released
+func (s *consulStore) Lock(key string, stopCh chan bool) (chan bool, error) {
+	session, err := s.createSession(consulLockTTL, "release")
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var acquired bool
+		err := s.request("PUT", "/v1/kv/"+consulKey(key), url.Values{"acquire": {session}}, []byte(session), &acquired)
+		if err == nil && acquired {
+			break
+		}
+		if err != nil {
+			logger.Warn("error acquiring lock", "action", "lock", "key", key, "error", err.Error())
+		}
+		select {
+		case <-stopCh:
+			s.request("PUT", "/v1/session/destroy/"+session, nil, nil, nil)
+			return nil, errLockStopped
+		case <-time.After(consulLockRetryDelay):
+		}
+		// Keep the session alive while waiting
+		if err := s.request("PUT", "/v1/session/renew/"+session, nil, nil, nil); err != nil {
+			if session, err = s.createSession(consulLockTTL, "release"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	lock := &consulLock{releaseCh: make(chan bool), session: session}
+	s.mu.Lock()
+	s.locks[key] = lock
+	s.mu.Unlock()
+	lostCh := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-lock.releaseCh:
+				return
+			case <-time.After(consulLockTTL / 2):
+			}
+			if err := s.request("PUT", "/v1/session/renew/"+session, nil, nil, nil); err != nil {
+				logger.Error("error renewing lock session, lock lost", "action", "lock", "key", key, "error", err.Error())
+				close(lostCh)
+				return
+			}
+		}
+	}()
+	return lostCh, nil
+}
+
+// Release a lock, destroying its session
+func (s *consulStore) Unlock(key string) error {
+	s.mu.Lock()
+	lock, exists := s.locks[key]
+	delete(s.locks, key)
+	s.mu.Unlock()
+	if !exists {
+		return fmt.Errorf("lock %s not held", key)
+	}
+	close(lock.releaseCh)
+	if err := s.request("PUT", "/v1/kv/"+consulKey(key), url.Values{"release": {lock.session}}, nil, nil); err != nil {
+		return err
+	}
+	return s.request("PUT", "/v1/session/destroy/"+lock.session, nil, nil, nil)
+}
+
+// Get the keys under a path, blocking until they change if an index is provided
+func (s *consulStore) list(path string, index uint64, stopCh chan bool) ([]*consulKeyValue, uint64, error) {
+	params := url.Values{"recurse": {""}}
+	client := s.client
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", fmt.Sprintf("%ds", int(consulWatchWait.Seconds())))
+		client = s.watchClient
+	}
+	req, err := s.newRequest("GET", "/v1/kv/"+consulKey(strings.TrimSuffix(path, "/")+"/"), params, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if stopCh != nil {
+		cancelCh, doneCh := make(chan struct{}), make(chan struct{})
+		defer close(doneCh)
+		go func() {
+			select {
+			case <-stopCh:
+				close(cancelCh)
+			case <-doneCh:
+			}
+		}()
+		req.Cancel = cancelCh
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if newIndex < index {
+		// The index went backwards (the Consul cluster was restored, for example), start over
+		newIndex = 0
+	}
+	kvs := []*consulKeyValue{}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&kvs); err != nil {
+			return nil, 0, err
+		}
+	default:
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, 0, fmt.Errorf("got status code: %d (%s)", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	// Folders created from the Consul UI are keys ending in a slash
+	keys := []*consulKeyValue{}
+	for _, kv := range kvs {
+		if !strings.HasSuffix(kv.Key, "/") {
+			keys = append(keys, kv)
+		}
+	}
+	return keys, newIndex, nil
+}
+
+// Create a session with the ttl and behavior provided, returning its id
+func (s *consulStore) createSession(ttl time.Duration, behavior string) (string, error) {
+	body, _ := json.Marshal(map[string]string{
+		"Name":      "lbmanager",
+		"TTL":       fmt.Sprintf("%ds", int(ttl.Seconds())),
+		"Behavior":  behavior,
+		"LockDelay": "1s",
+	})
+	var session struct {
+		ID string
+	}
+	if err := s.request("PUT", "/v1/session/create", nil, body, &session); err != nil {
+		return "", fmt.Errorf("error creating session: %s", err)
+	}
+	return session.ID, nil
+}
+
+// Send a request to the Consul API, decoding the JSON response into resp if provided
+func (s *consulStore) request(method string, path string, params url.Values, body []byte, resp interface{}) error {
+	req, err := s.newRequest(method, path, params, body)
+	if err != nil {
+		return err
+	}
+	httpResp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	data, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return err
+	}
+	if httpResp.StatusCode == http.StatusNotFound {
+		return errKeyNotFound
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status code: %d (%s)", httpResp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.Unmarshal(data, resp)
+}
+
+// Build a request to the Consul API
+func (s *consulStore) newRequest(method string, path string, params url.Values, body []byte) (*http.Request, error) {
+	u := s.address + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+	return req, nil
+}
+
+// Get the changes between two sets of keys, sorted as they were made (keys deleted go last, as their
+// index is unknown)
+func consulChanges(previous, current map[string]*consulKeyValue) []*storeNode {
+	nodes := storeNodesByIndex{}
+	for key, kv := range current {
+		if old, exists := previous[key]; !exists || old.ModifyIndex != kv.ModifyIndex {
+			nodes = append(nodes, kv.node("set"))
+		}
+	}
+	sort.Sort(nodes)
+	for key, kv := range previous {
+		if _, exists := current[key]; !exists {
+			node := kv.node("delete")
+			node.value = ""
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// Build a store node from a Consul key
+func (kv *consulKeyValue) node(action string) *storeNode {
+	return &storeNode{
+		action: action,
+		index:  kv.ModifyIndex,
+		key:    "/" + kv.Key,
+		value:  string(kv.Value),
+	}
+}
+
+// Get the Consul key for a config store key, which don't start with a slash
+func consulKey(key string) string {
+	return strings.TrimPrefix(key, "/")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsulStoreList(t *testing.T) {
+	fake := newFakeConsul(t)
+	fake.set("lbManager/elb/us-east-1/web/multiple/i-11111111", "")
+	fake.set("lbManager/route53/us-east-1/Z1/www.example.com/single/10.0.0.1", "value")
+	fake.set("lbManager/elb/", "")
+	fake.set("lbManagerOther/key", "")
+	store := fake.store(t)
+
+	nodes, err := store.List("/lbManager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, node := range nodes {
+		got = append(got, node.action+" "+node.key+"="+node.value)
+	}
+	want := []string{
+		"get /lbManager/elb/us-east-1/web/multiple/i-11111111=",
+		"get /lbManager/route53/us-east-1/Z1/www.example.com/single/10.0.0.1=value",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got nodes:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if query := fake.queries[len(fake.queries)-1]; query != "recurse=" {
+		t.Errorf("got query %q, want a recursive one", query)
+	}
+}
+
+func TestConsulStoreKeyNotFound(t *testing.T) {
+	store := newFakeConsul(t).store(t)
+
+	if _, err := store.List("/lbManager"); err != errKeyNotFound {
+		t.Errorf("List: got error %v, want errKeyNotFound", err)
+	}
+	if err := store.Refresh("/lbManager/elb/us-east-1/web/multiple/i-11111111", 60); err != errKeyNotFound {
+		t.Errorf("Refresh: got error %v, want errKeyNotFound", err)
+	}
+}
+
+func TestConsulStoreWatch(t *testing.T) {
+	fake := newFakeConsul(t)
+	fake.set("lbManager/elb/us-east-1/web/multiple/i-11111111", "")
+	fake.set("lbManager/elb/us-east-1/web/multiple/i-22222222", "")
+	store := fake.store(t)
+
+	nodesCh, stopCh, errCh := make(chan *storeNode), make(chan bool), make(chan error, 1)
+	go func() {
+		errCh <- store.Watch("/lbManager", nodesCh, stopCh)
+	}()
+	// Wait for the watch to block on the index of the current keys
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		fake.mu.Lock()
+		queries := len(fake.queries)
+		fake.mu.Unlock()
+		if queries >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("watch didn't start a blocking query")
+		}
+	}
+	fake.set("lbManager/elb/us-east-1/web/multiple/i-33333333", "")
+	expectNode(t, nodesCh, "set /lbManager/elb/us-east-1/web/multiple/i-33333333")
+	fake.set("lbManager/elb/us-east-1/web/multiple/i-11111111", "updated")
+	expectNode(t, nodesCh, "set /lbManager/elb/us-east-1/web/multiple/i-11111111")
+	fake.delete("lbManager/elb/us-east-1/web/multiple/i-22222222")
+	expectNode(t, nodesCh, "delete /lbManager/elb/us-east-1/web/multiple/i-22222222")
+
+	fake.mu.Lock()
+	for _, query := range fake.queries[1:] {
+		if !strings.Contains(query, "index=") {
+			t.Errorf("got query %q, want a blocking one", query)
+		}
+	}
+	fake.mu.Unlock()
+	close(stopCh)
+	for _ = range nodesCh {
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("got error %v stopping the watch", err)
+	}
+}
+
+func TestConsulStoreWatchFollowsSnapshot(t *testing.T) {
+	fake := newFakeConsul(t)
+	fake.set("lbManager/elb/us-east-1/web/multiple/i-11111111", "")
+	store := fake.store(t)
+	if _, err := store.Snapshot("/lbManager"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes made between the read and the watch are sent, while other reads don't affect it
+	fake.set("lbManager/elb/us-east-1/web/multiple/i-22222222", "")
+	fake.delete("lbManager/elb/us-east-1/web/multiple/i-11111111")
+	store.List("/lbManager")
+	nodesCh, stopCh := make(chan *storeNode), make(chan bool)
+	go store.Watch("/lbManager", nodesCh, stopCh)
+	expectNode(t, nodesCh, "set /lbManager/elb/us-east-1/web/multiple/i-22222222")
+	expectNode(t, nodesCh, "delete /lbManager/elb/us-east-1/web/multiple/i-11111111")
+	close(stopCh)
+	for _ = range nodesCh {
+	}
+}
+
+func TestConsulStoreSetWithTTL(t *testing.T) {
+	fake := newFakeConsul(t)
+	store := fake.store(t)
+
+	if err := store.Set("/lbManager/elb/us-east-1/web/multiple/i-11111111", "", 3); err != nil {
+		t.Fatal(err)
+	}
+	kv := fake.kvs["lbManager/elb/us-east-1/web/multiple/i-11111111"]
+	if kv == nil || kv.Session == "" {
+		t.Fatalf("got key %+v, want it held by a session", kv)
+	}
+	session := fake.sessions[kv.Session]
+	if session["Behavior"] != "delete" || session["TTL"] != "10s" {
+		t.Errorf("got session %v, want a delete one with the minimum ttl", session)
+	}
+	if err := store.Refresh("/lbManager/elb/us-east-1/web/multiple/i-11111111", 3); err != nil {
+		t.Errorf("got error %v refreshing the key", err)
+	}
+
+	// Setting it again, from another store as well, replaces the session holding it
+	other := fake.store(t)
+	for _, s := range []*consulStore{store, other} {
+		if err := s.Set("/lbManager/elb/us-east-1/web/multiple/i-11111111", "", 3); err != nil {
+			t.Fatalf("got error %v setting the key again", err)
+		}
+	}
+	kv = fake.kvs["lbManager/elb/us-east-1/web/multiple/i-11111111"]
+	if len(fake.sessions) != 1 || fake.sessions[kv.Session] == nil {
+		t.Errorf("got sessions %v, want only the one holding the key %+v", fake.sessions, kv)
+	}
+
+	// The session created is destroyed when the key can't be acquired
+	fake.rejectAcquires = true
+	if err := store.Set("/lbManager/elb/us-east-1/web/multiple/i-33333333", "", 3); err == nil {
+		t.Error("got no error setting a key acquired by another session")
+	}
+	if len(fake.sessions) != 1 {
+		t.Errorf("got sessions %v, want the one of the key not acquired destroyed", fake.sessions)
+	}
+	fake.rejectAcquires = false
+
+	if err := store.Set("/lbManager/elb/us-east-1/web/multiple/i-22222222", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if kv := fake.kvs["lbManager/elb/us-east-1/web/multiple/i-22222222"]; kv == nil || kv.Session != "" {
+		t.Errorf("got key %+v, want it set without a session", kv)
+	}
+}
+
+func TestConsulStoreLock(t *testing.T) {
+	fake := newFakeConsul(t)
+	store, other := fake.store(t), fake.store(t)
+
+	if _, err := store.Lock("/lbManager/_leader", make(chan bool)); err != nil {
+		t.Fatal(err)
+	}
+	kv := fake.kvs["lbManager/_leader"]
+	if kv == nil || kv.Session == "" || fake.sessions[kv.Session]["Behavior"] != "release" {
+		t.Fatalf("got lock key %+v, want it held by a release session", kv)
+	}
+
+	// Another store can't acquire it while it's held
+	stopCh := make(chan bool)
+	close(stopCh)
+	if _, err := other.Lock("/lbManager/_leader", stopCh); err != errLockStopped {
+		t.Errorf("got error %v acquiring a held lock, want errLockStopped", err)
+	}
+
+	session := kv.Session
+	if err := store.Unlock("/lbManager/_leader"); err != nil {
+		t.Fatal(err)
+	}
+	if kv.Session != "" || fake.sessions[session] != nil {
+		t.Errorf("got lock key %+v, want it released and its session destroyed", kv)
+	}
+	if err := store.Unlock("/lbManager/_leader"); err == nil {
+		t.Error("got no error releasing a lock not held")
+	}
+	if _, err := other.Lock("/lbManager/_leader", make(chan bool)); err != nil {
+		t.Errorf("got error %v acquiring a released lock", err)
+	}
+	other.Unlock("/lbManager/_leader")
+}
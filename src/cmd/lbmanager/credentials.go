@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	sdkaws "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/mitchellh/goamz/aws"
+)
+
+// Address of the ECS container credentials endpoint, used along with AWS_CONTAINER_CREDENTIALS_RELATIVE_URI
+const containerCredentialsHost = "http://169.254.170.2"
+
+// Time before temporary credentials expire when they are refreshed
+const credentialsExpiryWindow = 5 * time.Minute
+
+// Build the AWS credentials chain. Credentials are looked up in order from the flags, the environment, the
+// shared credentials file, the container credentials endpoint and the EC2 instance role, and refreshed
+// automatically before they expire.
+func newAwsCredentials(accessKey, secretKey, profile, metadataEndpoint string) *credentials.Credentials {
+	chain := &credentialsChain{}
+	if accessKey != "" || secretKey != "" {
+		chain.add("flags", &credentials.StaticProvider{Value: credentials.Value{AccessKeyID: accessKey, SecretAccessKey: secretKey}})
+	}
+	chain.add("environment", &credentials.EnvProvider{})
+	chain.add("sharedCredentialsFile", &credentials.SharedCredentialsProvider{Profile: profile})
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+		chain.add("container", &containerCredentialsProvider{URL: uri})
+	} else if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		chain.add("container", &containerCredentialsProvider{URL: containerCredentialsHost + uri})
+	}
+	chain.add("instanceRole", &ec2rolecreds.EC2RoleProvider{
+		Client:       ec2metadata.New(session.New(), &sdkaws.Config{Endpoint: sdkaws.String(metadataEndpoint)}),
+		ExpiryWindow: credentialsExpiryWindow,
+	})
+	return credentials.NewCredentials(chain)
+}
+
+// Get the current AWS credentials as used by goamz clients, refreshing them if they have expired
+func getAwsAuth(creds *credentials.Credentials) (aws.Auth, error) {
+	value, err := creds.Get()
+	if err != nil {
+		return aws.Auth{}, fmt.Errorf("error getting AWS credentials: %s", err)
+	}
+	return aws.Auth{AccessKey: value.AccessKeyID, SecretKey: value.SecretAccessKey, Token: value.SessionToken}, nil
+}
+
+// Credentials provider trying a list of providers in order, and sticking to the first one returning
+// credentials until they expire. It's the vendored ChainProvider with its providers named, so that the
+// provider used is logged and the errors of all of them are reported when none can provide credentials.
+type credentialsChain struct {
+	credentials.ChainProvider
+	named []*namedProvider
+}
+
+// Credentials provider of a chain, keeping the error of its latest retrieval
+type namedProvider struct {
+	credentials.Provider
+	err  error
+	name string
+}
+
+// Add a provider to the chain
+func (c *credentialsChain) add(name string, provider credentials.Provider) {
+	named := &namedProvider{Provider: provider, name: name}
+	c.named = append(c.named, named)
+	c.Providers = append(c.Providers, named)
+}
+
+// Retrieve credentials from the first provider in the chain able to provide them
+func (c *credentialsChain) Retrieve() (credentials.Value, error) {
+	value, err := c.ChainProvider.Retrieve()
+	if err != nil {
+		errors := []string{}
+		for _, provider := range c.named {
+			errors = append(errors, provider.name+": "+provider.err.Error())
+		}
+		return value, fmt.Errorf("no valid credentials found (%s)", strings.Join(errors, "; "))
+	}
+	return value, nil
+}
+
+// Retrieve credentials from the provider, logging its name when it provides them
+func (p *namedProvider) Retrieve() (credentials.Value, error) {
+	value, err := p.Provider.Retrieve()
+	if p.err = err; err == nil {
+		logger.Info("AWS credentials retrieved", "action", "getCredentials", "provider", p.name)
+	}
+	return value, err
+}
+
+// Credentials provider getting temporary credentials from the ECS container credentials endpoint
+type containerCredentialsProvider struct {
+	credentials.Expiry
+	URL string
+}
+
+// Retrieve credentials from the container credentials endpoint
+func (p *containerCredentialsProvider) Retrieve() (credentials.Value, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, err := http.NewRequest("GET", p.URL, nil)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return credentials.Value{}, fmt.Errorf("got status code: %d", resp.StatusCode)
+	}
+	var body struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return credentials.Value{}, err
+	}
+	p.SetExpiration(body.Expiration, credentialsExpiryWindow)
+	return credentials.Value{AccessKeyID: body.AccessKeyId, SecretAccessKey: body.SecretAccessKey, SessionToken: body.Token}, nil
+}
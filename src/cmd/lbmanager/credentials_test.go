@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Clear the environment the credentials chain reads, so that only the providers under test find credentials
+func clearAwsEnvironment(t *testing.T) {
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY", "AWS_SESSION_TOKEN",
+		"AWS_PROFILE", "AWS_CONTAINER_CREDENTIALS_FULL_URI", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_AUTHORIZATION_TOKEN"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", t.TempDir()+"/credentials")
+}
+
+func TestInstanceRoleCredentials(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		want      []string
+	}{
+		{name: "valid credentials", expiresIn: time.Hour, want: []string{"AKID1", "AKID1"}},
+		{name: "credentials within the expiry window", expiresIn: credentialsExpiryWindow - time.Minute, want: []string{"AKID1", "AKID2"}},
+	}
+	for _, test := range tests {
+		clearAwsEnvironment(t)
+		creds := newAwsCredentials("", "", "", newFakeMetadata(t, test.expiresIn).url)
+		got := []string{}
+		for _ = range test.want {
+			auth, err := getAwsAuth(creds)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			if auth.SecretKey != "secret" || auth.Token != "token" {
+				t.Errorf("%s: got credentials %+v", test.name, auth)
+			}
+			got = append(got, auth.AccessKey)
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("%s: got access keys %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestContainerCredentials(t *testing.T) {
+	clearAwsEnvironment(t)
+	metadata := newFakeMetadata(t, time.Hour)
+	container := startFakeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/credentials" || r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `{"AccessKeyId": "ASIACONTAINER", "SecretAccessKey": "secret", "Token": "token", "Expiration": %q}`,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", container.URL+"/credentials")
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "Bearer token")
+
+	// The container credentials are used before the instance role ones
+	auth, err := getAwsAuth(newAwsCredentials("", "", "", metadata.url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.AccessKey != "ASIACONTAINER" {
+		t.Errorf("got access key %s, want the container one", auth.AccessKey)
+	}
+
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "")
+	_, err = getAwsAuth(newAwsCredentials("", "", "", "http://127.0.0.1:1/latest"))
+	if err == nil || !strings.Contains(err.Error(), "no valid credentials found (") || !strings.Contains(err.Error(), "container: got status code: 403") ||
+		!strings.Contains(err.Error(), "instanceRole: ") {
+		t.Errorf("got error %v, want the errors of all the providers", err)
+	}
+}
+
+func TestStaticCredentialsFirst(t *testing.T) {
+	clearAwsEnvironment(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	if auth, err := getAwsAuth(newAwsCredentials("AKIDFLAGS", "secret", "", "http://127.0.0.1:1/latest")); err != nil || auth.AccessKey != "AKIDFLAGS" {
+		t.Errorf("got access key %s and error %v, want the flags ones", auth.AccessKey, err)
+	}
+	if auth, err := getAwsAuth(newAwsCredentials("", "", "", "http://127.0.0.1:1/latest")); err != nil || auth.AccessKey != "AKIDENV" {
+		t.Errorf("got access key %s and error %v, want the environment ones", auth.AccessKey, err)
+	}
+}
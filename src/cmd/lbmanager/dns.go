@@ -0,0 +1,466 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Minimal DNS wire format support, enough to query record sets, send RFC 2136 updates and sign them
+// with TSIG (RFC 8945), as no DNS library is vendored.
+
+// DNS record types, classes, opcodes and response codes used
+const (
+	dnsTypeA    = 1
+	dnsTypeSOA  = 6
+	dnsTypeAAAA = 28
+	dnsTypeTSIG = 250
+
+	dnsClassIN  = 1
+	dnsClassANY = 255
+
+	dnsOpcodeQuery  = 0
+	dnsOpcodeUpdate = 5
+
+	dnsRcodeNoError  = 0
+	dnsRcodeNXDomain = 3
+)
+
+// Time difference allowed between the signer and the verifier of TSIG signed messages
+const tsigFudge = 300
+
+var dnsRcodes = map[int]string{
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	6:  "YXDOMAIN",
+	7:  "YXRRSET",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+	16: "BADSIG",
+	17: "BADKEY",
+	18: "BADTIME",
+}
+
+// TSIG algorithms supported, by name
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-md5.sig-alg.reg.int": md5.New,
+	"hmac-sha1":                sha1.New,
+	"hmac-sha256":              sha256.New,
+	"hmac-sha512":              sha512.New,
+}
+
+var errDnsMessageTruncated = errors.New("truncated DNS message")
+
+// DNS message, holding the zone, prerequisite and update sections in updates
+type dnsMessage struct {
+	id         uint16
+	flags      uint16
+	question   []dnsQuestion
+	answer     []dnsRR
+	authority  []dnsRR
+	additional []dnsRR
+
+	// Offset of the TSIG record in unpacked messages, 0 if not signed
+	tsigOffset int
+}
+
+type dnsQuestion struct {
+	name   string
+	qType  uint16
+	qClass uint16
+}
+
+type dnsRR struct {
+	name   string
+	rrType uint16
+	class  uint16
+	ttl    uint32
+	data   []byte
+}
+
+// TSIG key, as in the -y argument of nsupdate: [ALGORITHM:]NAME:SECRET, with the secret base64 encoded
+type tsigKey struct {
+	algorithm string
+	name      string
+	secret    []byte
+}
+
+// Get the response code of a message
+func (msg *dnsMessage) rcode() int {
+	return int(msg.flags & 0xf)
+}
+
+// Encode a message in the DNS wire format, without compressing names
+func (msg *dnsMessage) pack() []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint16(buf[0:], msg.id)
+	binary.BigEndian.PutUint16(buf[2:], msg.flags)
+	binary.BigEndian.PutUint16(buf[4:], uint16(len(msg.question)))
+	binary.BigEndian.PutUint16(buf[6:], uint16(len(msg.answer)))
+	binary.BigEndian.PutUint16(buf[8:], uint16(len(msg.authority)))
+	binary.BigEndian.PutUint16(buf[10:], uint16(len(msg.additional)))
+	for _, q := range msg.question {
+		buf = append(packDnsName(buf, q.name), byte(q.qType>>8), byte(q.qType), byte(q.qClass>>8), byte(q.qClass))
+	}
+	for _, section := range [][]dnsRR{msg.answer, msg.authority, msg.additional} {
+		for _, rr := range section {
+			buf = rr.pack(buf)
+		}
+	}
+	return buf
+}
+
+// Append a record to a message being packed
+func (rr *dnsRR) pack(buf []byte) []byte {
+	buf = packDnsName(buf, rr.name)
+	buf = append(buf, byte(rr.rrType>>8), byte(rr.rrType), byte(rr.class>>8), byte(rr.class))
+	buf = append(buf, byte(rr.ttl>>24), byte(rr.ttl>>16), byte(rr.ttl>>8), byte(rr.ttl))
+	buf = append(buf, byte(len(rr.data)>>8), byte(len(rr.data)))
+	return append(buf, rr.data...)
+}
+
+// Decode a message in the DNS wire format
+func unpackDnsMessage(data []byte) (*dnsMessage, error) {
+	if len(data) < 12 {
+		return nil, errDnsMessageTruncated
+	}
+	msg := &dnsMessage{
+		id:    binary.BigEndian.Uint16(data[0:]),
+		flags: binary.BigEndian.Uint16(data[2:]),
+	}
+	counts := []int{}
+	for i := 4; i < 12; i += 2 {
+		counts = append(counts, int(binary.BigEndian.Uint16(data[i:])))
+	}
+	offset := 12
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := unpackDnsName(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(data) {
+			return nil, errDnsMessageTruncated
+		}
+		msg.question = append(msg.question, dnsQuestion{
+			name:   name,
+			qType:  binary.BigEndian.Uint16(data[next:]),
+			qClass: binary.BigEndian.Uint16(data[next+2:]),
+		})
+		offset = next + 4
+	}
+	for section, rrs := range []*[]dnsRR{&msg.answer, &msg.authority, &msg.additional} {
+		for i := 0; i < counts[section+1]; i++ {
+			start := offset
+			name, next, err := unpackDnsName(data, offset)
+			if err != nil {
+				return nil, err
+			}
+			if next+10 > len(data) {
+				return nil, errDnsMessageTruncated
+			}
+			rr := dnsRR{
+				name:   name,
+				rrType: binary.BigEndian.Uint16(data[next:]),
+				class:  binary.BigEndian.Uint16(data[next+2:]),
+				ttl:    binary.BigEndian.Uint32(data[next+4:]),
+			}
+			length := int(binary.BigEndian.Uint16(data[next+8:]))
+			if next+10+length > len(data) {
+				return nil, errDnsMessageTruncated
+			}
+			rr.data = data[next+10 : next+10+length]
+			offset = next + 10 + length
+			if rr.rrType == dnsTypeTSIG {
+				msg.tsigOffset = start
+			}
+			*rrs = append(*rrs, rr)
+		}
+	}
+	return msg, nil
+}
+
+// Append a name to a message being packed
+func packDnsName(buf []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label != "" {
+			buf = append(buf, byte(len(label)))
+			buf = append(buf, label...)
+		}
+	}
+	return append(buf, 0)
+}
+
+// Read a name from a message, following compression pointers. Returns the name, without trailing dot,
+// and the offset after it.
+func unpackDnsName(data []byte, offset int) (string, int, error) {
+	labels := []string{}
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(data) {
+			return "", 0, errDnsMessageTruncated
+		}
+		length := int(data[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(data) {
+				return "", 0, errDnsMessageTruncated
+			}
+			if jumps++; jumps > 32 {
+				return "", 0, errors.New("too many compression pointers in DNS message")
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(data[offset:]) & 0x3fff)
+		default:
+			if offset+1+length > len(data) {
+				return "", 0, errDnsMessageTruncated
+			}
+			labels = append(labels, string(data[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// Check if two names are the same, as names are case insensitive
+func sameDnsName(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
+
+// Build a record set member from a record, returning an empty string if it's not an address record
+func dnsRRAddress(rr dnsRR) string {
+	if (rr.rrType == dnsTypeA && len(rr.data) == net.IPv4len) || (rr.rrType == dnsTypeAAAA && len(rr.data) == net.IPv6len) {
+		return net.IP(rr.data).String()
+	}
+	return ""
+}
+
+// Build an address record for the IP provided
+func newDnsAddressRR(name string, ip net.IP, ttl uint32) dnsRR {
+	if ip4 := ip.To4(); ip4 != nil {
+		return dnsRR{name: name, rrType: dnsTypeA, class: dnsClassIN, ttl: ttl, data: []byte(ip4)}
+	}
+	return dnsRR{name: name, rrType: dnsTypeAAAA, class: dnsClassIN, ttl: ttl, data: []byte(ip.To16())}
+}
+
+// Get a random message id
+func newDnsId() uint16 {
+	b := make([]byte, 2)
+	rand.Read(b)
+	return binary.BigEndian.Uint16(b)
+}
+
+// Send a message over TCP to the server provided, signing it and verifying the response signature if a
+// key is provided, and return the response
+func dnsExchange(server string, msg *dnsMessage, key *tsigKey, timeout time.Duration) (*dnsMessage, error) {
+	data := msg.pack()
+	var requestMac []byte
+	if key != nil {
+		data, requestMac = key.sign(data, nil, time.Now())
+	}
+	conn, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(append([]byte{byte(len(data) >> 8), byte(len(data))}, data...)); err != nil {
+		return nil, err
+	}
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+	data = make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+	resp, err := unpackDnsMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	if resp.id != msg.id {
+		return nil, fmt.Errorf("DNS response id mismatch: %d (expected %d)", resp.id, msg.id)
+	}
+	if key != nil && resp.tsigOffset > 0 {
+		if err := key.verify(data, resp, requestMac, time.Now()); err != nil {
+			return nil, err
+		}
+	} else if key != nil && resp.rcode() == dnsRcodeNoError {
+		return nil, errors.New("DNS response not signed")
+	}
+	return resp, nil
+}
+
+// Get an error for a response code other than NOERROR, including the TSIG error if there's one
+func dnsRcodeError(resp *dnsMessage) error {
+	rcode := resp.rcode()
+	if rcode == dnsRcodeNoError {
+		return nil
+	}
+	name := dnsRcodes[rcode]
+	if name == "" {
+		name = fmt.Sprintf("RCODE%d", rcode)
+	}
+	if tsigErr := tsigError(resp); tsigErr != "" {
+		name += ", " + tsigErr
+	}
+	return fmt.Errorf("DNS server returned %s", name)
+}
+
+// Parse a TSIG key from its [ALGORITHM:]NAME:SECRET form, using hmac-sha256 if no algorithm is provided
+func parseTsigKey(value string) (*tsigKey, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) == 2 {
+		parts = append([]string{"hmac-sha256"}, parts...)
+	}
+	if len(parts) != 3 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid TSIG key: expected [ALGORITHM:]NAME:SECRET")
+	}
+	algorithm := strings.ToLower(strings.TrimSuffix(parts[0], "."))
+	if algorithm == "hmac-md5" {
+		algorithm = "hmac-md5.sig-alg.reg.int"
+	}
+	if tsigAlgorithms[algorithm] == nil {
+		return nil, fmt.Errorf("unsupported TSIG algorithm: %s (hmac-md5|hmac-sha1|hmac-sha256|hmac-sha512)", parts[0])
+	}
+	secret, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid TSIG key secret: %s", err)
+	}
+	return &tsigKey{algorithm: algorithm, name: strings.ToLower(strings.TrimSuffix(parts[1], ".")), secret: secret}, nil
+}
+
+// Compute the MAC of a message, given the MAC of the request when the message is a response
+func (k *tsigKey) mac(data []byte, requestMac []byte, signed uint64, fudge uint16, tsigErr uint16, other []byte) []byte {
+	h := hmac.New(tsigAlgorithms[k.algorithm], k.secret)
+	if requestMac != nil {
+		h.Write([]byte{byte(len(requestMac) >> 8), byte(len(requestMac))})
+		h.Write(requestMac)
+	}
+	h.Write(data)
+	vars := packDnsName(nil, k.name)
+	vars = append(vars, 0, dnsClassANY, 0, 0, 0, 0)
+	vars = packDnsName(vars, k.algorithm)
+	vars = append(vars, byte(signed>>40), byte(signed>>32), byte(signed>>24), byte(signed>>16), byte(signed>>8), byte(signed))
+	vars = append(vars, byte(fudge>>8), byte(fudge), byte(tsigErr>>8), byte(tsigErr), byte(len(other)>>8), byte(len(other)))
+	h.Write(append(vars, other...))
+	return h.Sum(nil)
+}
+
+// Sign a packed message, returning it with the TSIG record appended and its MAC
+func (k *tsigKey) sign(data []byte, requestMac []byte, now time.Time) ([]byte, []byte) {
+	signed := uint64(now.Unix())
+	mac := k.mac(data, requestMac, signed, tsigFudge, 0, nil)
+	rdata := packDnsName(nil, k.algorithm)
+	rdata = append(rdata, byte(signed>>40), byte(signed>>32), byte(signed>>24), byte(signed>>16), byte(signed>>8), byte(signed))
+	rdata = append(rdata, byte(tsigFudge>>8), byte(tsigFudge&0xff), byte(len(mac)>>8), byte(len(mac)))
+	rdata = append(rdata, mac...)
+	rdata = append(rdata, data[0], data[1], 0, 0, 0, 0)
+	signedData := append([]byte{}, data...)
+	binary.BigEndian.PutUint16(signedData[10:], binary.BigEndian.Uint16(data[10:])+1)
+	rr := dnsRR{name: k.name, rrType: dnsTypeTSIG, class: dnsClassANY, data: rdata}
+	return rr.pack(signedData), mac
+}
+
+// TSIG record fields
+type tsigRecord struct {
+	algorithm  string
+	signed     uint64
+	fudge      uint16
+	mac        []byte
+	originalId uint16
+	err        uint16
+	other      []byte
+}
+
+// Parse the TSIG record of a message
+func parseTsigRecord(rr dnsRR) (*tsigRecord, error) {
+	algorithm, offset, err := unpackDnsName(rr.data, 0)
+	data := rr.data
+	if err != nil || offset+10 > len(data) {
+		return nil, errors.New("invalid TSIG record")
+	}
+	t := &tsigRecord{algorithm: strings.ToLower(algorithm)}
+	for i := 0; i < 6; i++ {
+		t.signed = t.signed<<8 | uint64(data[offset+i])
+	}
+	t.fudge = binary.BigEndian.Uint16(data[offset+6:])
+	macSize := int(binary.BigEndian.Uint16(data[offset+8:]))
+	offset += 10
+	if offset+macSize+6 > len(data) {
+		return nil, errors.New("invalid TSIG record")
+	}
+	t.mac = data[offset : offset+macSize]
+	offset += macSize
+	t.originalId = binary.BigEndian.Uint16(data[offset:])
+	t.err = binary.BigEndian.Uint16(data[offset+2:])
+	otherSize := int(binary.BigEndian.Uint16(data[offset+4:]))
+	if offset+6+otherSize > len(data) {
+		return nil, errors.New("invalid TSIG record")
+	}
+	t.other = data[offset+6 : offset+6+otherSize]
+	return t, nil
+}
+
+// Get the name of the TSIG error in a response, if any
+func tsigError(resp *dnsMessage) string {
+	if resp.tsigOffset == 0 {
+		return ""
+	}
+	t, err := parseTsigRecord(resp.additional[len(resp.additional)-1])
+	if err != nil || t.err == 0 {
+		return ""
+	}
+	return dnsRcodes[int(t.err)]
+}
+
+// Verify the TSIG signature of a response to a request signed with the key
+func (k *tsigKey) verify(data []byte, resp *dnsMessage, requestMac []byte, now time.Time) error {
+	rr := resp.additional[len(resp.additional)-1]
+	if !sameDnsName(rr.name, k.name) {
+		return fmt.Errorf("DNS response signed with an unknown key: %s", rr.name)
+	}
+	t, err := parseTsigRecord(rr)
+	if err != nil {
+		return err
+	}
+	if t.err != 0 {
+		// Responses reporting TSIG errors aren't signed
+		return nil
+	}
+	if !sameDnsName(t.algorithm, k.algorithm) {
+		return fmt.Errorf("DNS response signed with an unexpected algorithm: %s", t.algorithm)
+	}
+	unsigned := append([]byte{}, data[:resp.tsigOffset]...)
+	binary.BigEndian.PutUint16(unsigned[0:], t.originalId)
+	binary.BigEndian.PutUint16(unsigned[10:], uint16(len(resp.additional)-1))
+	if !hmac.Equal(t.mac, k.mac(unsigned, requestMac, t.signed, t.fudge, t.err, t.other)) {
+		return errors.New("invalid DNS response signature")
+	}
+	if diff := now.Unix() - int64(t.signed); diff > int64(t.fudge) || -diff > int64(t.fudge) {
+		return errors.New("DNS response signature expired")
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNS record types only served by the embedded server
+const dnsTypeSRV = 33
+
+// Maximum size of the responses sent over UDP, as EDNS isn't supported
+const dnsMaxUdpSize = 512
+
+func init() {
+	registerBackend("dns", &lbBackend{
+		fields:        []string{"name", "class", "member"},
+		usage:         []string{"FQDN", "LB_CLASS", "IP[:PORT]"},
+		idFields:      []string{"name"},
+		optionsScopes: [][]string{{"name"}},
+		validate: func(k *memberKey) error {
+			if !fqdnRe.MatchString(k.name) {
+				return fmt.Errorf("invalid fqdn: %s (lowercase and without trailing dot)", k.name)
+			}
+			if ip := net.ParseIP(k.member); k.member != "" && (ip == nil || ip.String() != k.member) && !validHostPort(k.member) {
+				return fmt.Errorf("invalid member: %s (IP or IP:PORT)", k.member)
+			}
+			return nil
+		},
+		build: func(m *Manager, configEntry *configEntry) LoadBalancer {
+			return &Dns{LB: m.newLB(configEntry)}
+		},
+	})
+}
+
+// Load balancer only served by the embedded DNS server, so its syncs have nothing to apply. Members may
+// include a port, used in the SRV records.
+type Dns struct {
+	LB
+}
+
+// Setup DNS served load balancer
+func (lb *Dns) Setup(meta map[string]string) {
+	logger.Info("setting up load balancer state", lb.logFields("action", "setup", "name", meta["name"])...)
+	lb.class = meta["class"]
+	lb.configKey = lb.ConfigPath + "/dns/" + meta["name"] + "/"
+	lb.name = meta["name"]
+}
+
+// Sync state of the load balancer instance, served as is by the embedded DNS server
+func (lb *Dns) Sync() {
+	startedAt := time.Now()
+	lb.recordActualMembers(len(lb.Members()))
+	lb.recordSync(startedAt, nil)
+}
+
+// Get the differences between the load balancer state and the records served, always the same
+func (lb *Dns) Diff() (*LBDiff, error) {
+	members := lb.Members()
+	return lb.buildDiff(members, members), nil
+}
+
+// Embedded authoritative DNS server, answering A, AAAA and SRV queries for the names of the dns and route53
+// load balancers from their members. Names in the zones served not matching a load balancer get NXDOMAIN.
+type DnsServer struct {
+	Addr    string
+	Manager *Manager
+	Ttl     uint32
+	Zones   []string
+}
+
+// Address record served for a load balancer member
+type dnsTarget struct {
+	ip   net.IP
+	name string
+	port int
+}
+
+// Start serving DNS queries over UDP and TCP
+func (s *DnsServer) Start() {
+	udpConn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		logger.Error("error serving DNS", "action", "startDns", "error", err.Error())
+		return
+	}
+	tcpListener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		logger.Error("error serving DNS", "action", "startDns", "error", err.Error())
+		udpConn.Close()
+		return
+	}
+	logger.Info("DNS server listening", "action", "startDns", "addr", s.Addr, "zones", strings.Join(s.Zones, ","))
+	go s.serveTcp(tcpListener)
+	s.serveUdp(udpConn)
+}
+
+// Answer the queries received over UDP, truncating the responses not fitting in a datagram
+func (s *DnsServer) serveUdp(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			logger.Error("error reading DNS query", "action", "serveDns", "error", err.Error())
+			return
+		}
+		resp := s.handle(buf[:n])
+		if resp == nil {
+			continue
+		}
+		data := resp.pack()
+		if len(data) > dnsMaxUdpSize {
+			resp.flags |= 1 << 9
+			resp.answer, resp.authority, resp.additional = nil, nil, nil
+			data = resp.pack()
+		}
+		conn.WriteTo(data, addr)
+	}
+}
+
+// Answer the queries received over TCP connections
+func (s *DnsServer) serveTcp(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.Error("error accepting DNS connection", "action", "serveDns", "error", err.Error())
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				length := make([]byte, 2)
+				if _, err := io.ReadFull(conn, length); err != nil {
+					return
+				}
+				data := make([]byte, binary.BigEndian.Uint16(length))
+				if _, err := io.ReadFull(conn, data); err != nil {
+					return
+				}
+				resp := s.handle(data)
+				if resp == nil {
+					return
+				}
+				data = resp.pack()
+				if _, err := conn.Write(append([]byte{byte(len(data) >> 8), byte(len(data))}, data...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Build the response to a query, or nil if it's not a valid query
+func (s *DnsServer) handle(data []byte) *dnsMessage {
+	query, err := unpackDnsMessage(data)
+	if err != nil || query.flags&(1<<15) != 0 {
+		return nil
+	}
+	// Responses echo the opcode and the recursion desired flag
+	resp := &dnsMessage{id: query.id, flags: 1<<15 | query.flags&(0xf<<11|1<<8), question: query.question}
+	if (query.flags>>11)&0xf != dnsOpcodeQuery || len(query.question) != 1 {
+		resp.flags |= 4
+		return resp
+	}
+	q := query.question[0]
+	name := strings.ToLower(strings.TrimSuffix(q.name, "."))
+	zone := s.zone(name)
+	targets, found := s.lookup(name)
+	if zone != "" && name == zone {
+		// The zone apex only has the SOA record
+		found = true
+	}
+	switch {
+	case !found && zone == "":
+		resp.flags |= 5
+		return resp
+	case !found:
+		resp.flags |= 1<<10 | dnsRcodeNXDomain
+		resp.authority = []dnsRR{s.soa(zone)}
+		return resp
+	}
+	if zone != "" {
+		resp.flags |= 1 << 10
+	}
+	if name == zone && q.qType == dnsTypeSOA {
+		resp.answer = []dnsRR{s.soa(zone)}
+	}
+	shuffled := make([]dnsTarget, len(targets))
+	for i, p := range rand.Perm(len(targets)) {
+		shuffled[i] = targets[p]
+	}
+	answered := make(map[string]bool)
+	for _, target := range shuffled {
+		switch {
+		case q.qType == dnsTypeSRV && target.port > 0:
+			rdata := []byte{0, 0, 0, 1, byte(target.port >> 8), byte(target.port)}
+			resp.answer = append(resp.answer, dnsRR{name: name, rrType: dnsTypeSRV, class: dnsClassIN, ttl: s.Ttl, data: packDnsName(rdata, target.name)})
+			if !answered[target.name] {
+				answered[target.name] = true
+				resp.additional = append(resp.additional, newDnsAddressRR(target.name, target.ip, s.Ttl))
+			}
+		case answered[target.ip.String()]:
+		case q.qType == dnsTypeA && target.ip.To4() != nil, q.qType == dnsTypeAAAA && target.ip.To4() == nil:
+			answered[target.ip.String()] = true
+			resp.answer = append(resp.answer, newDnsAddressRR(name, target.ip, s.Ttl))
+		}
+	}
+	if len(resp.answer) == 0 && zone != "" {
+		resp.authority = []dnsRR{s.soa(zone)}
+	}
+	return resp
+}
+
+// Get the zone served a name belongs to, or an empty string if it's not in any of them
+func (s *DnsServer) zone(name string) string {
+	longest := ""
+	for _, zone := range s.Zones {
+		if (name == zone || strings.HasSuffix(name, "."+zone)) && len(zone) > len(longest) {
+			longest = zone
+		}
+	}
+	return longest
+}
+
+// Get the addresses served for a name: the members of the load balancer with that name (or the addresses
+// they were resolved to), or the member a SRV record target points to. Returns false if there's no such name.
+func (s *DnsServer) lookup(name string) ([]dnsTarget, bool) {
+	for _, status := range s.Manager.LoadBalancersStatus() {
+		if status.Type != "dns" && status.Type != "route53" {
+			continue
+		}
+		members := status.Members
+		if status.Addresses != nil {
+			members = status.Addresses
+		}
+		if status.Name == name {
+			return dnsTargets(status.Name, members), true
+		}
+		if strings.HasSuffix(name, "."+status.Name) {
+			for _, target := range dnsTargets(status.Name, members) {
+				if target.name == name {
+					return []dnsTarget{{ip: target.ip, name: name}}, true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// Build the addresses served for the members of a load balancer. Members with a port are also served in
+// SRV records, pointing to a name built from the member address under the load balancer name.
+func dnsTargets(lbName string, members []string) []dnsTarget {
+	targets := []dnsTarget{}
+	for _, member := range members {
+		target := dnsTarget{ip: net.ParseIP(member)}
+		if host, port, err := net.SplitHostPort(member); err == nil {
+			target.ip = net.ParseIP(host)
+			target.port, _ = strconv.Atoi(port)
+		}
+		if target.ip == nil {
+			continue
+		}
+		target.name = strings.NewReplacer(".", "-", ":", "-").Replace(target.ip.String()) + "." + lbName
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// Build the SOA record of a zone, sent in negative responses so that resolvers can cache them for the
+// configured TTL
+func (s *DnsServer) soa(zone string) dnsRR {
+	rdata := packDnsName(nil, "lbmanager."+zone)
+	rdata = packDnsName(rdata, "hostmaster."+zone)
+	for _, value := range []uint32{uint32(time.Now().Unix()), 3600, 600, 86400, s.Ttl} {
+		rdata = append(rdata, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+	}
+	return dnsRR{name: zone, rrType: dnsTypeSOA, class: dnsClassIN, ttl: s.Ttl, data: rdata}
+}
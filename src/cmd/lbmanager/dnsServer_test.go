@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDnsServerLookupResolvedAddresses(t *testing.T) {
+	route53 := &Route53{LB: LB{Type: "route53", class: "multiple", name: "www.example.com"}}
+	route53.AddMember("i-11111111")
+	route53.AddMember("10.0.0.2")
+	dns := &Dns{LB: LB{Type: "dns", class: "multiple", name: "api.example.com"}}
+	dns.AddMember("10.0.0.3:8080")
+	manager := &Manager{}
+	manager.init()
+	manager.loadBalancers["www"], manager.loadBalancers["api"] = route53, dns
+	server := &DnsServer{Manager: manager, Zones: []string{"example.com"}}
+
+	lookup := func(name string) string {
+		targets, found := server.lookup(name)
+		if !found {
+			return "NXDOMAIN"
+		}
+		ips := []string{}
+		for _, target := range targets {
+			ips = append(ips, target.ip.String())
+		}
+		sort.Strings(ips)
+		return strings.Join(ips, ",")
+	}
+	// Nothing is served for the instance ids until they are resolved
+	if got := lookup("www.example.com"); got != "" {
+		t.Errorf("got %q before resolving the instance ids, want no addresses", got)
+	}
+	route53.addresses = []string{"10.0.0.2", "10.0.0.1"}
+	if got := lookup("www.example.com"); got != "10.0.0.1,10.0.0.2" {
+		t.Errorf("got %q, want the resolved addresses", got)
+	}
+	if got := lookup("10-0-0-3.api.example.com"); got != "10.0.0.3" {
+		t.Errorf("got %q, want the SRV target address", got)
+	}
+	if got := lookup("other.example.com"); got != "NXDOMAIN" {
+		t.Errorf("got %q for a name without load balancer", got)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestTsigSignVerify(t *testing.T) {
+	key, err := parseTsigKey("hmac-sha256:lbmanager.:c2VjcmV0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	request := &dnsMessage{id: 1234, question: []dnsQuestion{{name: "www.example.com", qType: dnsTypeA, qClass: dnsClassIN}}}
+	signedRequest, requestMac := key.sign(request.pack(), nil, now)
+	unpacked, err := unpackDnsMessage(signedRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.verify(signedRequest, unpacked, nil, now); err != nil {
+		t.Errorf("got error %v verifying the request", err)
+	}
+
+	// Responses are signed with the MAC of the request they answer prepended
+	response := &dnsMessage{id: 1234, flags: 0x8000, question: request.question}
+	signedResponse, _ := key.sign(response.pack(), requestMac, now)
+	unpacked, err = unpackDnsMessage(signedResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unpacked.additional) != 1 || unpacked.additional[0].rrType != dnsTypeTSIG {
+		t.Fatalf("got additional records %v, want a TSIG one", unpacked.additional)
+	}
+	if err := key.verify(signedResponse, unpacked, requestMac, now); err != nil {
+		t.Errorf("got error %v verifying the response", err)
+	}
+	if err := key.verify(signedResponse, unpacked, nil, now); err == nil {
+		t.Error("got no error verifying the response without the request MAC")
+	}
+	if err := key.verify(signedResponse, unpacked, requestMac, now.Add(time.Hour)); err == nil || err.Error() != "DNS response signature expired" {
+		t.Errorf("got error %v verifying an old response, want it expired", err)
+	}
+
+	// The original id is signed, so that forwarders can change the message id
+	forwarded := append([]byte{}, signedResponse...)
+	binary.BigEndian.PutUint16(forwarded, 4321)
+	if err := key.verify(forwarded, unpacked, requestMac, now); err != nil {
+		t.Errorf("got error %v verifying a response with another id", err)
+	}
+	tampered := append([]byte{}, signedResponse...)
+	tampered[2] |= 0x04
+	if err := key.verify(tampered, unpacked, requestMac, now); err == nil {
+		t.Error("got no error verifying a tampered response")
+	}
+	other, _ := parseTsigKey("hmac-sha256:lbmanager:b3RoZXI=")
+	if err := other.verify(signedResponse, unpacked, requestMac, now); err == nil {
+		t.Error("got no error verifying a response with another secret")
+	}
+}
+
+func TestParseTsigKey(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		err   string
+	}{
+		{value: "lbmanager:c2VjcmV0", want: "hmac-sha256:lbmanager"},
+		{value: "HMAC-MD5.:Key.Example.:c2VjcmV0", want: "hmac-md5.sig-alg.reg.int:key.example"},
+		{value: "hmac-sha512:lbmanager:c2VjcmV0", want: "hmac-sha512:lbmanager"},
+		{value: "c2VjcmV0", err: "invalid TSIG key: expected [ALGORITHM:]NAME:SECRET"},
+		{value: "hmac-sha384:lbmanager:c2VjcmV0", err: "unsupported TSIG algorithm: hmac-sha384 (hmac-md5|hmac-sha1|hmac-sha256|hmac-sha512)"},
+		{value: "lbmanager:not base64", err: "invalid TSIG key secret: illegal base64 data at input byte 3"},
+	}
+	for _, test := range tests {
+		key, err := parseTsigKey(test.value)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.value, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: got error %v", test.value, err)
+		} else if got := key.algorithm + ":" + key.name; got != test.want {
+			t.Errorf("%s: got key %s, want %s", test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dynamic DNS settings, shared by all the dnsupdate load balancers. The server, TSIG key and TTL can be
+// set per zone or load balancer in their options.
+type dnsUpdateOptions struct {
+	server  string
+	timeout time.Duration
+	tsig    *tsigKey
+	ttl     uint32
+}
+
+var dnsUpdateSettings = &dnsUpdateOptions{server: "127.0.0.1:53", timeout: 10 * time.Second, ttl: 60}
+
+var (
+	// Serializes the queries and updates of each zone, as ZoneUpdater does in Route53 hosted zones
+	dnsZoneLocks   = make(map[string]*sync.Mutex)
+	dnsZoneLocksMu sync.Mutex
+)
+
+func init() {
+	registerBackend("dnsupdate", &lbBackend{
+		fields:        []string{"hostedZone", "name", "class", "member"},
+		usage:         []string{"ZONE", "FQDN", "LB_CLASS", "IP"},
+		idFields:      []string{"hostedZone", "name"},
+		optionsScopes: [][]string{{"hostedZone"}},
+		validate: func(k *memberKey) error {
+			if !fqdnRe.MatchString(k.hostedZone) {
+				return fmt.Errorf("invalid zone: %s (lowercase and without trailing dot)", k.hostedZone)
+			}
+			if !fqdnRe.MatchString(k.name) || (k.name != k.hostedZone && !strings.HasSuffix(k.name, "."+k.hostedZone)) {
+				return fmt.Errorf("invalid fqdn: %s (lowercase, without trailing dot and in zone %s)", k.name, k.hostedZone)
+			}
+			if ip := net.ParseIP(k.member); k.member != "" && (ip == nil || ip.String() != k.member) {
+				return fmt.Errorf("invalid IP address: %s", k.member)
+			}
+			return nil
+		},
+		build: func(m *Manager, configEntry *configEntry) LoadBalancer {
+			scopes := m.optionsScopes(configEntry.lbType, configEntry.lbMetadata)
+			return &DnsUpdate{
+				LB:       m.newLB(configEntry),
+				Options:  func() *lbOptions { return m.optionsFor(scopes...) },
+				Settings: dnsUpdateSettings,
+			}
+		},
+	})
+}
+
+// Load balancer keeping the A and AAAA records of a name in a zone served by BIND, Knot, PowerDNS or any
+// server supporting RFC 2136 updates. Unlike Route53 ones, the records are deleted when the load balancer
+// has no members.
+type DnsUpdate struct {
+	LB
+	Options  func() *lbOptions
+	Settings *dnsUpdateOptions
+	syncCh   chan int
+	zone     string
+	zoneMu   *sync.Mutex
+}
+
+// Setup dynamic DNS based load balancer
+func (lb *DnsUpdate) Setup(meta map[string]string) {
+	logger.Info("setting up load balancer state", lb.logFields("action", "setup", "name", meta["name"], "zone", meta["hostedZone"])...)
+	lb.class = meta["class"]
+	lb.configKey = lb.ConfigPath + "/dnsupdate/" + meta["hostedZone"] + "/" + meta["name"] + "/"
+	lb.name = meta["name"]
+	lb.zone = meta["hostedZone"]
+	dnsZoneLocksMu.Lock()
+	if dnsZoneLocks[lb.zone] == nil {
+		dnsZoneLocks[lb.zone] = &sync.Mutex{}
+	}
+	lb.zoneMu = dnsZoneLocks[lb.zone]
+	dnsZoneLocksMu.Unlock()
+	lb.syncCh = make(chan int)
+	go func() {
+		lb.sync()
+	}()
+}
+
+// Sync state of the load balancer instance with the real service
+func (lb *DnsUpdate) Sync() {
+	if !lb.Tracker.begin() {
+		logger.Warn("shutting down, sync discarded", lb.logFields("action", "sync")...)
+		return
+	}
+	lb.syncCh <- 1
+}
+
+// Get the differences between the load balancer state and the records in the DNS server
+func (lb *DnsUpdate) Diff() (*LBDiff, error) {
+	records, err := lb.getRecords()
+	if err != nil {
+		return nil, err
+	}
+	return lb.buildDiff(lb.Members(), records), nil
+}
+
+// Get the options of the zone, or empty ones if none are set
+func (lb *DnsUpdate) options() *lbOptions {
+	if lb.Options != nil {
+		if options := lb.Options(); options != nil {
+			return options
+		}
+	}
+	return &lbOptions{}
+}
+
+// Get the address of the DNS server of the zone, set in its options or in -dnsupdate-server
+func (lb *DnsUpdate) server() string {
+	server := lb.Settings.server
+	if options := lb.options(); options.DnsServer != "" {
+		server = options.DnsServer
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return server
+}
+
+// Get the TSIG key signing the queries and updates of the zone, set in its options or in -dnsupdate-tsig-key
+func (lb *DnsUpdate) tsig() (*tsigKey, error) {
+	if options := lb.options(); options.DnsTsigKey != "" {
+		key, err := parseTsigKey(options.DnsTsigKey)
+		if err != nil {
+			return nil, fmt.Errorf("error in the dnsTsigKey option of zone %s: %s", lb.zone, err)
+		}
+		return key, nil
+	}
+	return lb.Settings.tsig, nil
+}
+
+// Get the TTL of the records of the zone, set in its options or in -dnsupdate-ttl
+func (lb *DnsUpdate) ttl() uint32 {
+	if options := lb.options(); options.DnsTtl > 0 {
+		return options.DnsTtl
+	}
+	return lb.Settings.ttl
+}
+
+// Get the A and AAAA records of the load balancer name from the DNS server
+func (lb *DnsUpdate) getRecords() ([]string, error) {
+	key, err := lb.tsig()
+	if err != nil {
+		return nil, err
+	}
+	records := []string{}
+	for _, rrType := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		query := &dnsMessage{
+			id:       newDnsId(),
+			flags:    dnsOpcodeQuery << 11,
+			question: []dnsQuestion{{name: lb.name, qType: rrType, qClass: dnsClassIN}},
+		}
+		resp, err := dnsExchange(lb.server(), query, key, lb.Settings.timeout)
+		if err != nil {
+			return nil, err
+		}
+		if resp.rcode() == dnsRcodeNXDomain {
+			break
+		}
+		if err := dnsRcodeError(resp); err != nil {
+			return nil, err
+		}
+		for _, rr := range resp.answer {
+			if address := dnsRRAddress(rr); address != "" && rr.rrType == rrType && sameDnsName(rr.name, lb.name) {
+				records = append(records, address)
+			}
+		}
+	}
+	sort.Strings(records)
+	return records, nil
+}
+
+// Replace the record sets of the load balancer name with the members provided, in a single update. Only
+// the record sets having changes are replaced.
+func (lb *DnsUpdate) update(members []string, records []string) error {
+	key, err := lb.tsig()
+	if err != nil {
+		return err
+	}
+	update := &dnsMessage{
+		id:       newDnsId(),
+		flags:    dnsOpcodeUpdate << 11,
+		question: []dnsQuestion{{name: lb.zone, qType: dnsTypeSOA, qClass: dnsClassIN}},
+	}
+	for _, rrType := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		desired, actual := addressesOfType(members, rrType), addressesOfType(records, rrType)
+		if strings.Join(desired, ",") == strings.Join(actual, ",") {
+			continue
+		}
+		// Deleting the whole record set and adding the desired records replaces it atomically
+		update.authority = append(update.authority, dnsRR{name: lb.name, rrType: rrType, class: dnsClassANY})
+		for _, address := range desired {
+			update.authority = append(update.authority, newDnsAddressRR(lb.name, net.ParseIP(address), lb.ttl()))
+		}
+	}
+	resp, err := dnsExchange(lb.server(), update, key, lb.Settings.timeout)
+	if err != nil {
+		return err
+	}
+	return dnsRcodeError(resp)
+}
+
+// Get the addresses provided of the record type provided, sorted
+func addressesOfType(addresses []string, rrType uint16) []string {
+	matching := []string{}
+	for _, address := range addresses {
+		if ip := net.ParseIP(address); ip != nil && (ip.To4() != nil) == (rrType == dnsTypeA) {
+			matching = append(matching, ip.String())
+		}
+	}
+	sort.Strings(matching)
+	return matching
+}
+
+// Sync state of the load balancer instance with the real service
+func (lb *DnsUpdate) sync() {
+	for _ = range lb.syncCh {
+		if lb.Tracker.cancelled() {
+			lb.recordSync(time.Now(), errSyncCancelled)
+			lb.Tracker.end()
+			continue
+		}
+		startedAt := time.Now()
+		members := addressesOfType(lb.Members(), dnsTypeA)
+		members = append(members, addressesOfType(lb.Members(), dnsTypeAAAA)...)
+		logger.Debug("syncing", lb.logFields("action", "sync", "members", members)...)
+		lb.zoneMu.Lock()
+		records, err := lb.getRecords()
+		if err != nil {
+			logger.Error("error querying records", lb.logFields("action", "listRecords", "server", lb.server(), "error", err.Error())...)
+		} else if diff := lb.buildDiff(members, records); len(diff.ToAdd) > 0 || len(diff.ToRemove) > 0 {
+			if lb.DryRun {
+				logger.Info("dry run, not updating records", lb.logFields("action", "updateRecords", "members", members)...)
+			} else if err = lb.update(members, records); err != nil {
+				logger.Error("error updating records", lb.logFields("action", "updateRecords", "server", lb.server(), "error", err.Error())...)
+			} else {
+				logger.Info("records updated", lb.logFields("action", "updateRecords", "members", members)...)
+				records = members
+			}
+		}
+		lb.zoneMu.Unlock()
+		if err == nil {
+			lb.recordActualMembers(len(records))
+		}
+		lb.recordSync(startedAt, err)
+		lb.Tracker.end()
+	}
+}
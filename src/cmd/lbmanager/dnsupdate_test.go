@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDnsUpdateGetRecords(t *testing.T) {
+	key, _ := parseTsigKey("lbmanager:c2VjcmV0")
+	server := newFakeDnsServer(t, key)
+	lb := newTestDnsUpdate(server.address, key)
+
+	records, err := lb.getRecords()
+	if err != nil || len(records) != 0 {
+		t.Errorf("got records %v and error %v for a missing name, want none", records, err)
+	}
+	// No A records, but the name exists
+	server.add("www.example.com", "2001:db8::2", "2001:db8::1")
+	records, err = lb.getRecords()
+	if err != nil || strings.Join(records, ",") != "2001:db8::1,2001:db8::2" {
+		t.Errorf("got records %v and error %v, want the AAAA ones", records, err)
+	}
+	server.add("www.example.com", "10.0.0.2", "10.0.0.1")
+	records, err = lb.getRecords()
+	if err != nil || strings.Join(records, ",") != "10.0.0.1,10.0.0.2,2001:db8::1,2001:db8::2" {
+		t.Errorf("got records %v and error %v, want the A and AAAA ones sorted", records, err)
+	}
+}
+
+func TestDnsUpdateUpdate(t *testing.T) {
+	key, _ := parseTsigKey("lbmanager:c2VjcmV0")
+	server := newFakeDnsServer(t, key)
+	server.add("www.example.com", "10.0.0.1", "10.0.0.2", "2001:db8::1")
+	lb := newTestDnsUpdate(server.address, key)
+
+	members := []string{"10.0.0.1", "10.0.0.3", "2001:db8::1"}
+	records, err := lb.getRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.update(members, records); err != nil {
+		t.Fatal(err)
+	}
+	// Only the A record set changed, so it's the only one replaced
+	got := []string{}
+	for _, rr := range server.updates[0] {
+		got = append(got, strings.Join([]string{rr.name, map[uint16]string{dnsTypeA: "A", dnsTypeAAAA: "AAAA"}[rr.rrType],
+			map[uint16]string{dnsClassIN: "IN", dnsClassANY: "ANY"}[rr.class], dnsRRAddress(rr)}, " "))
+		if rr.class == dnsClassIN && rr.ttl != 30 {
+			t.Errorf("got ttl %d, want the one in the settings", rr.ttl)
+		}
+	}
+	want := []string{
+		"www.example.com A ANY ",
+		"www.example.com A IN 10.0.0.1",
+		"www.example.com A IN 10.0.0.3",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got update:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if addresses := server.addresses("www.example.com"); strings.Join(addresses, ",") != "10.0.0.1,10.0.0.3,2001:db8::1" {
+		t.Errorf("got records %v after the update", addresses)
+	}
+
+	// Removing all the members deletes the record sets
+	if err := lb.update(nil, server.addresses("www.example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if addresses := server.addresses("www.example.com"); len(addresses) != 0 {
+		t.Errorf("got records %v, want them deleted", addresses)
+	}
+}
+
+func TestDnsUpdateTsigErrors(t *testing.T) {
+	key, _ := parseTsigKey("lbmanager:c2VjcmV0")
+	tests := []struct {
+		name      string
+		serverKey string
+		unchained bool
+		err       string
+	}{
+		{name: "bad signature", serverKey: "lbmanager:b3RoZXI=", err: "DNS server returned NOTAUTH, BADSIG"},
+		{name: "bad key", serverKey: "other:c2VjcmV0", err: "DNS server returned NOTAUTH, BADKEY"},
+		{name: "response not chained to the request", serverKey: "lbmanager:c2VjcmV0", unchained: true, err: "invalid DNS response signature"},
+	}
+	for _, test := range tests {
+		serverKey, _ := parseTsigKey(test.serverKey)
+		server := newFakeDnsServer(t, serverKey)
+		server.unchained = test.unchained
+		server.add("www.example.com", "10.0.0.1")
+		lb := newTestDnsUpdate(server.address, key)
+		if _, err := lb.getRecords(); err == nil || err.Error() != test.err {
+			t.Errorf("%s: got error %v querying, want %q", test.name, err, test.err)
+		}
+		if err := lb.update([]string{"10.0.0.2"}, []string{"10.0.0.1"}); err == nil || err.Error() != test.err {
+			t.Errorf("%s: got error %v updating, want %q", test.name, err, test.err)
+		}
+		if !test.unchained && len(server.updates) != 0 {
+			t.Errorf("%s: got updates %v applied with an invalid signature", test.name, server.updates)
+		}
+	}
+}
+
+func TestDnsUpdateZoneOptions(t *testing.T) {
+	key, _ := parseTsigKey("lbmanager:c2VjcmV0")
+	zoneKey, _ := parseTsigKey("hmac-sha512:example:b3RoZXI=")
+	server := newFakeDnsServer(t, zoneKey)
+	lb := newTestDnsUpdate("127.0.0.1:1", key)
+
+	tests := []struct {
+		name    string
+		options *lbOptions
+		ttl     uint32
+		err     string
+	}{
+		{
+			name:    "zone settings",
+			options: &lbOptions{DnsServer: server.address, DnsTsigKey: "hmac-sha512:example:b3RoZXI=", DnsTtl: 300},
+			ttl:     300,
+		},
+		{
+			name:    "default ttl",
+			options: &lbOptions{DnsServer: server.address, DnsTsigKey: "hmac-sha512:example:b3RoZXI="},
+			ttl:     30,
+		},
+		{
+			name:    "default key",
+			options: &lbOptions{DnsServer: server.address},
+			err:     "DNS server returned NOTAUTH, BADKEY",
+		},
+		{
+			name:    "invalid key",
+			options: &lbOptions{DnsServer: server.address, DnsTsigKey: "example"},
+			err:     "error in the dnsTsigKey option of zone example.com: invalid TSIG key: expected [ALGORITHM:]NAME:SECRET",
+		},
+	}
+	for _, test := range tests {
+		lb.Options = func() *lbOptions { return test.options }
+		server.updates = nil
+		err := lb.update([]string{"10.0.0.1"}, nil)
+		if (err != nil || test.err != "") && (err == nil || err.Error() != test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			continue
+		}
+		if test.err != "" {
+			continue
+		}
+		if len(server.updates) != 1 || server.updates[0][1].ttl != test.ttl {
+			t.Errorf("%s: got updates %v, want a record with ttl %d", test.name, server.updates, test.ttl)
+		}
+		if _, err := lb.getRecords(); err != nil {
+			t.Errorf("%s: got error %v querying", test.name, err)
+		}
+	}
+}
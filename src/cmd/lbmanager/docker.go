@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Minimal client of the Docker Engine API, listening on a unix socket
+type dockerClient struct {
+	client       *http.Client
+	eventsClient *http.Client
+}
+
+type dockerContainer struct {
+	Id     string
+	Labels map[string]string
+}
+
+type dockerEvent struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// Create a Docker client connecting to the unix socket provided
+func newDockerClient(socket string) *dockerClient {
+	transport := &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout("unix", socket, 5*time.Second)
+		},
+	}
+	return &dockerClient{
+		client:       &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		eventsClient: &http.Client{Transport: transport},
+	}
+}
+
+// Get the running containers
+func (c *dockerClient) containers() ([]*dockerContainer, error) {
+	containers := []*dockerContainer{}
+	err := c.get("/containers/json", &containers)
+	return containers, err
+}
+
+// Get the labels of a container
+func (c *dockerClient) containerLabels(id string) (map[string]string, error) {
+	var container struct {
+		Config struct {
+			Labels map[string]string
+		}
+	}
+	err := c.get("/containers/"+url.QueryEscape(id)+"/json", &container)
+	return container.Config.Labels, err
+}
+
+// Send the start and die events of containers to the channel provided until stopCh is closed or the
+// connection fails, closing the channel on return
+func (c *dockerClient) events(eventsCh chan *dockerEvent, stopCh chan bool) error {
+	defer close(eventsCh)
+	filters := `{"type":["container"],"event":["start","die"]}`
+	req, err := http.NewRequest("GET", "http://docker/events?filters="+url.QueryEscape(filters), nil)
+	if err != nil {
+		return err
+	}
+	cancelCh, doneCh := make(chan struct{}), make(chan struct{})
+	defer close(doneCh)
+	go func() {
+		select {
+		case <-stopCh:
+			close(cancelCh)
+		case <-doneCh:
+		}
+	}()
+	req.Cancel = cancelCh
+	resp, err := c.eventsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("got status code: %d (%s)", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := &dockerEvent{}
+		if err := decoder.Decode(event); err != nil {
+			select {
+			case <-stopCh:
+				return nil
+			default:
+				return err
+			}
+		}
+		select {
+		case eventsCh <- event:
+		case <-stopCh:
+			return nil
+		}
+	}
+}
+
+// Send a GET request to the Docker API, decoding the JSON response into resp
+func (c *dockerClient) get(path string, resp interface{}) error {
+	httpResp, err := c.client.Get("http://docker" + path)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	data, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status code: %d (%s)", httpResp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, resp)
+}
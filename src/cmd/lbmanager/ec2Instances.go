@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// Time instances resolved from their private IP or DNS name are cached, and time the members not
+// found are cached, so that they aren't looked up on every sync
+const (
+	instanceCacheTtl     = 5 * time.Minute
+	instanceCacheMissTtl = time.Minute
+)
+
+// Cache of the instances resolved, by region and private IP or DNS name
+type instanceCache struct {
+	entries map[string]*instanceCacheEntry
+	mu      sync.Mutex
+}
+
+type instanceCacheEntry struct {
+	expires    time.Time
+	instanceId string
+}
+
+var ec2InstanceCache = &instanceCache{entries: make(map[string]*instanceCacheEntry)}
+
+// Get a cached instance, returning false if it's not cached or the entry expired. The instance id is
+// empty if the member wasn't found.
+func (c *instanceCache) get(region, member string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[region+"/"+member]
+	if entry == nil || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.instanceId, true
+}
+
+// Cache the instance a member resolves to, or that it wasn't found if the instance id is empty
+func (c *instanceCache) set(region, member, instanceId string) {
+	ttl := instanceCacheTtl
+	if instanceId == "" {
+		ttl = instanceCacheMissTtl
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[region+"/"+member] = &instanceCacheEntry{expires: time.Now().Add(ttl), instanceId: instanceId}
+}
+
+// Resolve the instances of members set as private IPs or DNS names, looking up the ones not cached with
+// DescribeInstances (in a single call per kind of member). Members already set as instance ids are
+// returned as is, and members not found among the pending or running instances in the region are
+// returned as unresolved.
+func resolveInstances(lb *LB, members []string) (resolved map[string]string, unresolved []string, err error) {
+	resolved, unresolved = make(map[string]string), []string{}
+	pending := map[string][]string{"private-ip-address": {}, "private-dns-name": {}}
+	for _, member := range members {
+		switch {
+		case instanceIdRe.MatchString(member):
+			resolved[member] = member
+		case net.ParseIP(member) != nil:
+			pending["private-ip-address"] = appendUncached(pending["private-ip-address"], lb.region, member)
+		default:
+			pending["private-dns-name"] = appendUncached(pending["private-dns-name"], lb.region, member)
+		}
+	}
+	for _, filterName := range []string{"private-ip-address", "private-dns-name"} {
+		if len(pending[filterName]) == 0 {
+			continue
+		}
+		if err = lookupInstances(lb, filterName, pending[filterName]); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, member := range members {
+		if _, ok := resolved[member]; ok {
+			continue
+		}
+		if instanceId, _ := ec2InstanceCache.get(lb.region, member); instanceId != "" {
+			resolved[member] = instanceId
+		} else {
+			unresolved = append(unresolved, member)
+		}
+	}
+	return
+}
+
+// Append a member to the list of members to look up, unless it's cached
+func appendUncached(members []string, region, member string) []string {
+	if _, cached := ec2InstanceCache.get(region, member); cached {
+		return members
+	}
+	return append(members, member)
+}
+
+// Look up the instances having one of the private IPs or DNS names provided, caching the results
+func lookupInstances(lb *LB, filterName string, values []string) error {
+	instances, err := describeInstances(lb, filterName, values, "pending", "running")
+	if err != nil {
+		return err
+	}
+	found := make(map[string]string)
+	for _, instance := range instances {
+		found[instance.PrivateIpAddress] = instance.InstanceId
+		found[instance.PrivateDNSName] = instance.InstanceId
+	}
+	for _, value := range values {
+		ec2InstanceCache.set(lb.region, value, found[value])
+	}
+	return nil
+}
+
+// Get the current public or private IPs of the instances provided, by instance id, in a single
+// DescribeInstances call. Addresses aren't cached, as they change when instances are stopped and started
+// or elastic IPs are moved. Instances not found among the pending or running ones in the region, or
+// without an address of the kind requested, are returned as unresolved.
+func instanceAddresses(lb *LB, instanceIds []string, private bool) (addresses map[string]string, unresolved []string, err error) {
+	instances, err := describeInstances(lb, "instance-id", instanceIds, "pending", "running")
+	if err != nil {
+		return nil, nil, err
+	}
+	addresses, unresolved = make(map[string]string), []string{}
+	for _, instance := range instances {
+		if private {
+			addresses[instance.InstanceId] = instance.PrivateIpAddress
+		} else {
+			addresses[instance.InstanceId] = instance.PublicIpAddress
+		}
+	}
+	for _, instanceId := range instanceIds {
+		if addresses[instanceId] == "" {
+			delete(addresses, instanceId)
+			unresolved = append(unresolved, instanceId)
+		}
+	}
+	return
+}
+
+// Describe the instances in the region of the load balancer matching one of the values of the filter
+// provided, in any of the states provided (in any state if none). Filters are used instead of instance
+// ids, as EC2 fails the whole call when one of the instance ids requested doesn't exist.
+func describeInstances(lb *LB, filterName string, values []string, states ...string) ([]ec2.Instance, error) {
+	auth, err := getAwsAuth(lb.AwsCredentials())
+	if err != nil {
+		return nil, err
+	}
+	region, _ := awsEndpoints.region(lb.region)
+	filter := ec2.NewFilter()
+	filter.Add(filterName, values...)
+	if len(states) > 0 {
+		filter.Add("instance-state-name", states...)
+	}
+	resp, err := ec2.New(auth, region).Instances(nil, filter)
+	metrics.observeAwsCall(lb.Id, "DescribeInstances", err)
+	if err != nil {
+		return nil, err
+	}
+	instances := []ec2.Instance{}
+	for _, reservation := range resp.Reservations {
+		instances = append(instances, reservation.Instances...)
+	}
+	return instances, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestResolveInstances(t *testing.T) {
+	fake := newFakeAws(t)
+	cache := newTestInstanceCache(t)
+	lb := &LB{AwsCredentials: fakeAwsCredentials, Id: "elb_local-1_web", region: fakeAwsRegion}
+	members := []string{"i-99999999", "10.0.0.1", "ip-10-0-0-1.ec2.internal", "10.0.0.2", "10.0.0.3"}
+
+	// Steps run in order, sharing the cache
+	tests := []struct {
+		name       string
+		instances  []fakeInstance
+		expire     string
+		resolved   []string
+		unresolved []string
+		requests   int
+	}{
+		{
+			name: "looked up",
+			instances: []fakeInstance{
+				{id: "i-11111111", state: "running", privateIp: "10.0.0.1", privateDns: "ip-10-0-0-1.ec2.internal"},
+				{id: "i-22222222", state: "terminated", privateIp: "10.0.0.2"},
+			},
+			resolved:   []string{"10.0.0.1=i-11111111", "i-99999999=i-99999999", "ip-10-0-0-1.ec2.internal=i-11111111"},
+			unresolved: []string{"10.0.0.2", "10.0.0.3"},
+			requests:   2,
+		},
+		{
+			name: "cached",
+			instances: []fakeInstance{
+				{id: "i-33333333", state: "running", privateIp: "10.0.0.3"},
+			},
+			resolved:   []string{"10.0.0.1=i-11111111", "i-99999999=i-99999999", "ip-10-0-0-1.ec2.internal=i-11111111"},
+			unresolved: []string{"10.0.0.2", "10.0.0.3"},
+		},
+		{
+			name: "members not found expired",
+			instances: []fakeInstance{
+				{id: "i-33333333", state: "running", privateIp: "10.0.0.3"},
+			},
+			expire:     "misses",
+			resolved:   []string{"10.0.0.1=i-11111111", "10.0.0.3=i-33333333", "i-99999999=i-99999999", "ip-10-0-0-1.ec2.internal=i-11111111"},
+			unresolved: []string{"10.0.0.2"},
+			requests:   1,
+		},
+		{
+			name: "address reused by a new instance",
+			instances: []fakeInstance{
+				{id: "i-11111111", state: "terminated", privateIp: "10.0.0.1", privateDns: "ip-10-0-0-1.ec2.internal"},
+				{id: "i-44444444", state: "pending", privateIp: "10.0.0.1", privateDns: "ip-10-0-0-1.ec2.internal"},
+			},
+			expire:     "all",
+			resolved:   []string{"10.0.0.1=i-44444444", "i-99999999=i-99999999", "ip-10-0-0-1.ec2.internal=i-44444444"},
+			unresolved: []string{"10.0.0.2", "10.0.0.3"},
+			requests:   2,
+		},
+	}
+	for _, test := range tests {
+		fake.setInstances(test.instances...)
+		if test.expire != "" {
+			cache.expire(test.expire == "misses")
+		}
+		resolved, unresolved, err := resolveInstances(lb, members)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		got := []string{}
+		for member, instanceId := range resolved {
+			got = append(got, member+"="+instanceId)
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(test.resolved, " ") {
+			t.Errorf("%s: got resolved %v, want %v", test.name, got, test.resolved)
+		}
+		if strings.Join(unresolved, " ") != strings.Join(test.unresolved, " ") {
+			t.Errorf("%s: got unresolved %v, want %v", test.name, unresolved, test.unresolved)
+		}
+		if requests := fake.takeRequests(); len(requests) != test.requests {
+			t.Errorf("%s: got requests %v, want %d DescribeInstances calls", test.name, requests, test.requests)
+		}
+	}
+}
@@ -1,21 +1,54 @@
 package main
 
 import (
-	"github.com/mitchellh/goamz/aws"
+	"fmt"
 	"github.com/mitchellh/goamz/elb"
-	"log"
+	"net"
+	"regexp"
+	"strings"
+	"time"
 )
 
+var (
+	elbNameRe    = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,30}[a-zA-Z0-9])?$`)
+	instanceIdRe = regexp.MustCompile(`^i-([0-9a-f]{8}|[0-9a-f]{17})$`)
+)
+
+func init() {
+	registerBackend("elb", &lbBackend{
+		fields:        []string{"region", "name", "class", "member"},
+		usage:         []string{"REGION", "LB_NAME", "LB_CLASS", "MEMBER"},
+		idFields:      []string{"region", "name"},
+		optionsScopes: [][]string{{"region", "name"}, {"region"}},
+		validate: func(k *memberKey) error {
+			if err := k.validateRegion(); err != nil {
+				return err
+			}
+			if !elbNameRe.MatchString(k.name) {
+				return fmt.Errorf("invalid ELB name: %s", k.name)
+			}
+			if ip := net.ParseIP(k.member); k.member != "" && !instanceIdRe.MatchString(k.member) && (ip == nil || ip.To4() == nil) && !fqdnRe.MatchString(k.member) {
+				return fmt.Errorf("invalid member: %s (instance id, private IP or private DNS name)", k.member)
+			}
+			return nil
+		},
+		build: func(m *Manager, configEntry *configEntry) LoadBalancer {
+			return &Elb{LB: m.newLB(configEntry)}
+		},
+	})
+}
+
 type Elb struct {
 	LB
-	awsClient *elb.ELB
-	syncCh    chan int
+	syncCh chan int
 }
 
 // Setup ELB based load balancer
 func (lb *Elb) Setup(meta map[string]string) {
-	log.Printf("-> ELB:%s:settingUpLoadBalancerState\n", meta["name"])
-	lb.awsClient = elb.New(lb.AwsAuth, aws.Regions[meta["region"]])
+	logger.Info("setting up load balancer state", lb.logFields("action", "setup", "name", meta["name"], "region", meta["region"])...)
+	if !awsEndpoints.validRegion("elb", meta["region"]) {
+		logger.Warn("unknown region and no endpoint provided for it, AWS calls will fail", lb.logFields("action", "setup", "region", meta["region"])...)
+	}
 	lb.class = meta["class"]
 	lb.configKey = lb.ConfigPath + "/elb/" + meta["region"] + "/" + meta["name"] + "/"
 	lb.name = meta["name"]
@@ -28,20 +61,81 @@ func (lb *Elb) Setup(meta map[string]string) {
 
 // Sync state of the load balancer instance with the real service
 func (lb *Elb) Sync() {
+	if !lb.Tracker.begin() {
+		logger.Warn("shutting down, sync discarded", lb.logFields("action", "sync")...)
+		return
+	}
 	lb.syncCh <- 1
 }
 
+// Get the differences between the load balancer state and the AWS ELB
+func (lb *Elb) Diff() (*LBDiff, error) {
+	instances, _, err := lb.resolveMembers(lb.Members())
+	if err != nil {
+		return nil, err
+	}
+	instancesInAwsElb, err := lb.getInstancesInAwsElb()
+	if err != nil {
+		return nil, err
+	}
+	return lb.buildDiff(instances, instancesInAwsElb), nil
+}
+
+// Get the instances of the members, which may be set as instance ids, private IPs or private DNS names,
+// along with the members not found in the region
+func (lb *Elb) resolveMembers(members []string) (instances []string, unresolved []string, err error) {
+	resolved, unresolved, err := resolveInstances(&lb.LB, members)
+	if err != nil {
+		return nil, nil, err
+	}
+	instances = []string{}
+	for _, member := range members {
+		if instance, ok := resolved[member]; ok && !lb.memberExists(instance, instances) {
+			instances = append(instances, instance)
+		}
+	}
+	return instances, unresolved, nil
+}
+
+// Get the instance of a member, as registered in the AWS ELB
+func (lb *Elb) resolveMember(member string) (string, error) {
+	instances, _, err := lb.resolveMembers([]string{member})
+	if err != nil || len(instances) == 0 {
+		return member, err
+	}
+	return instances[0], nil
+}
+
+// Build an ELB client using the current AWS credentials
+func (lb *Elb) awsClient() (*elb.ELB, error) {
+	auth, err := getAwsAuth(lb.AwsCredentials())
+	if err != nil {
+		return nil, err
+	}
+	region, _ := awsEndpoints.region(lb.region)
+	return elb.New(auth, region), nil
+}
+
 // Add an instance to the AWS ELB
-func (lb *Elb) addInstanceToAwsElb(instance string) {
-	log.Printf("-> ELB:%s:addInstanceToAwsElb:%s\n", lb.name, instance)
+func (lb *Elb) addInstanceToAwsElb(instance string) error {
+	if lb.DryRun {
+		logger.Info("dry run, not registering instance in AWS ELB", lb.logFields("action", "registerInstance", "member", instance)...)
+		return nil
+	}
+	logger.Info("registering instance in AWS ELB", lb.logFields("action", "registerInstance", "member", instance)...)
 	options := elb.RegisterInstancesWithLoadBalancer{
 		LoadBalancerName: lb.name,
 		Instances:        []string{instance},
 	}
-	_, err := lb.awsClient.RegisterInstancesWithLoadBalancer(&options)
+	awsClient, err := lb.awsClient()
+	if err == nil {
+		_, err = awsClient.RegisterInstancesWithLoadBalancer(&options)
+		metrics.observeAwsCall(lb.Id, "RegisterInstancesWithLoadBalancer", err)
+	}
 	if err != nil {
-		log.Println(err)
+		logger.Error("error registering instance in AWS ELB", lb.logFields("action", "registerInstance", "member", instance, "error", err.Error())...)
 	}
+	return err
 }
 
 // Get instances in AWS ELB
@@ -50,47 +144,94 @@ func (lb *Elb) getInstancesInAwsElb() (instances []string, err error) {
 	options := elb.DescribeLoadBalancer{
 		Names: []string{lb.name},
 	}
-	resp, err := lb.awsClient.DescribeLoadBalancers(&options)
+	awsClient, err := lb.awsClient()
+	if err != nil {
+		return
+	}
+	resp, err := awsClient.DescribeLoadBalancers(&options)
+	metrics.observeAwsCall(lb.Id, "DescribeLoadBalancers", err)
 	if err == nil {
 		for _, instance := range resp.LoadBalancers[0].Instances {
 			instances = append(instances, instance.InstanceId)
 		}
-		log.Printf("-- ELB:%s:instancesInAws:%s\n", lb.name, instances)
+		logger.Debug("instances in AWS ELB", lb.logFields("action", "describeInstances", "members", instances)...)
 	}
 	return
 }
 
 // Remove an instance from the AWS ELB
-func (lb *Elb) removeInstanceFromAwsElb(instance string) {
-	log.Printf("<- ELB:%s:removeInstanceFromAwsElb:%s\n", lb.name, instance)
+func (lb *Elb) removeInstanceFromAwsElb(instance string) error {
+	if lb.DryRun {
+		logger.Info("dry run, not deregistering instance from AWS ELB", lb.logFields("action", "deregisterInstance", "member", instance)...)
+		return nil
+	}
+	logger.Info("deregistering instance from AWS ELB", lb.logFields("action", "deregisterInstance", "member", instance)...)
 	options := elb.DeregisterInstancesFromLoadBalancer{
 		LoadBalancerName: lb.name,
 		Instances:        []string{instance},
 	}
-	_, err := lb.awsClient.DeregisterInstancesFromLoadBalancer(&options)
+	awsClient, err := lb.awsClient()
+	if err == nil {
+		_, err = awsClient.DeregisterInstancesFromLoadBalancer(&options)
+		metrics.observeAwsCall(lb.Id, "DeregisterInstancesFromLoadBalancer", err)
+	}
 	if err != nil {
-		log.Println(err)
+		logger.Error("error deregistering instance from AWS ELB", lb.logFields("action", "deregisterInstance", "member", instance, "error", err.Error())...)
 	}
+	return err
 }
 
 // Sync state of the load balancer instance with the real service
 func (lb *Elb) sync() {
 	for _ = range lb.syncCh {
-		log.Printf("-- ELB:%s:syncing:%s\n", lb.name, lb.members)
+		if lb.Tracker.cancelled() {
+			lb.recordSync(time.Now(), errSyncCancelled)
+			lb.Tracker.end()
+			continue
+		}
+		startedAt := time.Now()
+		logger.Debug("syncing", lb.logFields("action", "sync", "members", lb.Members())...)
+		members, unresolved, err := lb.resolveMembers(lb.Members())
+		if err != nil {
+			logger.Error("error resolving members instances", lb.logFields("action", "sync", "error", err.Error())...)
+			lb.recordSync(startedAt, err)
+			lb.Tracker.end()
+			continue
+		}
+		var syncErr error
+		lb.recordUnresolved(unresolved)
+		if len(unresolved) > 0 {
+			syncErr = fmt.Errorf("members not found among the instances in %s: %s", lb.region, strings.Join(unresolved, " "))
+			logger.Warn("members not found, not registering them", lb.logFields("action", "sync", "members", unresolved)...)
+		}
 		instancesInAwsElb, err := lb.getInstancesInAwsElb()
 		if err != nil {
-			log.Println(err)
+			logger.Error("error getting instances in AWS ELB", lb.logFields("action", "sync", "error", err.Error())...)
+			lb.recordSync(startedAt, err)
+			lb.Tracker.end()
 			continue
 		}
+		actualMembers := len(instancesInAwsElb)
 		for _, instance := range instancesInAwsElb {
-			if !lb.memberExists(instance, lb.members) {
-				lb.removeInstanceFromAwsElb(instance)
+			if !lb.memberExists(instance, members) {
+				if err := lb.removeInstanceFromAwsElb(instance); err != nil {
+					syncErr = err
+				} else if !lb.DryRun {
+					actualMembers--
+				}
 			}
 		}
-		for _, instance := range lb.members {
+		for _, instance := range members {
 			if !lb.memberExists(instance, instancesInAwsElb) {
-				lb.addInstanceToAwsElb(instance)
+				if err := lb.addInstanceToAwsElb(instance); err != nil {
+					syncErr = err
+				} else if !lb.DryRun {
+					actualMembers++
+				}
 			}
 		}
+		lb.recordActualMembers(actualMembers)
+		lb.recordSync(startedAt, syncErr)
+		lb.Tracker.end()
 	}
 }
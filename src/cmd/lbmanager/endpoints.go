@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+// AWS services whose endpoints can be overridden
+var endpointServices = map[string]bool{"ec2": true, "elb": true, "route53": true, "sts": true}
+
+// AWS endpoints overridden, by service or service/region
+type endpoints map[string]string
+
+// Endpoints overridden from the command line
+var awsEndpoints = endpoints{}
+
+// Parse a comma separated list of endpoint overrides, in the form SERVICE[/REGION]=URL
+func parseEndpoints(s string) (endpoints, error) {
+	e := endpoints{}
+	if s == "" {
+		return e, nil
+	}
+	for _, override := range strings.Split(s, ",") {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid endpoint: %s (SERVICE[/REGION]=URL)", override)
+		}
+		if service := strings.SplitN(parts[0], "/", 2)[0]; !endpointServices[service] {
+			return nil, fmt.Errorf("invalid endpoint service: %s (ec2|elb|route53|sts)", service)
+		}
+		if u, err := url.Parse(parts[1]); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint url: %s", parts[1])
+		}
+		e[parts[0]] = strings.TrimSuffix(parts[1], "/")
+	}
+	return e, nil
+}
+
+// Get the endpoint overridden for a service in a region, if any
+func (e endpoints) lookup(service, region string) string {
+	if endpoint, ok := e[service+"/"+region]; ok {
+		return endpoint
+	}
+	return e[service]
+}
+
+// Get the region to use in goamz clients, with its endpoints overridden. Regions unknown to goamz are
+// only valid for the services whose endpoints have been provided.
+func (e endpoints) region(name string) (region aws.Region, known bool) {
+	region, known = aws.Regions[name]
+	if !known {
+		region = aws.Region{Name: name}
+	}
+	if endpoint := e.lookup("ec2", name); endpoint != "" {
+		region.EC2Endpoint = endpoint
+	}
+	if endpoint := e.lookup("elb", name); endpoint != "" {
+		region.ELBEndpoint = endpoint
+	}
+	if endpoint := e.lookup("route53", name); endpoint != "" {
+		region.Route53Endpoint = endpoint
+	}
+	return
+}
+
+// Check if a region can be used for a service, either being known to goamz or having its endpoint overridden
+func (e endpoints) validRegion(service, name string) bool {
+	_, known := aws.Regions[name]
+	return known || e.lookup(service, name) != ""
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/route53"
+)
+
+func TestParseEndpoints(t *testing.T) {
+	tests := []struct {
+		value string
+		want  endpoints
+		err   string
+	}{
+		{value: "", want: endpoints{}},
+		{
+			value: "ec2=http://localhost:4566/,route53/us-east-1=https://route53.example.com",
+			want:  endpoints{"ec2": "http://localhost:4566", "route53/us-east-1": "https://route53.example.com"},
+		},
+		{value: "ec2", err: "invalid endpoint: ec2 (SERVICE[/REGION]=URL)"},
+		{value: "s3=http://localhost:4566", err: "invalid endpoint service: s3 (ec2|elb|route53|sts)"},
+		{value: "elb=localhost:4566", err: "invalid endpoint url: localhost:4566"},
+	}
+	for _, test := range tests {
+		got, err := parseEndpoints(test.value)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q: got error %v, want %q", test.value, err, test.err)
+			}
+			continue
+		}
+		if err != nil || len(got) != len(test.want) {
+			t.Errorf("%q: got endpoints %v and error %v, want %v", test.value, got, err, test.want)
+			continue
+		}
+		for key, endpoint := range test.want {
+			if got[key] != endpoint {
+				t.Errorf("%q: got endpoint %s=%s, want %s", test.value, key, got[key], endpoint)
+			}
+		}
+	}
+}
+
+func TestEndpointsRegion(t *testing.T) {
+	e := endpoints{"ec2": "http://localhost:4566", "ec2/eu-west-1": "http://localhost:4567", "route53/local-1": "http://localhost:4568"}
+	region, known := e.region("eu-west-1")
+	if !known || region.EC2Endpoint != "http://localhost:4567" || region.ELBEndpoint != aws.EUWest.ELBEndpoint {
+		t.Errorf("got region %+v, want the region endpoint overriding the service one, and the other ones kept", region)
+	}
+	if region, _ := e.region("us-east-1"); region.EC2Endpoint != "http://localhost:4566" {
+		t.Errorf("got ec2 endpoint %s, want the service one", region.EC2Endpoint)
+	}
+	if region, known := e.region("local-1"); known || region.Route53Endpoint != "http://localhost:4568" || region.ELBEndpoint != "" {
+		t.Errorf("got region %+v, want only the endpoints provided", region)
+	}
+	if !e.validRegion("route53", "local-1") || e.validRegion("elb", "local-1") || !e.validRegion("elb", "us-east-1") {
+		t.Error("got regions valid without endpoints for their services")
+	}
+}
+
+func TestClientsUseOverriddenEndpoints(t *testing.T) {
+	fake := newFakeAws(t)
+	fake.elbs["web"] = []string{"i-11111111"}
+	fake.records["www.example.com"] = []string{"10.0.0.1"}
+	fake.setInstances(fakeInstance{id: "i-11111111", state: "running", privateIp: "10.0.0.1"})
+	elb := &Elb{LB: LB{AwsCredentials: fakeAwsCredentials, Id: "elb_local-1_web", name: "web", region: fakeAwsRegion}}
+
+	instances, err := elb.getInstancesInAwsElb()
+	if err != nil || strings.Join(instances, " ") != "i-11111111" {
+		t.Errorf("elb: got instances %v and error %v", instances, err)
+	}
+	region, _ := awsEndpoints.region(fakeAwsRegion)
+	z := &ZoneUpdater{AwsCredentials: fakeAwsCredentials, HostedZone: "Z1", Region: region}
+	records, err := z.getResourceRecords("route53_Z1_www.example.com", "www.example.com")
+	if err != nil || strings.Join(records, " ") != "10.0.0.1" {
+		t.Errorf("route53: got records %v and error %v", records, err)
+	}
+	newTestInstanceCache(t)
+	resolved, _, err := resolveInstances(&elb.LB, []string{"10.0.0.1"})
+	if err != nil || resolved["10.0.0.1"] != "i-11111111" {
+		t.Errorf("ec2: got instances %v and error %v", resolved, err)
+	}
+	client, _ := z.awsClient()
+	if _, err := client.ChangeResourceRecordSets("Z1", &route53.ChangeResourceRecordSetsRequest{Changes: []route53.Change{{
+		Action: "UPSERT", Record: route53.ResourceRecordSet{Name: "www.example.com", Type: "A", TTL: 60, Records: []string{"10.0.0.2"}},
+	}}}); err != nil || strings.Join(fake.records["www.example.com"], " ") != "10.0.0.2" {
+		t.Errorf("route53: got records %v and error %v after the change", fake.records["www.example.com"], err)
+	}
+
+	want := []string{
+		"elb DescribeLoadBalancers",
+		"route53 GET /2013-04-01/hostedzone/Z1/rrset",
+		"ec2 DescribeInstances",
+		"route53 POST /2013-04-01/hostedzone/Z1/rrset",
+	}
+	if got := fake.takeRequests(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got requests:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// Error codes returned by etcd when a key is not found and when the index watched has been cleared
+const (
+	etcdKeyNotFound     = 100
+	etcdEventIndexClear = 401
+)
+
+// Actions of the etcd v2 changes, as sent by the other config stores: keys created or updated are set,
+// and keys expired or deleted are deleted
+var etcdActions = map[string]string{
+	"set":              "set",
+	"create":           "set",
+	"update":           "set",
+	"compareAndSwap":   "set",
+	"delete":           "delete",
+	"expire":           "delete",
+	"compareAndDelete": "delete",
+}
+
+// Config store using the etcd v2 API
+type etcdStore struct {
+	client    *etcd.Client
+	mu        sync.Mutex
+	nextIndex uint64
+}
+
+// Create an etcd v2 config store, using TLS when a CA or client certificate is provided and basic auth
+// when a username is provided
+func newEtcdStore(options *storeOptions) (*etcdStore, error) {
+	client := etcd.NewClient(options.machines)
+	tlsConfig, err := options.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		client.SetTransport(&http.Transport{
+			Dial:            client.DefaultDial,
+			TLSClientConfig: tlsConfig,
+		})
+	}
+	if options.username != "" {
+		client.SetCredentials(options.username, options.password)
+	}
+	return &etcdStore{client: client}, nil
+}
+
+// Get all the keys under a path
+func (s *etcdStore) List(path string) ([]*storeNode, error) {
+	nodes, _, err := s.list(path)
+	return nodes, err
+}
+
+// Get all the keys under a path, resuming the next watch from the index following the one read
+func (s *etcdStore) Snapshot(path string) ([]*storeNode, error) {
+	nodes, index, err := s.list(path)
+	if err == nil || err == errKeyNotFound {
+		s.mu.Lock()
+		s.nextIndex = index + 1
+		s.mu.Unlock()
+	}
+	return nodes, err
+}
+
+// Get all the keys under a path, along with the etcd index they were read at
+func (s *etcdStore) list(path string) ([]*storeNode, uint64, error) {
+	response, err := s.client.Get(path, true, true)
+	if etcdErr, ok := err.(*etcd.EtcdError); ok && etcdErr.ErrorCode == etcdKeyNotFound {
+		return nil, etcdErr.Index, errKeyNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	nodes := []*storeNode{}
+	var walk func(node *etcd.Node)
+	walk = func(node *etcd.Node) {
+		if !node.Dir {
+			nodes = append(nodes, &storeNode{action: "get", index: node.ModifiedIndex, key: node.Key, value: node.Value})
+		}
+		for _, child := range node.Nodes {
+			walk(child)
+		}
+	}
+	walk(response.Node)
+	return nodes, response.EtcdIndex, nil
+}
+
+// Set a key
+func (s *etcdStore) Set(key string, value string, ttl uint64) error {
+	_, err := s.client.Set(key, value, ttl)
+	return s.convertError(err)
+}
+
+// Refresh the ttl of a key. Older etcd versions, not supporting refreshes, set the key again with the
+// same value, which is notified as an update.
+func (s *etcdStore) Refresh(key string, ttl uint64) error {
+	keyPath := strings.Replace(url.QueryEscape(path.Join("keys", key)), "%2F", "/", -1)
+	raw, err := s.client.SendRequest(etcd.NewRawRequest("PUT", keyPath+"?refresh=true&prevExist=true", url.Values{"ttl": {strconv.FormatUint(ttl, 10)}}, nil))
+	if err == nil {
+		_, err = raw.Unmarshal()
+	}
+	return s.convertError(err)
+}
+
+// Delete a key
+func (s *etcdStore) Delete(key string, recursive bool) error {
+	_, err := s.client.Delete(key, recursive)
+	return s.convertError(err)
+}
+
+// Watch the changes under a path, resuming from the index following the last change seen
+func (s *etcdStore) Watch(path string, nodesCh chan *storeNode, stopCh chan bool) error {
+	defer close(nodesCh)
+	responsesCh := make(chan *etcd.Response)
+	errCh := make(chan error, 1)
+	s.mu.Lock()
+	index := s.nextIndex
+	s.mu.Unlock()
+	go func() {
+		_, err := s.client.Watch(path, index, true, responsesCh, stopCh)
+		errCh <- err
+	}()
+	for response := range responsesCh {
+		s.mu.Lock()
+		s.nextIndex = response.Node.ModifiedIndex + 1
+		s.mu.Unlock()
+		nodesCh <- &storeNode{
+			action: etcdActions[response.Action],
+			dir:    response.Node.Dir,
+			index:  response.Node.ModifiedIndex,
+			key:    response.Node.Key,
+			value:  response.Node.Value,
+		}
+	}
+	err := <-errCh
+	if etcdErr, ok := err.(*etcd.EtcdError); ok && etcdErr.ErrorCode == etcdEventIndexClear {
+		// Changes since the last one seen are no longer available, the state has to be read again
+		s.mu.Lock()
+		s.nextIndex = 0
+		s.mu.Unlock()
+		return errWatchIndexLost
+	}
+	// go-etcd produces an "unexpected end of JSON input" error when the watcher times out
+	if err == etcd.ErrWatchStoppedByUser || (err != nil && err.Error() == "unexpected end of JSON input") {
+		return nil
+	}
+	return err
+}
+
+// Convert etcd errors to the store ones
+func (s *etcdStore) convertError(err error) error {
+	if etcdErr, ok := err.(*etcd.EtcdError); ok && etcdErr.ErrorCode == etcdKeyNotFound {
+		return errKeyNotFound
+	}
+	return err
+}
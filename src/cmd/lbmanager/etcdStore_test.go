@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEtcdStoreWatchActions(t *testing.T) {
+	changes := []string{
+		"create /lbManager/dns/www.example.com/multiple/10.0.0.1",
+		"update /lbManager/dns/www.example.com/multiple/10.0.0.1",
+		"compareAndSwap /lbManager/dns/www.example.com/multiple/10.0.0.1",
+		"expire /lbManager/dns/www.example.com/multiple/10.0.0.1",
+		"compareAndDelete /lbManager/dns/www.example.com/multiple/10.0.0.2",
+		"delete /lbManager/dns/www.example.com/multiple/10.0.0.3",
+	}
+	store := newFakeEtcd(t, 10, nil, changes).store(t)
+	store.Snapshot("/lbManager")
+
+	nodesCh, stopCh := make(chan *storeNode), make(chan bool)
+	go store.Watch("/lbManager", nodesCh, stopCh)
+	for i, want := range []string{"set", "set", "set", "delete", "delete", "delete"} {
+		expectNode(t, nodesCh, want+" "+strings.Fields(changes[i])[1])
+	}
+	close(stopCh)
+	for _ = range nodesCh {
+	}
+}
+
+func TestManagerRemovesExpiredMembers(t *testing.T) {
+	members := []string{
+		"/lbManager/dns/www.example.com/multiple/10.0.0.1",
+		"/lbManager/dns/www.example.com/multiple/10.0.0.2",
+	}
+	changes := []string{
+		"expire /lbManager/dns/www.example.com/multiple/10.0.0.1",
+		"compareAndDelete /lbManager/dns/www.example.com/multiple/10.0.0.2",
+		"create /lbManager/dns/www.example.com/multiple/10.0.0.3",
+	}
+	manager := &Manager{configPath: "/lbManager", dryRun: true, store: newFakeEtcd(t, 10, members, changes).store(t)}
+	go manager.Start()
+	defer manager.Stop(time.Second)
+	waitForMembers(t, manager, "10.0.0.3")
+}
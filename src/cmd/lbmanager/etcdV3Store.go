@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix of the etcd v3 JSON gateway endpoints
+const etcdV3ApiPrefix = "/v3"
+
+// Config store using the etcd v3 API through its JSON gateway. Keys are read with prefix range reads,
+// watches are resumed from the revision following the last change seen, and keys with a ttl are
+// attached to a lease.
+type etcdV3Store struct {
+	client       *http.Client
+	machines     []string
+	mu           sync.Mutex
+	nextRevision int64
+	password     string
+	token        string
+	username     string
+}
+
+type etcdV3KeyValue struct {
+	Key         string `json:"key"`
+	Lease       string `json:"lease"`
+	ModRevision int64  `json:"mod_revision,string"`
+	Value       string `json:"value"`
+}
+
+type etcdV3Header struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcdV3Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Error   string `json:"error"`
+}
+
+// Time to wait before returning when a watch can't be established
+const etcdV3WatchRetryDelay = time.Second
+
+// gRPC status code returned when the auth token is missing or has expired
+const etcdV3Unauthenticated = 16
+
+// Create an etcd v3 config store, using TLS when a CA or client certificate is provided and
+// authenticating when a username is provided
+func newEtcdV3Store(options *storeOptions) (*etcdV3Store, error) {
+	tlsConfig, err := options.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &etcdV3Store{
+		client: &http.Client{
+			Transport: &http.Transport{
+				Dial:            (&net.Dialer{Timeout: 5 * time.Second}).Dial,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		machines: options.machines,
+		password: options.password,
+		username: options.username,
+	}, nil
+}
+
+// Get all the keys under a path
+func (s *etcdV3Store) List(path string) ([]*storeNode, error) {
+	nodes, _, err := s.list(path)
+	return nodes, err
+}
+
+// Get all the keys under a path, resuming the next watch from the revision following the one read
+func (s *etcdV3Store) Snapshot(path string) ([]*storeNode, error) {
+	nodes, revision, err := s.list(path)
+	if revision > 0 {
+		s.mu.Lock()
+		s.nextRevision = revision + 1
+		s.mu.Unlock()
+	}
+	return nodes, err
+}
+
+// Get all the keys under a path, along with the revision they were read at
+func (s *etcdV3Store) list(path string) ([]*storeNode, int64, error) {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	req := map[string]interface{}{
+		"key":         encodeEtcdV3(prefix),
+		"range_end":   encodeEtcdV3(prefixRangeEnd(prefix)),
+		"sort_order":  "ASCEND",
+		"sort_target": "KEY",
+	}
+	var resp struct {
+		Header etcdV3Header      `json:"header"`
+		Kvs    []*etcdV3KeyValue `json:"kvs"`
+	}
+	if err := s.call("/kv/range", req, &resp); err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, resp.Header.Revision, errKeyNotFound
+	}
+	nodes := []*storeNode{}
+	for _, kv := range resp.Kvs {
+		nodes = append(nodes, kv.node("get"))
+	}
+	return nodes, resp.Header.Revision, nil
+}
+
+// Set a key, attaching it to a new lease when a ttl is provided
+func (s *etcdV3Store) Set(key string, value string, ttl uint64) error {
+	req := map[string]interface{}{
+		"key":   encodeEtcdV3(key),
+		"value": encodeEtcdV3(value),
+	}
+	if ttl > 0 {
+		var lease struct {
+			ID string `json:"ID"`
+		}
+		if err := s.call("/lease/grant", map[string]interface{}{"TTL": ttl}, &lease); err != nil {
+			return fmt.Errorf("error granting lease: %s", err)
+		}
+		req["lease"] = lease.ID
+	}
+	return s.call("/kv/put", req, nil)
+}
+
+// Refresh the ttl of a key, keeping alive the lease it's attached to (the lease keeps its original ttl)
+func (s *etcdV3Store) Refresh(key string, ttl uint64) error {
+	var resp struct {
+		Kvs []*etcdV3KeyValue `json:"kvs"`
+	}
+	if err := s.call("/kv/range", map[string]interface{}{"key": encodeEtcdV3(key)}, &resp); err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return errKeyNotFound
+	}
+	if lease := resp.Kvs[0].Lease; lease == "" || lease == "0" {
+		return nil
+	}
+	var keepAlive struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+	if err := s.call("/lease/keepalive", map[string]interface{}{"ID": resp.Kvs[0].Lease}, &keepAlive); err != nil {
+		return fmt.Errorf("error keeping lease alive: %s", err)
+	}
+	if keepAlive.Result.TTL == "" || keepAlive.Result.TTL == "0" {
+		// The lease expired, along with the key
+		return errKeyNotFound
+	}
+	return nil
+}
+
+// Delete a key, along with the keys prefixed by its path when recursive
+func (s *etcdV3Store) Delete(key string, recursive bool) error {
+	if err := s.call("/kv/deleterange", map[string]interface{}{"key": encodeEtcdV3(key)}, nil); err != nil {
+		return err
+	}
+	if recursive {
+		prefix := strings.TrimSuffix(key, "/") + "/"
+		return s.call("/kv/deleterange", map[string]interface{}{
+			"key":       encodeEtcdV3(prefix),
+			"range_end": encodeEtcdV3(prefixRangeEnd(prefix)),
+		}, nil)
+	}
+	return nil
+}
+
+// Watch the changes under a path, resuming from the revision following the last change seen
+func (s *etcdV3Store) Watch(path string, nodesCh chan *storeNode, stopCh chan bool) error {
+	defer close(nodesCh)
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	s.mu.Lock()
+	createRequest := map[string]interface{}{
+		"key":            encodeEtcdV3(prefix),
+		"range_end":      encodeEtcdV3(prefixRangeEnd(prefix)),
+		"start_revision": s.nextRevision,
+	}
+	s.mu.Unlock()
+	body, _ := json.Marshal(map[string]interface{}{"create_request": createRequest})
+
+	// Cancel the request when the watch is stopped
+	cancelCh, doneCh := make(chan struct{}), make(chan struct{})
+	defer close(doneCh)
+	go func() {
+		select {
+		case <-stopCh:
+			close(cancelCh)
+		case <-doneCh:
+		}
+	}()
+	resp, err := s.do("/watch", body, cancelCh)
+	if err != nil {
+		// Wait a bit before returning, so that watches aren't retried in a tight loop while etcd is down
+		select {
+		case <-stopCh:
+			return nil
+		case <-time.After(etcdV3WatchRetryDelay):
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusUnauthorized {
+			s.mu.Lock()
+			s.token = ""
+			s.mu.Unlock()
+		}
+		select {
+		case <-stopCh:
+			return nil
+		case <-time.After(etcdV3WatchRetryDelay):
+		}
+		return fmt.Errorf("got status code: %d (%s)", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var message struct {
+			Error  *etcdV3Error `json:"error"`
+			Result struct {
+				Header          etcdV3Header `json:"header"`
+				CompactRevision int64        `json:"compact_revision,string"`
+				Canceled        bool         `json:"canceled"`
+				Events          []struct {
+					Type string          `json:"type"`
+					Kv   *etcdV3KeyValue `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+		}
+		if err := decoder.Decode(&message); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return s.ignoreStopped(err, stopCh)
+		}
+		if message.Error != nil {
+			return fmt.Errorf("%s", message.Error.Message)
+		}
+		if message.Result.Canceled {
+			if message.Result.CompactRevision > 0 {
+				// Changes since the last one seen have been compacted, the state has to be read again
+				s.mu.Lock()
+				s.nextRevision = 0
+				s.mu.Unlock()
+				return errWatchIndexLost
+			}
+			return fmt.Errorf("watch canceled")
+		}
+		// Watches started from now on resume from the revision they were created at
+		s.mu.Lock()
+		if s.nextRevision == 0 && message.Result.Header.Revision > 0 {
+			s.nextRevision = message.Result.Header.Revision + 1
+		}
+		s.mu.Unlock()
+		for _, event := range message.Result.Events {
+			action := "set"
+			if event.Type == "DELETE" {
+				action = "delete"
+			}
+			s.mu.Lock()
+			s.nextRevision = event.Kv.ModRevision + 1
+			s.mu.Unlock()
+			select {
+			case nodesCh <- event.Kv.node(action):
+			case <-stopCh:
+				return nil
+			}
+		}
+	}
+}
+
+// Ignore the errors produced when the watch is stopped
+func (s *etcdV3Store) ignoreStopped(err error, stopCh chan bool) error {
+	select {
+	case <-stopCh:
+		return nil
+	default:
+		return err
+	}
+}
+
+// Call a JSON gateway endpoint, authenticating again if the auth token has expired
+func (s *etcdV3Store) call(endpoint string, req interface{}, resp interface{}) error {
+	body, _ := json.Marshal(req)
+	for retry := 0; ; retry++ {
+		httpResp, err := s.do(endpoint, body, nil)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(httpResp.Body)
+		httpResp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if httpResp.StatusCode != http.StatusOK {
+			etcdErr := &etcdV3Error{}
+			json.Unmarshal(data, etcdErr)
+			if etcdErr.Code == etcdV3Unauthenticated && s.username != "" && retry == 0 {
+				s.mu.Lock()
+				s.token = ""
+				s.mu.Unlock()
+				continue
+			}
+			if etcdErr.Message == "" {
+				etcdErr.Message = strings.TrimSpace(string(data))
+			}
+			return fmt.Errorf("got status code: %d (%s)", httpResp.StatusCode, etcdErr.Message)
+		}
+		if resp == nil {
+			return nil
+		}
+		return json.Unmarshal(data, resp)
+	}
+}
+
+// Send a request to the first machine available, authenticating first if needed
+func (s *etcdV3Store) do(endpoint string, body []byte, cancelCh chan struct{}) (*http.Response, error) {
+	token, err := s.authToken()
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, machine := range s.machines {
+		req, err := http.NewRequest("POST", strings.TrimSuffix(machine, "/")+etcdV3ApiPrefix+endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		req.Cancel = cancelCh
+		resp, err := s.client.Do(req)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Get the auth token, authenticating if there isn't a valid one
+func (s *etcdV3Store) authToken() (string, error) {
+	if s.username == "" {
+		return "", nil
+	}
+	s.mu.Lock()
+	token := s.token
+	s.mu.Unlock()
+	if token != "" {
+		return token, nil
+	}
+	body, _ := json.Marshal(map[string]string{"name": s.username, "password": s.password})
+	var lastErr error
+	for _, machine := range s.machines {
+		resp, err := s.client.Post(strings.TrimSuffix(machine, "/")+etcdV3ApiPrefix+"/auth/authenticate", "application/json", bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var auth struct {
+			Token string `json:"token"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&auth)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || auth.Token == "" {
+			return "", fmt.Errorf("error authenticating in etcd as %s: got status code: %d", s.username, resp.StatusCode)
+		}
+		s.mu.Lock()
+		s.token = auth.Token
+		s.mu.Unlock()
+		return auth.Token, nil
+	}
+	return "", lastErr
+}
+
+// Build a store node from a key/value
+func (kv *etcdV3KeyValue) node(action string) *storeNode {
+	key, _ := base64.StdEncoding.DecodeString(kv.Key)
+	value, _ := base64.StdEncoding.DecodeString(kv.Value)
+	return &storeNode{
+		action: action,
+		index:  uint64(kv.ModRevision),
+		key:    string(key),
+		value:  string(value),
+	}
+}
+
+// Encode keys and values as expected by the JSON gateway
+func encodeEtcdV3(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// Get the end of the range of keys starting with a prefix
+func prefixRangeEnd(prefix string) string {
+	end := []byte(prefix)
+	end[len(end)-1]++
+	return string(end)
+}
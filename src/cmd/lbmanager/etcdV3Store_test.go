@@ -0,0 +1,200 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEtcdV3StoreList(t *testing.T) {
+	f := newFakeEtcdV3(t)
+	f.change(
+		"put /lbManager/nginx/web/multiple/10.0.0.2:80 ",
+		"put /lbManager/nginx/web/multiple/10.0.0.1:80 ",
+		"put /lbManager/_options {}",
+		"put /lbManager root",
+		"put /lbManagerOther/nginx/web/multiple/10.0.0.3:80 ",
+	)
+	store := f.store(t, "")
+
+	tests := []struct {
+		name string
+		path string
+		want []string
+		err  error
+	}{
+		{
+			name: "prefix",
+			path: "/lbManager",
+			want: []string{"/lbManager/_options", "/lbManager/nginx/web/multiple/10.0.0.1:80", "/lbManager/nginx/web/multiple/10.0.0.2:80"},
+		},
+		{
+			name: "trailing slash",
+			path: "/lbManager/nginx/",
+			want: []string{"/lbManager/nginx/web/multiple/10.0.0.1:80", "/lbManager/nginx/web/multiple/10.0.0.2:80"},
+		},
+		{
+			name: "missing",
+			path: "/lbManager/haproxy",
+			err:  errKeyNotFound,
+		},
+	}
+	for _, test := range tests {
+		nodes, err := store.List(test.path)
+		if err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		got := []string{}
+		for _, node := range nodes {
+			got = append(got, node.key)
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("%s: got keys %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEtcdV3StoreWatchResumes(t *testing.T) {
+	f := newFakeEtcdV3(t)
+	f.change("put /lbManager/nginx/web/multiple/10.0.0.1:80 ")
+	store := f.store(t, "")
+	if _, err := store.Snapshot("/lbManager"); err != nil {
+		t.Fatal(err)
+	}
+	// Neither the changes made before the watch starts nor other reads are missed
+	f.change("put /lbManager/nginx/web/multiple/10.0.0.2:80 ")
+	store.List("/lbManager")
+
+	nodesCh, stopCh := make(chan *storeNode), make(chan bool)
+	go store.Watch("/lbManager", nodesCh, stopCh)
+	expectNode(t, nodesCh, "set /lbManager/nginx/web/multiple/10.0.0.2:80")
+	close(stopCh)
+	for _ = range nodesCh {
+	}
+
+	f.change("delete /lbManager/nginx/web/multiple/10.0.0.1:80")
+	nodesCh, stopCh = make(chan *storeNode), make(chan bool)
+	go store.Watch("/lbManager", nodesCh, stopCh)
+	expectNode(t, nodesCh, "delete /lbManager/nginx/web/multiple/10.0.0.1:80")
+	close(stopCh)
+	for _ = range nodesCh {
+	}
+	if got := f.watchRevisions(); len(got) != 2 || got[0] != 3 || got[1] != 4 {
+		t.Errorf("got watches from revisions %v, want [3 4]", got)
+	}
+}
+
+func TestEtcdV3StoreWatchErrors(t *testing.T) {
+	f := newFakeEtcdV3(t)
+	f.password = "secret"
+	f.change("put /lbManager/nginx/web/multiple/10.0.0.1:80 ")
+	store := f.store(t, "lbmanager")
+	if _, err := store.Snapshot("/lbManager"); err != nil {
+		t.Fatal(err)
+	}
+
+	// An expired token is dropped, authenticating again in the next watch or call
+	f.expireToken()
+	if err := store.Watch("/lbManager", make(chan *storeNode), make(chan bool)); err == nil || err == errWatchIndexLost {
+		t.Errorf("got error %v watching with an expired token, want an authentication error", err)
+	}
+	f.expireToken()
+	if _, err := store.List("/lbManager"); err != nil {
+		t.Errorf("got error %v listing with an expired token, want it authenticated again", err)
+	}
+
+	// Changes compacted while not watching can't be resumed, the next watch starts from now on
+	f.changeAndCompact("put /lbManager/nginx/web/multiple/10.0.0.2:80 ")
+	if err := store.Watch("/lbManager", make(chan *storeNode), make(chan bool)); err != errWatchIndexLost {
+		t.Errorf("got error %v watching compacted changes, want %v", err, errWatchIndexLost)
+	}
+	nodesCh, stopCh := make(chan *storeNode), make(chan bool)
+	go store.Watch("/lbManager", nodesCh, stopCh)
+	for deadline := time.Now().Add(3 * time.Second); len(f.watchRevisions()) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+	f.change("put /lbManager/nginx/web/multiple/10.0.0.3:80 ")
+	expectNode(t, nodesCh, "set /lbManager/nginx/web/multiple/10.0.0.3:80")
+	close(stopCh)
+	for _ = range nodesCh {
+	}
+	if got := f.watchRevisions(); len(got) != 2 || got[0] != 3 || got[1] != 0 {
+		t.Errorf("got watches from revisions %v, want [3 0]", got)
+	}
+}
+
+func TestEtcdV3StoreLeases(t *testing.T) {
+	f := newFakeEtcdV3(t)
+	store := f.store(t, "")
+	if err := store.Set("/lbManager/_leader", "host1", 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("/lbManager/nginx/web/multiple/10.0.0.1:80", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	lease := f.kvs["/lbManager/_leader"].Lease
+	ttl := f.leases[lease]
+	f.mu.Unlock()
+	if ttl != 10 {
+		t.Fatalf("got key attached to lease %q, want a lease with ttl 10", lease)
+	}
+
+	tests := []struct {
+		name       string
+		key        string
+		expire     bool
+		keepAlives int
+		err        error
+	}{
+		{name: "lease alive", key: "/lbManager/_leader", keepAlives: 1},
+		{name: "without lease", key: "/lbManager/nginx/web/multiple/10.0.0.1:80", keepAlives: 1},
+		{name: "lease expired", key: "/lbManager/_leader", expire: true, keepAlives: 1, err: errKeyNotFound},
+		{name: "missing", key: "/lbManager/missing", keepAlives: 1, err: errKeyNotFound},
+	}
+	for _, test := range tests {
+		if test.expire {
+			f.expireLease(lease)
+		}
+		if err := store.Refresh(test.key, 10); err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+		f.mu.Lock()
+		keepAlives := f.keepAlives
+		f.mu.Unlock()
+		if keepAlives != test.keepAlives {
+			t.Errorf("%s: got %d keep alives, want %d", test.name, keepAlives, test.keepAlives)
+		}
+	}
+}
+
+func TestManagerReadsConfigAgainWhenChangesAreLost(t *testing.T) {
+	f := newFakeEtcdV3(t)
+	f.change(
+		"put /lbManager/_holds/dns_www.example.com ",
+		"put /lbManager/dns/www.example.com/_options {}",
+		"put /lbManager/dns/www.example.com/multiple/10.0.0.1 ",
+		"put /lbManager/dns/www.example.com/multiple/10.0.0.2 ",
+	)
+	manager := &Manager{configPath: "/lbManager", dryRun: true, store: f.store(t, "")}
+	go manager.Start()
+	defer manager.Stop(time.Second)
+	waitForMembers(t, manager, "10.0.0.1 10.0.0.2")
+
+	f.changeAndCompact(
+		"delete /lbManager/_holds/dns_www.example.com",
+		"delete /lbManager/dns/www.example.com/_options",
+		"delete /lbManager/dns/www.example.com/multiple/10.0.0.1",
+		"put /lbManager/dns/www.example.com/multiple/10.0.0.3 ",
+	)
+	waitForMembers(t, manager, "10.0.0.2 10.0.0.3")
+	manager.mu.RLock()
+	held := manager.holds["dns_www.example.com"]
+	manager.mu.RUnlock()
+	if held {
+		t.Errorf("got load balancer held, want the deleted hold released")
+	}
+	if options := manager.optionsFor("/lbManager/dns/www.example.com"); options != nil {
+		t.Errorf("got options %+v, want the deleted ones removed", options)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Plugins settings shared by all the exec load balancers
+type execOptions struct {
+	dir     string
+	timeout time.Duration
+}
+
+var execSettings = &execOptions{timeout: 30 * time.Second}
+
+// Backend of the load balancers run by plugins, not registered as its type is the name of the plugin
+var execBackend *lbBackend
+
+func init() {
+	execBackend = &lbBackend{
+		fields:        []string{"name", "class", "member"},
+		usage:         []string{"NAME", "LB_CLASS", "MEMBER"},
+		idFields:      []string{"name"},
+		optionsScopes: [][]string{{"name"}},
+		validate:      validateNamedKey,
+		build: func(m *Manager, configEntry *configEntry) LoadBalancer {
+			return &Exec{LB: m.newLB(configEntry), Plugin: pluginPath(configEntry.lbType)}
+		},
+	}
+}
+
+// Load balancer managed by a plugin, an executable run as "PLUGIN describe" to get the actual members and
+// as "PLUGIN apply" to add and remove members, with the request as JSON in stdin and the response as JSON
+// in stdout. The plugin of a load balancer is the one named as the type segment of its member keys.
+type Exec struct {
+	LB
+	Plugin string
+	syncCh chan int
+}
+
+// Body of the requests sent to the plugins
+type execRequest struct {
+	Action   string   `json:"action"`
+	Id       string   `json:"id"`
+	Name     string   `json:"name"`
+	Class    string   `json:"class"`
+	Members  []string `json:"members"`
+	ToAdd    []string `json:"toAdd"`
+	ToRemove []string `json:"toRemove"`
+}
+
+// Body of the plugins responses. Plugins may also report errors exiting with a non zero status, in which
+// case their stderr is used as error message.
+type execResponse struct {
+	Error   string   `json:"error"`
+	Members []string `json:"members"`
+}
+
+// Setup plugin based load balancer
+func (lb *Exec) Setup(meta map[string]string) {
+	logger.Info("setting up load balancer state", lb.logFields("action", "setup", "name", meta["name"], "plugin", lb.Plugin)...)
+	lb.class = meta["class"]
+	lb.configKey = lb.ConfigPath + "/" + lb.Type + "/" + meta["name"] + "/"
+	lb.name = meta["name"]
+	lb.syncCh = make(chan int)
+	go func() {
+		lb.sync()
+	}()
+}
+
+// Sync state of the load balancer instance with the real service
+func (lb *Exec) Sync() {
+	if !lb.Tracker.begin() {
+		logger.Warn("shutting down, sync discarded", lb.logFields("action", "sync")...)
+		return
+	}
+	lb.syncCh <- 1
+}
+
+// Get the differences between the load balancer state and the members described by the plugin
+func (lb *Exec) Diff() (*LBDiff, error) {
+	actual, err := lb.describe()
+	if err != nil {
+		return nil, err
+	}
+	return lb.buildDiff(lb.Members(), actual), nil
+}
+
+// Get the actual members of the load balancer from the plugin
+func (lb *Exec) describe() ([]string, error) {
+	resp, err := lb.run(&execRequest{Action: "describe", Members: lb.Members()})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Members == nil {
+		resp.Members = []string{}
+	}
+	return resp.Members, nil
+}
+
+// Add and remove members through the plugin
+func (lb *Exec) apply(diff *LBDiff) error {
+	if lb.DryRun {
+		logger.Info("dry run, not applying changes", lb.logFields("action", "apply", "toAdd", diff.ToAdd, "toRemove", diff.ToRemove)...)
+		return nil
+	}
+	logger.Info("applying changes through plugin", lb.logFields("action", "apply", "toAdd", diff.ToAdd, "toRemove", diff.ToRemove)...)
+	_, err := lb.run(&execRequest{Action: "apply", Members: diff.Desired, ToAdd: diff.ToAdd, ToRemove: diff.ToRemove})
+	return err
+}
+
+// Run the plugin with the request provided, killing it if it doesn't finish before the timeout
+func (lb *Exec) run(req *execRequest) (*execResponse, error) {
+	req.Id, req.Name, req.Class = lb.Id, lb.name, lb.Status().Class
+	for _, members := range []*[]string{&req.Members, &req.ToAdd, &req.ToRemove} {
+		if *members == nil {
+			*members = []string{}
+		}
+	}
+	body, _ := json.Marshal(req)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.Command(lb.Plugin, req.Action)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(body), stdout, stderr
+	// Run the plugin in its own process group, so that the processes it starts are killed with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error running plugin %s: %s", lb.Plugin, err)
+	}
+	timer := time.AfterFunc(execSettings.timeout, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err := cmd.Wait()
+	if !timer.Stop() {
+		return nil, fmt.Errorf("plugin %s %s timed out after %s", lb.Plugin, req.Action, execSettings.timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s %s failed: %s (%s)", lb.Plugin, req.Action, err, strings.TrimSpace(stderr.String()))
+	}
+	resp := &execResponse{}
+	if output := bytes.TrimSpace(stdout.Bytes()); len(output) > 0 {
+		if err := json.Unmarshal(output, resp); err != nil {
+			return nil, fmt.Errorf("invalid response from plugin %s %s: %s", lb.Plugin, req.Action, err)
+		}
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("plugin %s %s failed: %s", lb.Plugin, req.Action, resp.Error)
+	}
+	return resp, nil
+}
+
+// Sync state of the load balancer instance with the real service
+func (lb *Exec) sync() {
+	for _ = range lb.syncCh {
+		if lb.Tracker.cancelled() {
+			lb.recordSync(time.Now(), errSyncCancelled)
+			lb.Tracker.end()
+			continue
+		}
+		startedAt := time.Now()
+		members := lb.Members()
+		sort.Strings(members)
+		logger.Debug("syncing", lb.logFields("action", "sync", "members", members)...)
+		actual, err := lb.describe()
+		if err != nil {
+			logger.Error("error describing load balancer", lb.logFields("action", "sync", "error", err.Error())...)
+			lb.recordSync(startedAt, err)
+			lb.Tracker.end()
+			continue
+		}
+		diff := lb.buildDiff(members, actual)
+		if len(diff.ToAdd) > 0 || len(diff.ToRemove) > 0 {
+			if err = lb.apply(diff); err != nil {
+				logger.Error("error applying changes", lb.logFields("action", "sync", "error", err.Error())...)
+			} else if !lb.DryRun {
+				actual = members
+			}
+		}
+		lb.recordActualMembers(len(actual))
+		lb.recordSync(startedAt, err)
+		lb.Tracker.end()
+	}
+}
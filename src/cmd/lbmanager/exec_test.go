@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecSync(t *testing.T) {
+	previous := execSettings
+	execSettings = &execOptions{timeout: 500 * time.Millisecond}
+	defer func() { execSettings = previous }()
+
+	tests := []struct {
+		name     string
+		describe string
+		apply    string
+		calls    []string
+		err      string
+	}{
+		{
+			name:     "members matching",
+			describe: `echo '{"members": ["b", "a"]}'`,
+			calls:    []string{"describe"},
+		},
+		{
+			name:     "members changed",
+			describe: `echo '{"members": ["a", "c"]}'`,
+			calls:    []string{"describe", "apply toAdd=[b] toRemove=[c]"},
+		},
+		{
+			name:     "describe failing",
+			describe: `echo 'no such load balancer' >&2; exit 3`,
+			calls:    []string{"describe"},
+			err:      "plugin PLUGIN describe failed: exit status 3 (no such load balancer)",
+		},
+		{
+			name:     "apply error response",
+			describe: `echo '{"members": []}'`,
+			apply:    `echo '{"error": "quota exceeded"}'`,
+			calls:    []string{"describe", "apply toAdd=[a b] toRemove=[]"},
+			err:      "plugin PLUGIN apply failed: quota exceeded",
+		},
+		{
+			name:     "timeout",
+			describe: `sleep 10; echo '{"members": []}'`,
+			calls:    []string{"describe"},
+			err:      "plugin PLUGIN describe timed out after 500ms",
+		},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		plugin := filepath.Join(dir, "plugin")
+		script := "#!/bin/sh\nrequest=$(cat)\necho \"$request\" >> " + filepath.Join(dir, "calls") + "\ncase \"$1\" in\ndescribe) " + test.describe + " ;;\napply) " + test.apply + " ;;\nesac\n"
+		if err := ioutil.WriteFile(plugin, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		lb := &Exec{LB: LB{Id: "plugin_web", Tracker: newSyncTracker(), Type: "plugin"}, Plugin: plugin}
+		lb.Setup(map[string]string{"class": "multiple", "name": "web"})
+		lb.AddMember("a")
+		lb.AddMember("b")
+		startedAt := time.Now()
+		status := syncAndWait(t, lb, lb.Tracker)
+
+		if want := strings.Replace(test.err, "PLUGIN", plugin, 1); status.LastError != want {
+			t.Errorf("%s: got error %q, want %q", test.name, status.LastError, want)
+		}
+		if elapsed := time.Since(startedAt); elapsed > 5*time.Second {
+			t.Errorf("%s: got sync taking %s, want the plugin processes killed on timeout", test.name, elapsed)
+		}
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+		calls := []string{}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			req := &execRequest{}
+			if err := json.Unmarshal([]byte(line), req); err != nil || req.Id != "plugin_web" || req.Name != "web" || req.Class != "multiple" {
+				t.Errorf("%s: got request %s, want the load balancer identified", test.name, line)
+			}
+			call := req.Action
+			if req.Action == "apply" {
+				call += " toAdd=[" + strings.Join(req.ToAdd, " ") + "] toRemove=[" + strings.Join(req.ToRemove, " ") + "]"
+			}
+			calls = append(calls, call)
+		}
+		if strings.Join(calls, ", ") != strings.Join(test.calls, ", ") {
+			t.Errorf("%s: got calls %v, want %v", test.name, calls, test.calls)
+		}
+	}
+}
@@ -0,0 +1,949 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// Start a local HTTP server for a fake, stopped when the test ends
+func startFakeServer(t *testing.T, handler http.Handler) *httptest.Server {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Local stand-in of the instance metadata role credentials, handing out new keys on every retrieval,
+// expiring after the time set
+type fakeMetadata struct {
+	expiresIn time.Duration
+	mu        sync.Mutex
+	retrieved int
+	url       string
+}
+
+// Start a fake of the instance metadata, stopped when the test ends
+func newFakeMetadata(t *testing.T, expiresIn time.Duration) *fakeMetadata {
+	f := &fakeMetadata{expiresIn: expiresIn}
+	f.url = startFakeServer(t, f).URL + "/latest"
+	return f
+}
+
+func (f *fakeMetadata) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/latest/meta-data/iam/security-credentials":
+		fmt.Fprint(w, "lbmanager")
+	case "/latest/meta-data/iam/security-credentials/lbmanager":
+		f.retrieved++
+		fmt.Fprintf(w, `{"Code": "Success", "AccessKeyId": "AKID%d", "SecretAccessKey": "secret", "Token": "token", "Expiration": %q}`,
+			f.retrieved, time.Now().Add(f.expiresIn).UTC().Format(time.RFC3339))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Region unknown to goamz, only usable through the endpoints of the fake AWS services
+const fakeAwsRegion = "local-1"
+
+// EC2 instance served by the fake AWS services
+type fakeInstance struct {
+	id         string
+	state      string
+	privateIp  string
+	privateDns string
+	publicIp   string
+}
+
+// In memory fake of the EC2 DescribeInstances, ELB and Route53 record sets APIs used, recording the
+// requests received
+type fakeAws struct {
+	elbs      map[string][]string
+	instances []fakeInstance
+	mu        sync.Mutex
+	records   map[string][]string
+	requests  []string
+}
+
+// Start a fake of the AWS services, overriding their endpoints in fakeAwsRegion until the test ends
+func newFakeAws(t *testing.T) *fakeAws {
+	f := &fakeAws{elbs: make(map[string][]string), records: make(map[string][]string)}
+	server := startFakeServer(t, f)
+	previous := awsEndpoints
+	awsEndpoints = endpoints{
+		"ec2/" + fakeAwsRegion:     server.URL + "/ec2/",
+		"elb/" + fakeAwsRegion:     server.URL + "/elb/",
+		"route53/" + fakeAwsRegion: server.URL,
+	}
+	t.Cleanup(func() { awsEndpoints = previous })
+	return f
+}
+
+// Get static credentials accepted by the fake AWS services
+func fakeAwsCredentials() *credentials.Credentials {
+	return credentials.NewStaticCredentials("AKIDFAKE", "secret", "")
+}
+
+// Set the instances served
+func (f *fakeAws) setInstances(instances ...fakeInstance) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.instances = instances
+}
+
+// Get the requests received, as "SERVICE ACTION" or "route53 METHOD PATH", clearing them
+func (f *fakeAws) takeRequests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	requests := f.requests
+	f.requests = nil
+	return requests
+}
+
+func (f *fakeAws) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := r.URL.Query()
+	if query.Get("Signature") == "" && r.Header.Get("X-Amzn-Authorization") == "" {
+		http.Error(w, "<Response><Errors><Error><Code>MissingAuthenticationToken</Code></Error></Errors></Response>", http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.URL.Path == "/ec2/":
+		f.requests = append(f.requests, "ec2 "+query.Get("Action"))
+		f.describeInstances(w, query)
+	case r.URL.Path == "/elb/":
+		f.requests = append(f.requests, "elb "+query.Get("Action"))
+		f.elb(w, query)
+	case strings.HasPrefix(r.URL.Path, "/2013-04-01/hostedzone/"):
+		f.requests = append(f.requests, "route53 "+r.Method+" "+r.URL.Path)
+		f.route53(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Answer a DescribeInstances call, applying its filters
+func (f *fakeAws) describeInstances(w http.ResponseWriter, query map[string][]string) {
+	filters := map[string][]string{}
+	for i := 1; query[fmt.Sprintf("Filter.%d.Name", i)] != nil; i++ {
+		name := query[fmt.Sprintf("Filter.%d.Name", i)][0]
+		for j := 1; query[fmt.Sprintf("Filter.%d.Value.%d", i, j)] != nil; j++ {
+			filters[name] = append(filters[name], query[fmt.Sprintf("Filter.%d.Value.%d", i, j)][0])
+		}
+	}
+	fmt.Fprint(w, "<DescribeInstancesResponse><reservationSet>")
+	for _, instance := range f.instances {
+		fields := map[string]string{"instance-id": instance.id, "instance-state-name": instance.state, "ip-address": instance.publicIp,
+			"private-ip-address": instance.privateIp, "private-dns-name": instance.privateDns}
+		matches := true
+		for name, values := range filters {
+			matches = matches && containsMember(values, fields[name])
+		}
+		if matches {
+			fmt.Fprintf(w, "<item><instancesSet><item><instanceId>%s</instanceId><instanceState><name>%s</name></instanceState>"+
+				"<privateIpAddress>%s</privateIpAddress><privateDnsName>%s</privateDnsName><ipAddress>%s</ipAddress></item></instancesSet></item>",
+				instance.id, instance.state, instance.privateIp, instance.privateDns, instance.publicIp)
+		}
+	}
+	fmt.Fprint(w, "</reservationSet></DescribeInstancesResponse>")
+}
+
+// Answer the ELB calls, registering and deregistering the instances
+func (f *fakeAws) elb(w http.ResponseWriter, query map[string][]string) {
+	action := query["Action"][0]
+	if action == "DescribeLoadBalancers" {
+		name := query["LoadBalancerNames.member.1"][0]
+		fmt.Fprintf(w, "<DescribeLoadBalancersResponse><DescribeLoadBalancersResult><LoadBalancerDescriptions><member><LoadBalancerName>%s</LoadBalancerName><Instances>", name)
+		for _, instanceId := range f.elbs[name] {
+			fmt.Fprintf(w, "<member><InstanceId>%s</InstanceId></member>", instanceId)
+		}
+		fmt.Fprint(w, "</Instances></member></LoadBalancerDescriptions></DescribeLoadBalancersResult></DescribeLoadBalancersResponse>")
+		return
+	}
+	name := query["LoadBalancerName"][0]
+	for i := 1; query[fmt.Sprintf("Instances.member.%d.InstanceId", i)] != nil; i++ {
+		instanceId := query[fmt.Sprintf("Instances.member.%d.InstanceId", i)][0]
+		instances := []string{}
+		for _, registered := range f.elbs[name] {
+			if registered != instanceId {
+				instances = append(instances, registered)
+			}
+		}
+		if action == "RegisterInstancesWithLoadBalancer" {
+			instances = append(instances, instanceId)
+		}
+		f.elbs[name] = instances
+	}
+	fmt.Fprintf(w, "<%sResponse></%sResponse>", action, action)
+}
+
+// Answer the Route53 record sets calls, listing the A record sets or applying their changes
+func (f *fakeAws) route53(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		var request struct {
+			Changes []struct {
+				Name    string   `xml:"ResourceRecordSet>Name"`
+				Records []string `xml:"ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+			} `xml:"ChangeBatch>Changes>Change"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, change := range request.Changes {
+			f.records[strings.TrimSuffix(change.Name, ".")] = change.Records
+		}
+		fmt.Fprint(w, "<ChangeResourceRecordSetsResponse><ChangeInfo><Id>/change/C1</Id><Status>PENDING</Status></ChangeInfo></ChangeResourceRecordSetsResponse>")
+		return
+	}
+	names := []string{}
+	for name := range f.records {
+		if name >= r.URL.Query().Get("name") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	fmt.Fprint(w, "<ListResourceRecordSetsResponse><ResourceRecordSets>")
+	if len(names) > 0 {
+		fmt.Fprintf(w, "<ResourceRecordSet><Name>%s.</Name><Type>A</Type><TTL>60</TTL><ResourceRecords>", names[0])
+		for _, record := range f.records[names[0]] {
+			fmt.Fprintf(w, "<ResourceRecord><Value>%s</Value></ResourceRecord>", record)
+		}
+		fmt.Fprint(w, "</ResourceRecords></ResourceRecordSet>")
+	}
+	fmt.Fprint(w, "</ResourceRecordSets></ListResourceRecordSetsResponse>")
+}
+
+// Fake of the etcd v2 keys API, holding a directory of members and sending the changes provided to
+// the watches, one per index following the one of the directory
+type fakeEtcd struct {
+	changes []string
+	index   int
+	members []string
+	t       *testing.T
+	url     string
+}
+
+// Start a fake etcd, stopped when the test ends
+func newFakeEtcd(t *testing.T, index int, members []string, changes []string) *fakeEtcd {
+	f := &fakeEtcd{changes: changes, index: index, members: members, t: t}
+	f.url = startFakeServer(t, f).URL
+	return f
+}
+
+// Create a store connected to the fake etcd
+func (f *fakeEtcd) store(t *testing.T) *etcdStore {
+	store, err := newEtcdStore(&storeOptions{machines: []string{f.url}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/v2/keys/lbManager") {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("wait") != "true" {
+		nodes := []string{}
+		for i, member := range f.members {
+			nodes = append(nodes, fmt.Sprintf(`{"key": %q, "value": "", "modifiedIndex": %d}`, member, i+1))
+		}
+		w.Header().Set("X-Etcd-Index", fmt.Sprint(f.index))
+		fmt.Fprintf(w, `{"action": "get", "node": {"key": "/lbManager", "dir": true, "nodes": [%s]}}`, strings.Join(nodes, ","))
+		return
+	}
+	var waitIndex int
+	fmt.Sscan(r.URL.Query().Get("waitIndex"), &waitIndex)
+	if change := waitIndex - f.index - 1; change >= 0 && change < len(f.changes) {
+		fields := strings.Fields(f.changes[change])
+		w.Header().Set("X-Etcd-Index", fmt.Sprint(waitIndex))
+		fmt.Fprintf(w, `{"action": %q, "node": {"key": %q, "modifiedIndex": %d}}`, fields[0], fields[1], waitIndex)
+		return
+	}
+	if waitIndex <= f.index {
+		f.t.Errorf("got watch from index %d, want it to follow the index read %d", waitIndex, f.index)
+	}
+	select {
+	case <-r.Context().Done():
+	case <-time.After(5 * time.Second):
+	}
+}
+
+// Key/value change applied by the fake etcd v3 gateway
+type fakeEtcdV3Event struct {
+	deleted bool
+	key     string
+	kv      etcdV3KeyValue
+}
+
+// In memory fake of the etcd v3 JSON gateway endpoints used. Watches get the changes following their
+// start revision, or are canceled when it has been compacted. When a password is set, requests need the
+// token of the latest authentication.
+type fakeEtcdV3 struct {
+	changedCh   chan bool
+	compacted   int64
+	events      []fakeEtcdV3Event
+	granted     int
+	keepAlives  int
+	kvs         map[string]etcdV3KeyValue
+	leases      map[string]int64
+	mu          sync.Mutex
+	password    string
+	revision    int64
+	token       string
+	tokens      int
+	url         string
+	watchesFrom []int64
+}
+
+// Start a fake etcd v3 gateway, stopped when the test ends
+func newFakeEtcdV3(t *testing.T) *fakeEtcdV3 {
+	f := &fakeEtcdV3{changedCh: make(chan bool), kvs: make(map[string]etcdV3KeyValue), leases: make(map[string]int64), revision: 1}
+	f.url = startFakeServer(t, f).URL
+	return f
+}
+
+// Create a store connected to the fake gateway
+func (f *fakeEtcdV3) store(t *testing.T, username string) *etcdV3Store {
+	store, err := newEtcdV3Store(&storeOptions{machines: []string{f.url}, username: username, password: f.password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// Apply changes ("put KEY VALUE" or "delete KEY"), notifying the watches once all of them are applied
+func (f *fakeEtcdV3) change(changes ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.apply(changes)
+	f.notify()
+}
+
+// Apply changes as change does, compacting the revisions up to the latest one
+func (f *fakeEtcdV3) changeAndCompact(changes ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.apply(changes)
+	f.compacted = f.revision
+	f.notify()
+}
+
+func (f *fakeEtcdV3) apply(changes []string) {
+	for _, change := range changes {
+		fields := strings.SplitN(change, " ", 3)
+		if fields[0] == "put" {
+			f.put(fields[1], fields[2], "")
+		} else {
+			f.deleteRange(fields[1], "")
+		}
+	}
+}
+
+// Expire a lease, deleting the keys attached to it
+func (f *fakeEtcdV3) expireLease(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.leases, id)
+	for key, kv := range f.kvs {
+		if kv.Lease == id {
+			f.deleteRange(key, "")
+		}
+	}
+	f.notify()
+}
+
+// Make the current auth token invalid, as when it expires
+func (f *fakeEtcdV3) expireToken() {
+	f.mu.Lock()
+	f.token = ""
+	f.mu.Unlock()
+}
+
+// Get the revisions the watches received were started from
+func (f *fakeEtcdV3) watchRevisions() []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int64{}, f.watchesFrom...)
+}
+
+func (f *fakeEtcdV3) put(key string, value string, lease string) {
+	f.revision++
+	kv := etcdV3KeyValue{Key: encodeEtcdV3(key), Lease: lease, ModRevision: f.revision, Value: encodeEtcdV3(value)}
+	f.kvs[key] = kv
+	f.events = append(f.events, fakeEtcdV3Event{key: key, kv: kv})
+}
+
+func (f *fakeEtcdV3) deleteRange(key string, rangeEnd string) {
+	for _, k := range f.keys(key, rangeEnd) {
+		f.revision++
+		kv := f.kvs[k]
+		kv.ModRevision = f.revision
+		delete(f.kvs, k)
+		f.events = append(f.events, fakeEtcdV3Event{deleted: true, key: k, kv: kv})
+	}
+}
+
+// Get the keys in a range, sorted, or the key provided when there's no range end
+func (f *fakeEtcdV3) keys(key string, rangeEnd string) []string {
+	keys := []string{}
+	for k := range f.kvs {
+		if inEtcdV3Range(k, key, rangeEnd) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeEtcdV3) notify() {
+	close(f.changedCh)
+	f.changedCh = make(chan bool)
+}
+
+func (f *fakeEtcdV3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CreateRequest struct {
+			Key           string `json:"key"`
+			RangeEnd      string `json:"range_end"`
+			StartRevision int64  `json:"start_revision"`
+		} `json:"create_request"`
+		ID       string `json:"ID"`
+		Key      string `json:"key"`
+		Lease    string `json:"lease"`
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		RangeEnd string `json:"range_end"`
+		TTL      int64  `json:"TTL"`
+		Value    string `json:"value"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	decode := func(s string) string {
+		data, _ := base64.StdEncoding.DecodeString(s)
+		return string(data)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	endpoint := strings.TrimPrefix(r.URL.Path, etcdV3ApiPrefix)
+	if endpoint == "/auth/authenticate" {
+		if req.Password != f.password {
+			http.Error(w, `{"code": 3, "message": "authentication failed"}`, http.StatusBadRequest)
+			return
+		}
+		f.tokens++
+		f.token = fmt.Sprintf("token%d", f.tokens)
+		fmt.Fprintf(w, `{"token": %q}`, f.token)
+		return
+	}
+	if f.password != "" && (f.token == "" || r.Header.Get("Authorization") != f.token) {
+		http.Error(w, `{"code": 16, "message": "invalid auth token"}`, http.StatusUnauthorized)
+		return
+	}
+	header := fmt.Sprintf(`{"revision": "%d"}`, f.revision)
+	switch endpoint {
+	case "/kv/range":
+		kvs := []etcdV3KeyValue{}
+		for _, key := range f.keys(decode(req.Key), decode(req.RangeEnd)) {
+			kvs = append(kvs, f.kvs[key])
+		}
+		data, _ := json.Marshal(kvs)
+		fmt.Fprintf(w, `{"header": %s, "kvs": %s}`, header, data)
+	case "/kv/put":
+		if _, exists := f.leases[req.Lease]; req.Lease != "" && !exists {
+			http.Error(w, `{"code": 5, "message": "requested lease not found"}`, http.StatusNotFound)
+			return
+		}
+		f.put(decode(req.Key), decode(req.Value), req.Lease)
+		f.notify()
+		fmt.Fprintf(w, `{"header": %s}`, header)
+	case "/kv/deleterange":
+		f.deleteRange(decode(req.Key), decode(req.RangeEnd))
+		f.notify()
+		fmt.Fprintf(w, `{"header": %s}`, header)
+	case "/lease/grant":
+		f.granted++
+		id := fmt.Sprint(7586 + f.granted)
+		f.leases[id] = req.TTL
+		fmt.Fprintf(w, `{"header": %s, "ID": %q, "TTL": "%d"}`, header, id, req.TTL)
+	case "/lease/keepalive":
+		f.keepAlives++
+		if ttl, exists := f.leases[req.ID]; exists {
+			fmt.Fprintf(w, `{"result": {"header": %s, "ID": %q, "TTL": "%d"}}`, header, req.ID, ttl)
+		} else {
+			fmt.Fprintf(w, `{"result": {"header": %s, "ID": %q}}`, header, req.ID)
+		}
+	case "/watch":
+		f.watch(w, r, decode(req.CreateRequest.Key), decode(req.CreateRequest.RangeEnd), req.CreateRequest.StartRevision)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Stream the changes in a range from the start revision, or from the next one when it's 0, until the
+// request is canceled. Called with the lock held.
+func (f *fakeEtcdV3) watch(w http.ResponseWriter, r *http.Request, key string, rangeEnd string, next int64) {
+	f.watchesFrom = append(f.watchesFrom, next)
+	if next == 0 {
+		next = f.revision + 1
+	}
+	fmt.Fprintf(w, `{"result": {"header": {"revision": "%d"}, "created": true}}`+"\n", f.revision)
+	for {
+		if next <= f.compacted {
+			fmt.Fprintf(w, `{"result": {"header": {"revision": "%d"}, "compact_revision": "%d", "canceled": true}}`+"\n", f.revision, f.compacted)
+			return
+		}
+		for _, event := range f.events {
+			if event.kv.ModRevision < next || !inEtcdV3Range(event.key, key, rangeEnd) {
+				continue
+			}
+			next = event.kv.ModRevision + 1
+			eventType := "PUT"
+			if event.deleted {
+				eventType = "DELETE"
+			}
+			data, _ := json.Marshal(event.kv)
+			fmt.Fprintf(w, `{"result": {"header": {"revision": "%d"}, "events": [{"type": %q, "kv": %s}]}}`+"\n", f.revision, eventType, data)
+		}
+		w.(http.Flusher).Flush()
+		changedCh := f.changedCh
+		f.mu.Unlock()
+		select {
+		case <-changedCh:
+			f.mu.Lock()
+		case <-r.Context().Done():
+			f.mu.Lock()
+			return
+		}
+	}
+}
+
+// Check if a key is the one provided, or in the range starting with it when there's a range end
+func inEtcdV3Range(k string, key string, rangeEnd string) bool {
+	return k == key || (rangeEnd != "" && k >= key && k < rangeEnd)
+}
+
+// Key/value stored by the fake Consul agent, as returned by the KV API
+type fakeConsulKeyValue struct {
+	Key         string
+	ModifyIndex uint64
+	Session     string `json:",omitempty"`
+	Value       []byte
+}
+
+// In memory fake of the Consul KV and session HTTP API, supporting blocking queries. Acquires can be
+// rejected as if another client acquired the key first.
+type fakeConsul struct {
+	changedCh      chan struct{}
+	created        int
+	index          uint64
+	kvs            map[string]*fakeConsulKeyValue
+	mu             sync.Mutex
+	queries        []string
+	rejectAcquires bool
+	sessions       map[string]map[string]string
+	url            string
+}
+
+// Start a fake Consul agent, stopped when the test ends
+func newFakeConsul(t *testing.T) *fakeConsul {
+	f := &fakeConsul{
+		changedCh: make(chan struct{}),
+		index:     1,
+		kvs:       make(map[string]*fakeConsulKeyValue),
+		sessions:  make(map[string]map[string]string),
+	}
+	f.url = startFakeServer(t, f).URL
+	return f
+}
+
+// Create a store connected to the fake agent
+func (f *fakeConsul) store(t *testing.T) *consulStore {
+	store, err := newConsulStore(&storeOptions{machines: []string{f.url}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// Record a change, waking up the blocking queries
+func (f *fakeConsul) changed() {
+	f.index++
+	close(f.changedCh)
+	f.changedCh = make(chan struct{})
+}
+
+// Set a key as if it were set from another client
+func (f *fakeConsul) set(key string, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.changed()
+	f.kvs[key] = &fakeConsulKeyValue{Key: key, ModifyIndex: f.index, Value: []byte(value)}
+}
+
+// Delete a key as if it were deleted from another client
+func (f *fakeConsul) delete(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.changed()
+	delete(f.kvs, key)
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case r.URL.Path == "/v1/session/create":
+		session := map[string]string{}
+		json.Unmarshal(body, &session)
+		f.created++
+		id := fmt.Sprintf("session-%d", f.created)
+		f.sessions[id] = session
+		fmt.Fprintf(w, `{"ID": %q}`, id)
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		if f.sessions[strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")] == nil {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "[]")
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/")
+		delete(f.sessions, id)
+		for _, kv := range f.kvs {
+			if kv.Session == id {
+				kv.Session = ""
+			}
+		}
+		fmt.Fprint(w, "true")
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		switch r.Method {
+		case "GET":
+			f.queries = append(f.queries, r.URL.RawQuery)
+			if index, _ := strconv.ParseUint(query.Get("index"), 10, 64); index > 0 && index >= f.index {
+				changedCh := f.changedCh
+				f.mu.Unlock()
+				select {
+				case <-changedCh:
+				case <-time.After(2 * time.Second):
+				}
+				f.mu.Lock()
+			}
+			kvs := []*fakeConsulKeyValue{}
+			for k, kv := range f.kvs {
+				if k == key || (query["recurse"] != nil && strings.HasPrefix(k, key)) {
+					kvs = append(kvs, kv)
+				}
+			}
+			sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+			w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+			if len(kvs) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(kvs)
+		case "PUT":
+			kv := f.kvs[key]
+			if session := query.Get("acquire"); session != "" {
+				if f.rejectAcquires || f.sessions[session] == nil || (kv != nil && kv.Session != "" && kv.Session != session) {
+					fmt.Fprint(w, "false")
+					return
+				}
+				f.changed()
+				f.kvs[key] = &fakeConsulKeyValue{Key: key, ModifyIndex: f.index, Session: session, Value: body}
+			} else if session := query.Get("release"); session != "" {
+				if kv != nil && kv.Session == session {
+					kv.Session = ""
+				}
+			} else {
+				f.changed()
+				f.kvs[key] = &fakeConsulKeyValue{Key: key, ModifyIndex: f.index, Value: body}
+			}
+			fmt.Fprint(w, "true")
+		case "DELETE":
+			f.changed()
+			for k := range f.kvs {
+				if k == key || (query["recurse"] != nil && strings.HasPrefix(k, key)) {
+					delete(f.kvs, k)
+				}
+			}
+			fmt.Fprint(w, "true")
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Fake webhook returning the members provided to the GET requests and the status codes queued to the
+// POST ones, recording the requests received
+type fakeWebhook struct {
+	members  []string
+	mu       sync.Mutex
+	posts    []webhookRequest
+	requests []string
+	statuses []int
+	url      string
+}
+
+// Start a fake webhook, stopped when the test ends
+func newFakeWebhook(t *testing.T, members []string, statuses []int) *fakeWebhook {
+	f := &fakeWebhook{members: members, statuses: statuses}
+	f.url = startFakeServer(t, f).URL
+	return f
+}
+
+func (f *fakeWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	signed := r.Header.Get(webhookSignatureHeader) == "sha256="+hex.EncodeToString(mac.Sum(nil))
+	f.requests = append(f.requests, fmt.Sprintf("%s signed=%t", r.Method, signed))
+	if r.Method == "GET" {
+		if f.members == nil {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(&webhookState{Members: f.members})
+		return
+	}
+	request := webhookRequest{}
+	json.Unmarshal(body, &request)
+	f.posts = append(f.posts, request)
+	if len(f.statuses) > 0 {
+		status := f.statuses[0]
+		f.statuses = f.statuses[1:]
+		w.WriteHeader(status)
+	}
+}
+
+// In process DNS server answering queries and applying RFC 2136 updates over TCP, verifying the TSIG
+// signatures of the requests when it has a key
+type fakeDnsServer struct {
+	address  string
+	key      *tsigKey
+	listener net.Listener
+	mu       sync.Mutex
+	records  map[string][]dnsRR
+	// Sign the responses without the request MAC, as a broken server would
+	unchained bool
+	updates   [][]dnsRR
+}
+
+// Start a fake DNS server, stopped when the test ends
+func newFakeDnsServer(t *testing.T, key *tsigKey) *fakeDnsServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeDnsServer{address: listener.Addr().String(), key: key, listener: listener, records: make(map[string][]dnsRR)}
+	t.Cleanup(s.Close)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeDnsServer) Close() {
+	s.listener.Close()
+}
+
+// Add address records to a name
+func (s *fakeDnsServer) add(name string, addresses ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, address := range addresses {
+		s.records[name] = append(s.records[name], newDnsAddressRR(name, net.ParseIP(address), 300))
+	}
+}
+
+// Get the addresses of a name, sorted
+func (s *fakeDnsServer) addresses(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addresses := []string{}
+	for _, rr := range s.records[name] {
+		addresses = append(addresses, dnsRRAddress(rr))
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+func (s *fakeDnsServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+		resp := s.handle(data)
+		conn.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+	}
+}
+
+func (s *fakeDnsServer) handle(data []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req, err := unpackDnsMessage(data)
+	if err != nil {
+		return nil
+	}
+	resp := &dnsMessage{id: req.id, flags: req.flags | 0x8000, question: req.question}
+	var requestMac []byte
+	if req.tsigOffset > 0 {
+		rr := req.additional[len(req.additional)-1]
+		t, _ := parseTsigRecord(rr)
+		requestMac = t.mac
+		if s.key == nil || !sameDnsName(rr.name, s.key.name) {
+			return s.tsigErrorResponse(resp, rr, 17)
+		}
+		if err := s.key.verify(data, req, nil, time.Now()); err != nil {
+			return s.tsigErrorResponse(resp, rr, 16)
+		}
+	}
+	switch req.flags >> 11 & 0xf {
+	case dnsOpcodeQuery:
+		q := req.question[0]
+		rrs, exists := s.records[q.name]
+		if !exists {
+			resp.flags |= dnsRcodeNXDomain
+		}
+		for _, rr := range rrs {
+			if rr.rrType == q.qType {
+				resp.answer = append(resp.answer, rr)
+			}
+		}
+	case dnsOpcodeUpdate:
+		s.updates = append(s.updates, req.authority)
+		for _, update := range req.authority {
+			rrs := []dnsRR{}
+			for _, rr := range s.records[update.name] {
+				if update.class != dnsClassANY || rr.rrType != update.rrType {
+					rrs = append(rrs, rr)
+				}
+			}
+			if update.class == dnsClassIN {
+				rrs = append(rrs, update)
+			}
+			s.records[update.name] = rrs
+		}
+	}
+	packed := resp.pack()
+	if requestMac != nil {
+		if s.unchained {
+			requestMac = nil
+		}
+		packed, _ = s.key.sign(packed, requestMac, time.Now())
+	}
+	return packed
+}
+
+// Build a NOTAUTH response with an unsigned TSIG record holding the error provided
+func (s *fakeDnsServer) tsigErrorResponse(resp *dnsMessage, requestTsig dnsRR, tsigErr uint16) []byte {
+	t, _ := parseTsigRecord(requestTsig)
+	rdata := packDnsName(nil, t.algorithm)
+	rdata = append(rdata, requestTsig.data[len(rdata):len(rdata)+8]...)
+	rdata = append(rdata, 0, 0, byte(resp.id>>8), byte(resp.id), byte(tsigErr>>8), byte(tsigErr), 0, 0)
+	resp.flags |= 9
+	resp.additional = []dnsRR{{name: requestTsig.name, rrType: dnsTypeTSIG, class: dnsClassANY, data: rdata}}
+	return resp.pack()
+}
+
+// Create a dnsupdate load balancer for www.example.com, using the DNS server and key provided
+func newTestDnsUpdate(server string, key *tsigKey) *DnsUpdate {
+	return &DnsUpdate{
+		LB:       LB{class: "multiple", name: "www.example.com"},
+		Settings: &dnsUpdateOptions{server: server, timeout: time.Second, tsig: key, ttl: 30},
+		zone:     "example.com",
+	}
+}
+
+// Use an empty instance cache until the test ends
+func newTestInstanceCache(t *testing.T) *instanceCache {
+	previous := ec2InstanceCache
+	ec2InstanceCache = &instanceCache{entries: make(map[string]*instanceCacheEntry)}
+	t.Cleanup(func() { ec2InstanceCache = previous })
+	return ec2InstanceCache
+}
+
+// Expire the cached entries, or only the members not found
+func (c *instanceCache) expire(missesOnly bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, entry := range c.entries {
+		if !missesOnly || entry.instanceId == "" {
+			entry.expires = time.Now().Add(-time.Second)
+		}
+	}
+}
+
+// Wait for the next change sent by a store watch, failing when it is not the one expected
+func expectNode(t *testing.T, nodesCh chan *storeNode, want string) {
+	select {
+	case node := <-nodesCh:
+		if got := node.action + " " + node.key; got != want {
+			t.Fatalf("got change %q, want %q", got, want)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timeout waiting for change %q", want)
+	}
+}
+
+// Sync a load balancer, waiting for the sync to finish
+func syncAndWait(t *testing.T, lb LoadBalancer, tracker *syncTracker) LBStatus {
+	lb.Sync()
+	for deadline := time.Now().Add(3 * time.Second); tracker.pendingSyncs() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the sync")
+		}
+	}
+	return lb.Status()
+}
+
+// Wait until the manager has a single load balancer with the members provided
+func waitForMembers(t *testing.T, manager *Manager, want string) {
+	var got []string
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if statuses := manager.LoadBalancersStatus(); len(statuses) == 1 {
+			if got = statuses[0].Members; strings.Join(got, " ") == want {
+				return
+			}
+		}
+	}
+	t.Fatalf("got members %v, want %s", got, want)
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Time between checks of the configuration file modification time
+const filePollInterval = 2 * time.Second
+
+var errFileStoreReadOnly = errors.New("the file config store is read only, edit the configuration file instead")
+
+// Read only config store holding the configuration tree in a JSON or YAML file. The file contents are
+// the tree under the configuration path: objects are directories, strings are key values and lists of
+// strings are keys with empty values (the members of a load balancer). The file is reloaded on SIGHUP
+// or when it's modified, and the changes are computed by comparing it with the previous contents.
+type fileStore struct {
+	file    string
+	hupCh   chan os.Signal
+	index   uint64
+	keys    map[string]*storeNode
+	modTime time.Time
+	mu      sync.Mutex
+	root    string
+}
+
+// Create a file config store, the keys in the file are placed under the root path provided. SIGHUP is
+// handled from now on, so that it doesn't terminate the process if it's received before watching.
+func newFileStore(options *storeOptions) (*fileStore, error) {
+	if options.file == "" {
+		return nil, fmt.Errorf("configuration file missing (-config-file)")
+	}
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	return &fileStore{file: options.file, hupCh: hupCh, root: options.root}, nil
+}
+
+// Get all the keys under a path recursively, from the file contents last loaded
+func (s *fileStore) List(path string) ([]*storeNode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys == nil {
+		if _, err := s.reload(); err != nil {
+			return nil, err
+		}
+	}
+	nodes := []*storeNode{}
+	for key, node := range s.keys {
+		if key == path || strings.HasPrefix(key, strings.TrimSuffix(path, "/")+"/") {
+			n := *node
+			nodes = append(nodes, &n)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, errKeyNotFound
+	}
+	sort.Sort(storeNodesByKey(nodes))
+	return nodes, nil
+}
+
+func (s *fileStore) Set(key string, value string, ttl uint64) error {
+	return errFileStoreReadOnly
+}
+
+func (s *fileStore) Delete(key string, recursive bool) error {
+	return errFileStoreReadOnly
+}
+
+// Reload the file on SIGHUP or when it's modified, sending the keys set and deleted since the previous
+// contents. If the file can't be loaded the previous contents are kept.
+func (s *fileStore) Watch(path string, nodesCh chan *storeNode, stopCh chan bool) error {
+	defer close(nodesCh)
+	ticker := time.NewTicker(filePollInterval)
+	defer ticker.Stop()
+
+	s.mu.Lock()
+	if s.keys == nil {
+		// Get the current keys to compare the following changes with
+		if _, err := s.reload(); err != nil {
+			logger.Error("error loading configuration file", "action", "watchConfig", "file", s.file, "error", err.Error())
+		}
+	}
+	s.mu.Unlock()
+	for {
+		select {
+		case <-stopCh:
+			return nil
+		case <-s.hupCh:
+			logger.Info("SIGHUP received, reloading configuration file", "action", "watchConfig", "file", s.file)
+		case <-ticker.C:
+			info, err := os.Stat(s.file)
+			s.mu.Lock()
+			modified := err == nil && !info.ModTime().Equal(s.modTime)
+			s.mu.Unlock()
+			if !modified {
+				continue
+			}
+		}
+		s.mu.Lock()
+		changes, err := s.reload()
+		s.mu.Unlock()
+		if err != nil {
+			logger.Error("error reloading configuration file, keeping the previous configuration", "action", "watchConfig", "file", s.file, "error", err.Error())
+			continue
+		}
+		logger.Info("configuration file reloaded", "action", "watchConfig", "file", s.file, "changes", len(changes))
+		for _, node := range changes {
+			if node.key != path && !strings.HasPrefix(node.key, strings.TrimSuffix(path, "/")+"/") {
+				continue
+			}
+			select {
+			case nodesCh <- node:
+			case <-stopCh:
+				return nil
+			}
+		}
+	}
+}
+
+// Load the file, replacing the keys held and returning the changes since the previous contents. Keys
+// set get a new index, so that the last ones added can be found. Must be called holding the lock.
+func (s *fileStore) reload() ([]*storeNode, error) {
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	switch strings.ToLower(filepath.Ext(s.file)) {
+	case ".yaml", ".yml":
+		tree, err = parseYaml(string(data))
+	default:
+		err = json.Unmarshal(data, &tree)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", s.file, err)
+	}
+	values := make(map[string]string)
+	if tree != nil {
+		if err := flattenConfigTree(s.root, tree, values); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %s", s.file, err)
+		}
+	}
+
+	// Indexes are assigned in key order, so that the latest member of a single class load balancer
+	// doesn't depend on the map iteration order
+	sortedKeys := make([]string, 0, len(values))
+	for key := range values {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+	changes := storeNodesByKey{}
+	keys := make(map[string]*storeNode)
+	for _, key := range sortedKeys {
+		value := values[key]
+		if old, exists := s.keys[key]; exists && old.value == value {
+			keys[key] = old
+			continue
+		}
+		s.index++
+		keys[key] = &storeNode{index: s.index, key: key, value: value}
+		changes = append(changes, &storeNode{action: "set", index: s.index, key: key, value: value})
+	}
+	deletes := storeNodesByKey{}
+	for key, node := range s.keys {
+		if _, exists := keys[key]; !exists {
+			deletes = append(deletes, &storeNode{action: "delete", index: node.index, key: key})
+		}
+	}
+	sort.Sort(deletes)
+	s.keys, s.modTime = keys, info.ModTime()
+	return append(changes, deletes...), nil
+}
+
+type storeNodesByKey []*storeNode
+
+func (n storeNodesByKey) Len() int           { return len(n) }
+func (n storeNodesByKey) Less(i, j int) bool { return n[i].key < n[j].key }
+func (n storeNodesByKey) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+
+// Get the keys and values of a configuration tree read from a file. Options keys can be set as objects,
+// being stored as JSON like in the other config stores.
+func flattenConfigTree(path string, tree interface{}, values map[string]string) error {
+	switch v := tree.(type) {
+	case nil:
+		values[path] = ""
+	case string:
+		values[path] = v
+	case []interface{}:
+		for _, item := range v {
+			key, ok := item.(string)
+			if !ok || key == "" || strings.Contains(key, "/") {
+				return fmt.Errorf("%s: list items must be key names", path)
+			}
+			values[path+"/"+key] = ""
+		}
+	case map[string]interface{}:
+		if strings.HasSuffix(path, "/"+optionsKey) {
+			value, err := json.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("%s: %s", path, err)
+			}
+			values[path] = string(value)
+			return nil
+		}
+		for key, value := range v {
+			if key == "" || strings.Contains(key, "/") {
+				return fmt.Errorf("%s: invalid key name: %q", path, key)
+			}
+			if err := flattenConfigTree(path+"/"+key, value, values); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s: values must be strings", path)
+	}
+	return nil
+}
+
+// Line of a YAML document, with its indentation and without comments
+type yamlLine struct {
+	indent int
+	number int
+	text   string
+}
+
+// Parse the subset of YAML used in configuration files: block mappings, block sequences of scalars and
+// scalars (plain or quoted, the empty mapping {} and flow sequences of scalars). All scalars are read
+// as strings.
+func parseYaml(data string) (interface{}, error) {
+	lines := []*yamlLine{}
+	for i, text := range strings.Split(data, "\n") {
+		text = strings.TrimRight(stripYamlComment(text), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't be used for indentation", i+1)
+		}
+		lines = append(lines, &yamlLine{indent: len(text) - len(trimmed), number: i + 1, text: trimmed})
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	value, next, err := parseYamlBlock(lines, 0, lines[0].indent)
+	if err == nil && next < len(lines) {
+		err = fmt.Errorf("line %d: unexpected indentation", lines[next].number)
+	}
+	return value, err
+}
+
+// Parse the mapping or sequence starting at the line provided, returning the index of the next line
+func parseYamlBlock(lines []*yamlLine, i int, indent int) (interface{}, int, error) {
+	if lines[i].text == "-" || strings.HasPrefix(lines[i].text, "- ") {
+		items := []interface{}{}
+		// Sequences indented at the same level as their key end at the next key
+		for ; i < len(lines) && lines[i].indent == indent; i++ {
+			line := lines[i]
+			if line.text != "-" && !strings.HasPrefix(line.text, "- ") {
+				break
+			}
+			item, err := parseYamlScalar(strings.TrimSpace(strings.TrimPrefix(line.text, "-")))
+			if err != nil {
+				return nil, i, fmt.Errorf("line %d: %s", line.number, err)
+			}
+			items = append(items, item)
+		}
+		return items, i, nil
+	}
+	mapping := make(map[string]interface{})
+	for i < len(lines) && lines[i].indent == indent {
+		line := lines[i]
+		var key, value string
+		if strings.HasSuffix(line.text, ":") {
+			key = strings.TrimSuffix(line.text, ":")
+		} else if sep := strings.Index(line.text, ": "); sep > 0 {
+			key, value = line.text[:sep], strings.TrimSpace(line.text[sep+2:])
+		} else {
+			return nil, i, fmt.Errorf("line %d: expected a mapping key", line.number)
+		}
+		parsedKey, err := parseYamlScalar(strings.TrimSpace(key))
+		key, ok := parsedKey.(string)
+		if err != nil || !ok {
+			return nil, i, fmt.Errorf("line %d: invalid mapping key", line.number)
+		}
+		if _, exists := mapping[key]; exists {
+			return nil, i, fmt.Errorf("line %d: duplicated key: %s", line.number, key)
+		}
+		i++
+		switch {
+		case value != "":
+			if mapping[key], err = parseYamlScalar(value); err != nil {
+				return nil, i, fmt.Errorf("line %d: %s", line.number, err)
+			}
+		case i < len(lines) && (lines[i].indent > indent ||
+			lines[i].indent == indent && (lines[i].text == "-" || strings.HasPrefix(lines[i].text, "- "))):
+			// Nested block, sequences may be indented at the same level as their key
+			if mapping[key], i, err = parseYamlBlock(lines, i, lines[i].indent); err != nil {
+				return nil, i, err
+			}
+		default:
+			mapping[key] = nil
+		}
+	}
+	return mapping, i, nil
+}
+
+// Parse a scalar, an empty mapping or a flow sequence of scalars
+func parseYamlScalar(text string) (interface{}, error) {
+	switch text {
+	case "", "~", "null":
+		return nil, nil
+	case "{}":
+		return map[string]interface{}{}, nil
+	}
+	if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+		items := []interface{}{}
+		if content := strings.TrimSpace(text[1 : len(text)-1]); content != "" {
+			for _, field := range strings.Split(content, ",") {
+				item, err := parseYamlScalar(strings.TrimSpace(field))
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			}
+		}
+		return items, nil
+	}
+	switch text[0] {
+	case '"':
+		return strconv.Unquote(text)
+	case '\'':
+		if len(text) < 2 || text[len(text)-1] != '\'' {
+			return nil, fmt.Errorf("unterminated string: %s", text)
+		}
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	case '{', '[', '&', '*', '!', '|', '>':
+		return nil, fmt.Errorf("unsupported YAML syntax: %s", text)
+	}
+	return text, nil
+}
+
+// Remove a comment from a YAML line, unless the # is inside a quoted string
+func stripYamlComment(text string) string {
+	var quote rune
+	for i, c := range text {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+	return text
+}
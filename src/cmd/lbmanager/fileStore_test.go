@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseYaml(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+		err  string
+	}{
+		{
+			name: "empty document",
+			yaml: "---\n# only comments\n",
+			want: `null`,
+		},
+		{
+			name: "nested mappings and sequences",
+			yaml: "elb:\n  us-east-1:\n    web:\n      multiple:\n        - i-11111111\n        - i-22222222\n",
+			want: `{"elb":{"us-east-1":{"web":{"multiple":["i-11111111","i-22222222"]}}}}`,
+		},
+		{
+			name: "sequence at the indentation of its key",
+			yaml: "multiple:\n- 10.0.0.1\n- 10.0.0.2\nsingle:\n- 10.0.0.3\n",
+			want: `{"multiple":["10.0.0.1","10.0.0.2"],"single":["10.0.0.3"]}`,
+		},
+		{
+			name: "flow sequences and empty values",
+			yaml: "multiple: [10.0.0.1:80, \"10.0.0.2:80\"]\nsingle: []\nempty:\nnone: ~\noptions: {}\n",
+			want: `{"empty":null,"multiple":["10.0.0.1:80","10.0.0.2:80"],"none":null,"options":{},"single":[]}`,
+		},
+		{
+			name: "scalars are strings",
+			yaml: "ttl: 60\nenabled: true\nversion: 1.10\n",
+			want: `{"enabled":"true","ttl":"60","version":"1.10"}`,
+		},
+		{
+			name: "quoted scalars",
+			yaml: "double: \"a \\\"quoted\\\" \\u00e9 value\"\nsingle: 'it''s'\nempty: ''\n",
+			want: `{"double":"a \"quoted\" é value","empty":"","single":"it's"}`,
+		},
+		{
+			name: "comments",
+			yaml: "# header\nkey: value # trailing comment\nhash: a#b\nquoted: \"a # b\"\nsingle: 'c # d' # comment\n  # indented comment\n",
+			want: `{"hash":"a#b","key":"value","quoted":"a # b","single":"c # d"}`,
+		},
+		{
+			name: "quoted keys",
+			yaml: "\"10.0.0.1:80\": \"\"\n'i-11111111':\n",
+			want: `{"10.0.0.1:80":"","i-11111111":null}`,
+		},
+		{
+			name: "windows line endings",
+			yaml: "key: value\r\nlist:\r\n  - item\r\n",
+			want: `{"key":"value","list":["item"]}`,
+		},
+		{
+			name: "tabs in indentation",
+			yaml: "elb:\n\tus-east-1: value\n",
+			err:  "line 2: tabs can't be used for indentation",
+		},
+		{
+			name: "block scalars",
+			yaml: "key: |\n  text\n",
+			err:  "line 1: unsupported YAML syntax: |",
+		},
+		{
+			name: "folded scalars",
+			yaml: "key: >\n  text\n",
+			err:  "line 1: unsupported YAML syntax: >",
+		},
+		{
+			name: "flow mappings",
+			yaml: "options: {roleArn: arn}\n",
+			err:  "line 1: unsupported YAML syntax: {roleArn: arn}",
+		},
+		{
+			name: "anchors",
+			yaml: "key: &anchor value\n",
+			err:  "line 1: unsupported YAML syntax: &anchor value",
+		},
+		{
+			name: "unterminated strings",
+			yaml: "key: 'value\n",
+			err:  "line 1: unterminated string: 'value",
+		},
+		{
+			name: "duplicated keys",
+			yaml: "key: a\nkey: b\n",
+			err:  "line 2: duplicated key: key",
+		},
+		{
+			name: "missing separator",
+			yaml: "key:value\n",
+			err:  "line 1: expected a mapping key",
+		},
+		{
+			name: "sequence items mixed with keys",
+			yaml: "- a\nkey: b\n",
+			err:  "line 2: unexpected indentation",
+		},
+		{
+			name: "null keys",
+			yaml: "~: value\n",
+			err:  "line 1: invalid mapping key",
+		},
+		{
+			name: "inconsistent indentation",
+			yaml: "a:\n    b: c\n  d: e\n",
+			err:  "line 3: unexpected indentation",
+		},
+	}
+	for _, test := range tests {
+		tree, err := parseYaml(test.yaml)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if got, _ := json.Marshal(tree); string(got) != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFlattenConfigTree(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want []string
+		err  string
+	}{
+		{
+			name: "lists as key names",
+			json: `{"elb": {"us-east-1": {"web": {"multiple": ["i-11111111", "i-22222222"]}}}}`,
+			want: []string{
+				"/lbManager/elb/us-east-1/web/multiple/i-11111111=",
+				"/lbManager/elb/us-east-1/web/multiple/i-22222222=",
+			},
+		},
+		{
+			name: "string and empty values",
+			json: `{"nginx": {"api": {"multiple": {"10.0.0.1:80": "weight=2", "10.0.0.2:80": null}}}}`,
+			want: []string{
+				"/lbManager/nginx/api/multiple/10.0.0.1:80=weight=2",
+				"/lbManager/nginx/api/multiple/10.0.0.2:80=",
+			},
+		},
+		{
+			name: "options objects stored as JSON",
+			json: `{"elb": {"us-east-1": {"_options": {"roleArn": "arn:aws:iam::123456789012:role/lbManager"}}}}`,
+			want: []string{
+				`/lbManager/elb/us-east-1/_options={"roleArn":"arn:aws:iam::123456789012:role/lbManager"}`,
+			},
+		},
+		{
+			name: "options set as strings",
+			json: `{"elb": {"_options": "{\"profile\": \"prod\"}"}}`,
+			want: []string{
+				`/lbManager/elb/_options={"profile": "prod"}`,
+			},
+		},
+		{
+			name: "list items not strings",
+			json: `{"elb": {"us-east-1": {"web": {"multiple": [1]}}}}`,
+			err:  "/lbManager/elb/us-east-1/web/multiple: list items must be key names",
+		},
+		{
+			name: "list items with slashes",
+			json: `{"elb": {"multiple": ["a/b"]}}`,
+			err:  "/lbManager/elb/multiple: list items must be key names",
+		},
+		{
+			name: "empty list items",
+			json: `{"elb": {"multiple": [""]}}`,
+			err:  "/lbManager/elb/multiple: list items must be key names",
+		},
+		{
+			name: "key names with slashes",
+			json: `{"elb/us-east-1": {}}`,
+			err:  `/lbManager: invalid key name: "elb/us-east-1"`,
+		},
+		{
+			name: "values not strings",
+			json: `{"elb": {"ttl": 60}}`,
+			err:  "/lbManager/elb/ttl: values must be strings",
+		},
+	}
+	for _, test := range tests {
+		var tree interface{}
+		if err := json.Unmarshal([]byte(test.json), &tree); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		values := make(map[string]string)
+		err := flattenConfigTree("/lbManager", tree, values)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		got := []string{}
+		for key, value := range values {
+			got = append(got, key+"="+value)
+		}
+		sort.Strings(got)
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got keys:\n%s\nwant:\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
+
+func TestFileStoreSighupBeforeWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lbmanager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte("elb:\n  us-east-1:\n    web:\n      multiple: [i-11111111]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newFileStore(&storeOptions{file: file, root: "/lbManager"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.List("/lbManager"); err != nil {
+		t.Fatal(err)
+	}
+	// Change the file keeping its modification time, so that only the signal reloads it
+	info, _ := os.Stat(file)
+	if err := ioutil.WriteFile(file, []byte("elb:\n  us-east-1:\n    web:\n      multiple: [i-22222222]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(file, info.ModTime(), info.ModTime())
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	time.Sleep(100 * time.Millisecond)
+
+	nodesCh, stopCh := make(chan *storeNode), make(chan bool)
+	defer close(stopCh)
+	go store.Watch("/lbManager", nodesCh, stopCh)
+	expectNode(t, nodesCh, "set /lbManager/elb/us-east-1/web/multiple/i-22222222")
+	expectNode(t, nodesCh, "delete /lbManager/elb/us-east-1/web/multiple/i-11111111")
+}
+
+func TestFileStoreIndexesFollowKeyOrder(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(file, []byte("dns:\n  www.example.com:\n    single: [10.0.0.3, 10.0.0.1, 10.0.0.2]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lb := &LB{configKey: "/lbManager/dns/www.example.com/"}
+	// Map iteration order changes between runs, so the file is read several times
+	for i := 0; i < 20; i++ {
+		store, err := newFileStore(&storeOptions{file: file, root: "/lbManager"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes, err := store.List("/lbManager")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := lb.findLastAddition("single", nodes); got != "10.0.0.3" {
+			t.Fatalf("got latest member %s, want the last one in key order 10.0.0.3", got)
+		}
+	}
+}
+
+func TestFlattenYamlConfigTree(t *testing.T) {
+	tree, err := parseYaml("route53:\n  us-east-1:\n    Z1:\n      www.example.com:\n        multiple: [10.0.0.1, 10.0.0.2]\n    _options: {}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]string)
+	if err := flattenConfigTree("/lbManager", tree, values); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/lbManager/route53/us-east-1/Z1/www.example.com/multiple/10.0.0.1": "",
+		"/lbManager/route53/us-east-1/Z1/www.example.com/multiple/10.0.0.2": "",
+		"/lbManager/route53/us-east-1/_options":                             "{}",
+	}
+	if len(values) != len(want) {
+		t.Fatalf("got keys %v, want %v", values, want)
+	}
+	for key, value := range want {
+		if got, exists := values[key]; !exists || got != value {
+			t.Errorf("got %s=%q, want %q", key, got, value)
+		}
+	}
+}
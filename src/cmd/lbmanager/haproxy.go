@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Template used when no -haproxy-template is provided
+const haproxyDefaultTemplate = `backend {{.Name}}
+	balance roundrobin
+{{range .Members}}	server {{.Name}} {{.Address}} check
+{{end}}`
+
+// HAProxy settings shared by all the haproxy load balancers
+type haproxyOptions struct {
+	checkCmd  string
+	dir       string
+	reloadCmd string
+	template  *template.Template
+}
+
+var haproxySettings = &haproxyOptions{}
+
+// Serializes the writes, checks and reloads of the HAProxy configuration
+var haproxyMu = &sync.Mutex{}
+
+var haproxyBackendRe = regexp.MustCompile(`^[a-zA-Z0-9_.:-]+$`)
+
+func init() {
+	registerBackend("haproxy", &lbBackend{
+		fields:        []string{"name", "class", "member"},
+		usage:         []string{"BACKEND", "LB_CLASS", "IP:PORT"},
+		idFields:      []string{"name"},
+		optionsScopes: [][]string{{"name"}},
+		validate: func(k *memberKey) error {
+			if !haproxyBackendRe.MatchString(k.name) {
+				return fmt.Errorf("invalid HAProxy backend name: %s", k.name)
+			}
+			if k.member != "" && !validHostPort(k.member) {
+				return fmt.Errorf("invalid member: %s (IP:PORT)", k.member)
+			}
+			return nil
+		},
+		build: func(m *Manager, configEntry *configEntry) LoadBalancer {
+			return &HAProxy{LB: m.newLB(configEntry)}
+		},
+	})
+}
+
+// Data available to the backend template
+type haproxyBackend struct {
+	Class   string
+	Members []haproxyMember
+	Name    string
+}
+
+type haproxyMember struct {
+	Address string
+	IP      string
+	Name    string
+	Port    string
+}
+
+// Load balancer rendering a HAProxy backend section in its own file. After a render changes the file,
+// the configuration is validated (restoring the previous file if invalid) and HAProxy is reloaded.
+type HAProxy struct {
+	LB
+	file   *hostConfigFile
+	syncCh chan int
+}
+
+// Build the HAProxy settings, loading the template from the file provided or using the default one
+func newHaproxyOptions(dir, templateFile, checkCmd, reloadCmd string) (*haproxyOptions, error) {
+	text := haproxyDefaultTemplate
+	if templateFile != "" {
+		data, err := ioutil.ReadFile(templateFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading HAProxy template: %s", err)
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New("backend").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing HAProxy template: %s", err)
+	}
+	return &haproxyOptions{checkCmd: checkCmd, dir: dir, reloadCmd: reloadCmd, template: tmpl}, nil
+}
+
+// Setup HAProxy backend based load balancer
+func (lb *HAProxy) Setup(meta map[string]string) {
+	logger.Info("setting up load balancer state", lb.logFields("action", "setup", "name", meta["name"])...)
+	lb.class = meta["class"]
+	lb.configKey = lb.ConfigPath + "/haproxy/" + meta["name"] + "/"
+	lb.file = &hostConfigFile{
+		checkCmd:  haproxySettings.checkCmd,
+		mu:        haproxyMu,
+		path:      filepath.Join(haproxySettings.dir, meta["name"]+".cfg"),
+		reloadCmd: haproxySettings.reloadCmd,
+	}
+	lb.name = meta["name"]
+	lb.syncCh = make(chan int)
+	go func() {
+		lb.sync()
+	}()
+}
+
+// Sync state of the load balancer instance with the real service
+func (lb *HAProxy) Sync() {
+	if !lb.Tracker.begin() {
+		logger.Warn("shutting down, sync discarded", lb.logFields("action", "sync")...)
+		return
+	}
+	lb.syncCh <- 1
+}
+
+// Get the differences between the load balancer state and the members in the backend file
+func (lb *HAProxy) Diff() (*LBDiff, error) {
+	rendered, err := lb.file.members()
+	if err != nil {
+		return nil, err
+	}
+	return lb.buildDiff(lb.Members(), rendered), nil
+}
+
+// Render the backend section for the members provided, sorted
+func (lb *HAProxy) render(sorted []string) ([]byte, error) {
+	backend := haproxyBackend{Class: lb.Status().Class, Members: []haproxyMember{}, Name: lb.name}
+	for _, member := range sorted {
+		ip, port, _ := net.SplitHostPort(member)
+		backend.Members = append(backend.Members, haproxyMember{
+			Address: member,
+			IP:      ip,
+			Name:    strings.NewReplacer(".", "_", ":", "_", "[", "", "]", "").Replace(member),
+			Port:    port,
+		})
+	}
+	buf := &bytes.Buffer{}
+	if err := haproxySettings.template.Execute(buf, backend); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Sync state of the load balancer instance with the real service
+func (lb *HAProxy) sync() {
+	for _ = range lb.syncCh {
+		if lb.Tracker.cancelled() {
+			lb.recordSync(time.Now(), errSyncCancelled)
+			lb.Tracker.end()
+			continue
+		}
+		startedAt := time.Now()
+		members := lb.Members()
+		sort.Strings(members)
+		logger.Debug("syncing", lb.logFields("action", "sync", "members", members)...)
+		body, err := lb.render(members)
+		if err == nil {
+			var changed bool
+			if changed, err = lb.file.apply(&lb.LB, members, body); changed && err == nil {
+				logger.Info("HAProxy backend updated", lb.logFields("action", "sync", "members", members)...)
+			}
+		}
+		if err != nil {
+			logger.Error("error syncing HAProxy backend", lb.logFields("action", "sync", "error", err.Error())...)
+		} else {
+			lb.recordActualMembers(len(members))
+		}
+		lb.recordSync(startedAt, err)
+		lb.Tracker.end()
+	}
+}
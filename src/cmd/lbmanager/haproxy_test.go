@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Use HAProxy settings rendering the backends in a temporary directory, recording the reloads in its
+// reloads file, until the test ends. The check command fails when the backend has the member provided.
+func newTestHAProxy(t *testing.T, invalidMember string) (*HAProxy, string) {
+	dir := t.TempDir()
+	options, err := newHaproxyOptions(dir, "", "! grep -q "+invalidMember+" "+filepath.Join(dir, "web.cfg"), "echo reload >> "+filepath.Join(dir, "reloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := haproxySettings
+	haproxySettings = options
+	t.Cleanup(func() { haproxySettings = previous })
+	lb := &HAProxy{LB: LB{Id: "haproxy_web", Tracker: newSyncTracker(), Type: "haproxy"}}
+	lb.Setup(map[string]string{"class": "multiple", "name": "web"})
+	return lb, dir
+}
+
+// Get the number of reloads recorded in a test directory
+func countReloads(dir string) int {
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "reloads"))
+	return strings.Count(string(data), "reload\n")
+}
+
+func TestHAProxyReloadsOnlyChanges(t *testing.T) {
+	lb, dir := newTestHAProxy(t, "10.0.0.66")
+	lb.AddMember("10.0.0.1:80")
+	lb.AddMember("10.0.0.2:80")
+
+	tests := []struct {
+		name    string
+		add     string
+		reloads int
+	}{
+		{name: "first render", reloads: 1},
+		{name: "same members", reloads: 1},
+		{name: "member added", add: "10.0.0.3:80", reloads: 2},
+		{name: "same members again", reloads: 2},
+	}
+	for _, test := range tests {
+		if test.add != "" {
+			lb.AddMember(test.add)
+		}
+		if status := syncAndWait(t, lb, lb.Tracker); status.LastError != "" {
+			t.Errorf("%s: got error %s", test.name, status.LastError)
+		}
+		if got := countReloads(dir); got != test.reloads {
+			t.Errorf("%s: got %d reloads, want %d", test.name, got, test.reloads)
+		}
+	}
+}
+
+func TestHAProxyRestoresFileFailingCheck(t *testing.T) {
+	lb, dir := newTestHAProxy(t, "10.0.0.66")
+	file := filepath.Join(dir, "web.cfg")
+
+	// Without a previous file the invalid one is removed
+	lb.AddMember("10.0.0.66:80")
+	if status := syncAndWait(t, lb, lb.Tracker); !strings.Contains(status.LastError, "invalid configuration") {
+		t.Errorf("got error %q, want an invalid configuration one", status.LastError)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("got error %v reading the invalid file, want it removed", err)
+	}
+
+	lb.RemoveMember("10.0.0.66:80")
+	lb.AddMember("10.0.0.1:80")
+	if status := syncAndWait(t, lb, lb.Tracker); status.LastError != "" {
+		t.Fatalf("got error %s rendering a valid backend", status.LastError)
+	}
+	valid, _ := ioutil.ReadFile(file)
+
+	lb.AddMember("10.0.0.66:80")
+	if status := syncAndWait(t, lb, lb.Tracker); !strings.Contains(status.LastError, "invalid configuration") {
+		t.Errorf("got error %q, want an invalid configuration one", status.LastError)
+	}
+	if got, _ := ioutil.ReadFile(file); string(got) != string(valid) {
+		t.Errorf("got file:\n%s\nwant the previous one restored:\n%s", got, valid)
+	}
+	if got := countReloads(dir); got != 1 {
+		t.Errorf("got %d reloads, want only the valid backend reloaded", got)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Header written in the generated configuration files, listing the members rendered so that they can
+// be read back
+const hostConfigMembersHeader = "# Generated by lbManager, do not edit. Members: "
+
+// Configuration file of a load balancer running on the host (HAProxy, nginx...), validated and reloaded
+// after it changes
+type hostConfigFile struct {
+	checkCmd      string
+	mu            *sync.Mutex
+	path          string
+	reloadCmd     string
+	reloadPending bool
+}
+
+// Get the members listed in the file header, or none if the file doesn't exist
+func (f *hostConfigFile) members() ([]string, error) {
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	line, _ := bufio.NewReader(file).ReadString('\n')
+	if !strings.HasPrefix(line, hostConfigMembersHeader) {
+		return nil, fmt.Errorf("%s wasn't generated by lbManager", f.path)
+	}
+	return strings.Fields(strings.TrimPrefix(line, hostConfigMembersHeader)), nil
+}
+
+// Write the file if its contents changed, validating the configuration and reloading the service. If
+// the configuration is invalid the previous file is restored. Returns false if the file was unchanged
+// and no reload was pending from a previous call.
+func (f *hostConfigFile) apply(lb *LB, members []string, body []byte) (bool, error) {
+	contents := append([]byte(hostConfigMembersHeader+strings.Join(members, " ")+"\n"), body...)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous, err := ioutil.ReadFile(f.path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	unchanged := err == nil && bytes.Equal(previous, contents)
+	if unchanged && !f.reloadPending {
+		return false, nil
+	}
+	if lb.DryRun {
+		logger.Info("dry run, not writing configuration file", lb.logFields("action", "render", "file", f.path)...)
+		return true, nil
+	}
+	if !unchanged {
+		if err := writeFileAtomic(f.path, contents); err != nil {
+			return true, err
+		}
+		if err := runCommand(f.checkCmd); err != nil {
+			// Restore the previous file, so that a later reload doesn't pick an invalid configuration
+			if previous != nil {
+				writeFileAtomic(f.path, previous)
+			} else {
+				os.Remove(f.path)
+			}
+			return true, fmt.Errorf("invalid configuration: %s", err)
+		}
+	}
+	logger.Info("reloading", lb.logFields("action", "reload", "file", f.path)...)
+	if err := runCommand(f.reloadCmd); err != nil {
+		f.reloadPending = true
+		return true, fmt.Errorf("error reloading: %s", err)
+	}
+	f.reloadPending = false
+	return true, nil
+}
+
+// Write a file atomically, writing a temporary file in the same directory and renaming it
+func writeFileAtomic(file string, contents []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// Run a shell command, returning its output in the error if it fails
+func runCommand(command string) error {
+	if command == "" {
+		return nil
+	}
+	output, err := exec.Command("/bin/sh", "-c", command).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s (%s)", command, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Directories in the configuration tree where load balancer holds and locks are set
+const (
+	holdsDir = "_holds"
+	locksDir = "_locks"
+)
+
+// Valid load balancer names, for the types not setting their own rules
+var lbNameRe = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// Member key in the configuration tree, following the layout parsed by Manager.processNodeKey
+type memberKey struct {
+	class      string
+	hostedZone string
+	lbType     string
+	member     string
+	name       string
+	region     string
+}
+
+// Build the id of a load balancer given its type and metadata
+func buildLbId(lbType string, meta map[string]string) string {
+	if backend := lookupBackend(lbType); backend != nil {
+		return backend.lbId(lbType, meta)
+	}
+	return lbType + "_" + meta["name"]
+}
+
+// Parse a member key from command line arguments, the key segments after the config path:
+//
+//	elb REGION LB_NAME [LB_CLASS] [INSTANCE_ID]
+//	route53 REGION HOSTED_ZONE FQDN [LB_CLASS] [IP]
+//	haproxy BACKEND [LB_CLASS] [IP:PORT]
+//	nginx UPSTREAM [LB_CLASS] [IP:PORT]
+//	webhook NAME [LB_CLASS] [MEMBER]
+//	PLUGIN NAME [LB_CLASS] [MEMBER]
+func parseMemberKey(args []string, withClass bool, withMember bool) (*memberKey, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("load balancer type missing")
+	}
+	key := &memberKey{lbType: args[0]}
+	backend := lookupBackend(key.lbType)
+	if backend == nil {
+		return nil, fmt.Errorf("invalid load balancer type: %s (%s, or a plugin in -plugins-dir)", key.lbType, strings.Join(lbTypes, "|"))
+	}
+	fields := keyFields(backend, withClass, withMember)
+	if len(args)-1 != len(fields) {
+		return nil, fmt.Errorf("wrong number of arguments for %s load balancer, expected: %s", key.lbType, memberKeyUsage(key.lbType, withClass, withMember))
+	}
+	for i, field := range fields {
+		*key.field(field) = args[i+1]
+	}
+	return key, key.validate()
+}
+
+// Get the key fields of a backend provided in the command line arguments
+func keyFields(backend *lbBackend, withClass bool, withMember bool) []string {
+	fields := []string{}
+	for _, field := range backend.fields {
+		if (field != "class" || withClass) && (field != "member" || withMember) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// Get the arguments expected to identify a member key of any built in load balancer type
+func memberKeysUsage(withClass bool, withMember bool) string {
+	usages := []string{}
+	for _, lbType := range lbTypes {
+		usages = append(usages, memberKeyUsage(lbType, withClass, withMember))
+	}
+	return strings.Join(usages, "|")
+}
+
+// Get the arguments expected to identify a member key
+func memberKeyUsage(lbType string, withClass bool, withMember bool) string {
+	backend := lookupBackend(lbType)
+	if backend == nil {
+		return lbType
+	}
+	usage := []string{lbType}
+	for i, field := range backend.fields {
+		if (field != "class" || withClass) && (field != "member" || withMember) {
+			usage = append(usage, backend.usage[i])
+		}
+	}
+	return strings.Join(usage, " ")
+}
+
+// Get the member key field with the name used in the backends key layouts
+func (k *memberKey) field(name string) *string {
+	switch name {
+	case "class":
+		return &k.class
+	case "hostedZone":
+		return &k.hostedZone
+	case "member":
+		return &k.member
+	case "region":
+		return &k.region
+	default:
+		return &k.name
+	}
+}
+
+// Validate the key segments, so that a typo doesn't end up creating a new load balancer
+func (k *memberKey) validate() error {
+	if k.class != "" && k.class != "single" && k.class != "multiple" {
+		return fmt.Errorf("invalid load balancer class: %s (single|multiple)", k.class)
+	}
+	if backend := lookupBackend(k.lbType); backend != nil && backend.validate != nil {
+		return backend.validate(k)
+	}
+	return nil
+}
+
+// Validate the region of an AWS load balancer key
+func (k *memberKey) validateRegion() error {
+	if !awsEndpoints.validRegion(k.lbType, k.region) {
+		return fmt.Errorf("invalid region: %s (unknown regions require an endpoint in -aws-endpoints)", k.region)
+	}
+	return nil
+}
+
+// Validate the key of a load balancer identified by its name, with members opaque to lbManager
+func validateNamedKey(k *memberKey) error {
+	if !lbNameRe.MatchString(k.name) {
+		return fmt.Errorf("invalid %s load balancer name: %s", k.lbType, k.name)
+	}
+	if strings.Contains(k.member, "/") {
+		return fmt.Errorf("invalid member: %s", k.member)
+	}
+	return nil
+}
+
+// Get the load balancer metadata, as built by Manager.processNodeKey
+func (k *memberKey) metadata() map[string]string {
+	meta := map[string]string{
+		"class":  k.class,
+		"name":   k.name,
+		"region": k.region,
+	}
+	if backend := lookupBackend(k.lbType); backend != nil {
+		for _, field := range backend.fields {
+			if field != "member" {
+				meta[field] = *k.field(field)
+			}
+		}
+	}
+	return meta
+}
+
+// Get the id of the load balancer the key belongs to
+func (k *memberKey) lbId() string {
+	return buildLbId(k.lbType, k.metadata())
+}
+
+// Get the path of the load balancer the key belongs to in the configuration tree
+func (k *memberKey) lbPath(configPath string) string {
+	path := configPath + "/" + k.lbType
+	if backend := lookupBackend(k.lbType); backend != nil {
+		for _, field := range backend.fields {
+			if field != "class" && field != "member" {
+				path += "/" + *k.field(field)
+			}
+		}
+	}
+	return path
+}
+
+// Check if a member is an IP:PORT address
+func validHostPort(member string) bool {
+	host, port, err := net.SplitHostPort(member)
+	if err != nil || net.ParseIP(host) == nil {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+// Get the path of the key used to hold the load balancer the key belongs to
+func (k *memberKey) holdPath(configPath string) string {
+	return configPath + "/" + holdsDir + "/" + k.lbId()
+}
+
+// Get the full path of the member key in the configuration tree
+func (k *memberKey) path(configPath string) string {
+	return k.lbPath(configPath) + "/" + k.class + "/" + k.member
+}
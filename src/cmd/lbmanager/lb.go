@@ -1,45 +1,87 @@
 package main
 
 import (
-	"github.com/coreos/go-etcd/etcd"
-	"github.com/mitchellh/goamz/aws"
-	"log"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 type LB struct {
-	AwsAuth    aws.Auth
-	ConfigPath string
-	EtcdClient *etcd.Client
-	Id         string
-	Type       string
-	class      string
-	configKey  string
-	members    []string
-	name       string
-	region     string
-}
-
-// Add a member to the load balancer state
+	AwsCredentials func() *credentials.Credentials
+	ConfigPath     string
+	DryRun         bool
+	Store          ConfigStore
+	Id             string
+	Tracker        *syncTracker
+	Type           string
+	class          string
+	configKey      string
+	lastError      error
+	lastSuccess    time.Time
+	lastSync       time.Time
+	members        []string
+	mu             sync.Mutex
+	name           string
+	region         string
+	unresolved     []string
+}
+
+// Snapshot of a load balancer's state, as exposed by the admin api. Addresses holds the ones set in the
+// real service when some members are resolved to them.
+type LBStatus struct {
+	Id                 string    `json:"id"`
+	Type               string    `json:"type"`
+	Name               string    `json:"name"`
+	Class              string    `json:"class"`
+	Members            []string  `json:"members"`
+	LastSync           time.Time `json:"lastSync"`
+	LastSuccessfulSync time.Time `json:"lastSuccessfulSync"`
+	LastError          string    `json:"lastError"`
+	Unresolved         []string  `json:"unresolved,omitempty"`
+	Addresses          []string  `json:"addresses,omitempty"`
+}
+
+// Differences between the desired state of a load balancer and its actual state in the real service
+type LBDiff struct {
+	Id       string   `json:"id"`
+	Type     string   `json:"type"`
+	Desired  []string `json:"desired"`
+	Actual   []string `json:"actual"`
+	ToAdd    []string `json:"toAdd"`
+	ToRemove []string `json:"toRemove"`
+}
+
+// Add a member to the load balancer state. The member keys of single class load balancers are read
+// from the config store without holding the lock, so that a slow store doesn't block the state readers.
 func (lb *LB) AddMember(member string) {
-	if lb.class == "single" {
-		log.Printf("-> %s:%s:setSingleMember:%s\n", strings.ToUpper(lb.Type), lb.name, member)
-		if lb.isLatestAdded(member) {
-			lb.members = []string{member}
-			lb.removeInvalidMembersFromConfig(member)
-		}
-	} else {
-		log.Printf("-> %s:%s:addMember:%s\n", strings.ToUpper(lb.Type), lb.name, member)
+	lb.mu.Lock()
+	class := lb.class
+	if class != "single" {
+		logger.Info("adding member", lb.logFields("action", "addMember", "member", member)...)
 		if p := lb.memberPosition(member); p == -1 {
 			lb.members = append(lb.members, member)
 		}
+		lb.mu.Unlock()
+		return
+	}
+	lb.mu.Unlock()
+	logger.Info("setting single member", lb.logFields("action", "setSingleMember", "member", member)...)
+	nodes, _ := lb.Store.List(lb.configKey + class)
+	if lb.findLastAddition(class, nodes) == member {
+		lb.mu.Lock()
+		lb.members = []string{member}
+		lb.mu.Unlock()
+		lb.removeInvalidMembersFromConfig(nodes, member)
 	}
 }
 
 // Remove a member from the load balancer state
 func (lb *LB) RemoveMember(member string) {
-	log.Printf("<- %s:%s:removeMember:%s\n", strings.ToUpper(lb.Type), lb.name, member)
+	logger.Info("removing member", lb.logFields("action", "removeMember", "member", member)...)
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
 	if p := lb.memberPosition(member); p > -1 {
 		lb.members = append(lb.members[:p], lb.members[p+1:]...)
 	}
@@ -47,55 +89,150 @@ func (lb *LB) RemoveMember(member string) {
 
 // Set load balancer's class (single/multiple) -based on the last class seen in a config entry-
 func (lb *LB) SetClass(newClass string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
 	if lb.class != newClass {
 		lb.class = newClass
-		switch lb.class {
-		case "single":
-			lb.EtcdClient.Delete(lb.configKey+"multiple", true)
-		case "multiple":
-			lb.EtcdClient.Delete(lb.configKey+"single", true)
+		if lb.DryRun {
+			logger.Info("dry run, not removing other class members from config", lb.logFields("action", "setClass", "class", lb.class)...)
+		} else {
+			switch lb.class {
+			case "single":
+				lb.Store.Delete(lb.configKey+"multiple", true)
+			case "multiple":
+				lb.Store.Delete(lb.configKey+"single", true)
+			}
 		}
 		lb.members = []string{}
-		log.Printf("-> %s:%s:lbClassUpdatedTo:%s:resettingMembers:%s\n", strings.ToUpper(lb.Type), lb.name, lb.class, lb.members)
+		logger.Info("class updated, resetting members", lb.logFields("action", "setClass", "class", lb.class)...)
 	}
 }
 
-// Checks if the provided member is the latest addition to the load balancer
-func (lb *LB) isLatestAdded(member string) bool {
-	if lastAddition := lb.findLastAddition(); lastAddition == member {
-		return true
+// Get the keys of the load balancer's current members in the configuration tree
+func (lb *LB) MemberKeys() []string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	keys := make([]string, len(lb.members))
+	for i, member := range lb.members {
+		keys[i] = lb.configKey + lb.class + "/" + member
 	}
-	return false
+	return keys
+}
+
+// Build the key/value pairs identifying the load balancer in log entries, followed by the ones provided
+func (lb *LB) logFields(fields ...interface{}) []interface{} {
+	return append([]interface{}{"lb", lb.Id, "type", lb.Type}, fields...)
+}
+
+// Get a copy of the load balancer's current members
+func (lb *LB) Members() []string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	members := make([]string, len(lb.members))
+	copy(members, lb.members)
+	return members
 }
 
-// Find latest added member to the load balancer
-func (lb *LB) findLastAddition() (lastAddition string) {
+// Get a snapshot of the load balancer's state
+func (lb *LB) Status() LBStatus {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	status := LBStatus{
+		Id:                 lb.Id,
+		Type:               lb.Type,
+		Name:               lb.name,
+		Class:              lb.class,
+		Members:            make([]string, len(lb.members)),
+		LastSync:           lb.lastSync,
+		LastSuccessfulSync: lb.lastSuccess,
+	}
+	copy(status.Members, lb.members)
+	if len(lb.unresolved) > 0 {
+		status.Unresolved = append([]string{}, lb.unresolved...)
+	}
+	if lb.lastError != nil {
+		status.LastError = lb.lastError.Error()
+	}
+	return status
+}
+
+// Record the result of the latest sync operation
+func (lb *LB) recordSync(startedAt time.Time, err error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.lastSync = time.Now()
+	lb.lastError = err
+	if err == nil {
+		lb.lastSuccess = lb.lastSync
+	}
+	metrics.observeSync(lb.Id, lb.Type, lb.lastSync.Sub(startedAt).Seconds(), err)
+}
+
+// Record the members that couldn't be resolved to the ones used in the real service in the latest sync
+func (lb *LB) recordUnresolved(members []string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.unresolved = members
+}
+
+// Record the number of members seen in the real service (ignored if unknown)
+func (lb *LB) recordActualMembers(count int) {
+	if count < 0 {
+		return
+	}
+	metrics.set("lbmanager_lb_members", float64(count), "lb", lb.Id, "type", lb.Type, "state", "actual")
+}
+
+// Build the diff between the desired members and the actual ones in the real service
+func (lb *LB) buildDiff(desired []string, actual []string) *LBDiff {
+	diff := &LBDiff{
+		Id:       lb.Id,
+		Type:     lb.Type,
+		Desired:  desired,
+		Actual:   actual,
+		ToAdd:    []string{},
+		ToRemove: []string{},
+	}
+	for _, member := range actual {
+		if !lb.memberExists(member, desired) {
+			diff.ToRemove = append(diff.ToRemove, member)
+		}
+	}
+	for _, member := range desired {
+		if !lb.memberExists(member, actual) {
+			diff.ToAdd = append(diff.ToAdd, member)
+		}
+	}
+	return diff
+}
+
+// Find latest added member to the load balancer among the member keys of its class
+func (lb *LB) findLastAddition(class string, nodes []*storeNode) (lastAddition string) {
 	lastAddition = "not_found"
 	var lastSeenIndex uint64 = 0
-	memberRe, _ := regexp.Compile(lb.configKey + lb.class + "/(.*)")
-	response, _ := lb.EtcdClient.Get(lb.configKey+lb.class, false, false)
-	if response != nil {
-		for _, child := range response.Node.Nodes {
-			if child.ModifiedIndex > lastSeenIndex {
-				result := memberRe.FindStringSubmatch(child.Key)
-				if len(result) > 0 {
-					lastSeenIndex = child.ModifiedIndex
-					lastAddition = result[1]
-				}
+	memberRe, _ := regexp.Compile(lb.configKey + class + "/(.*)")
+	for _, node := range nodes {
+		if node.index > lastSeenIndex {
+			result := memberRe.FindStringSubmatch(node.key)
+			if len(result) > 0 {
+				lastSeenIndex = node.index
+				lastAddition = result[1]
 			}
 		}
 	}
 	return
 }
 
-// Remove invalid members from the load balancer configuration in etcd
-func (lb *LB) removeInvalidMembersFromConfig(validMember string) {
-	response, _ := lb.EtcdClient.Get(lb.configKey+lb.class, false, false)
-	for _, child := range response.Node.Nodes {
-		if !strings.HasSuffix(child.Key, validMember) {
-			_, err := lb.EtcdClient.Delete(child.Key, false)
-			if err != nil {
-				log.Println(err)
+// Remove the member keys provided other than the one of the valid member from the config
+func (lb *LB) removeInvalidMembersFromConfig(nodes []*storeNode, validMember string) {
+	for _, node := range nodes {
+		if !strings.HasSuffix(node.key, validMember) {
+			if lb.DryRun {
+				logger.Info("dry run, not removing invalid member from config", lb.logFields("action", "removeInvalidMember", "key", node.key)...)
+				continue
+			}
+			if err := lb.Store.Delete(node.key, false); err != nil {
+				logger.Error("error removing invalid member from config", lb.logFields("action", "removeInvalidMember", "key", node.key, "error", err.Error())...)
 			}
 		}
 	}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Config store blocking its reads until released, recording the keys deleted
+type slowStore struct {
+	ConfigStore
+	deleted   []string
+	listingCh chan bool
+	nodes     []*storeNode
+	releaseCh chan bool
+}
+
+func (s *slowStore) List(path string) ([]*storeNode, error) {
+	s.listingCh <- true
+	<-s.releaseCh
+	return s.nodes, nil
+}
+
+func (s *slowStore) Delete(key string, recursive bool) error {
+	s.deleted = append(s.deleted, key)
+	return nil
+}
+
+func TestSingleMemberAddedWithoutBlockingReaders(t *testing.T) {
+	store := &slowStore{
+		nodes: []*storeNode{
+			{index: 1, key: "/lbManager/elb/us-east-1/web/single/i-11111111"},
+			{index: 2, key: "/lbManager/elb/us-east-1/web/single/i-22222222"},
+		},
+		listingCh: make(chan bool),
+		releaseCh: make(chan bool),
+	}
+	lb := &LB{Store: store, class: "single", configKey: "/lbManager/elb/us-east-1/web/", members: []string{"i-11111111"}}
+	addedCh := make(chan bool)
+	go func() {
+		lb.AddMember("i-22222222")
+		close(addedCh)
+	}()
+
+	<-store.listingCh
+	readCh := make(chan []string)
+	go func() {
+		readCh <- lb.Members()
+	}()
+	select {
+	case members := <-readCh:
+		if strings.Join(members, " ") != "i-11111111" {
+			t.Errorf("got members %v while adding, want the previous ones", members)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reading the members blocked while the config store was read")
+	}
+	close(store.releaseCh)
+	<-addedCh
+	if members := lb.Members(); strings.Join(members, " ") != "i-22222222" {
+		t.Errorf("got members %v, want the latest one added", members)
+	}
+	if strings.Join(store.deleted, " ") != "/lbManager/elb/us-east-1/web/single/i-11111111" {
+		t.Errorf("got keys deleted %v, want the previous member's one", store.deleted)
+	}
+}
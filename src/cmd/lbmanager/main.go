@@ -2,56 +2,364 @@ package main
 
 import (
 	"flag"
-	"log"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
 
 	"bitbucket.org/ipowow/updater"
-	"github.com/coreos/go-etcd/etcd"
-	"github.com/mitchellh/goamz/aws"
+	"github.com/mgutz/logxi/v1"
 )
 
+var logger = log.New("lbmanager")
+
 var config struct {
-	etcdHost     string
-	etcdPath     string
-	awsAccessKey string
-	awsSecretKey string
+	apiAddr         string
+	dnsServerAddr   string
+	dnsServerZones  string
+	dnsServerTtl    uint
+	configStore     string
+	configFile      string
+	consulAddr      string
+	consulToken     string
+	leaderLock      bool
+	etcdHost        string
+	etcdPath        string
+	etcdCAFile      string
+	etcdCertFile    string
+	etcdKeyFile     string
+	etcdUsername    string
+	etcdPassword    string
+	awsAccessKey    string
+	awsSecretKey    string
+	awsProfile      string
+	awsMetadataUrl  string
+	awsEndpoints    string
+	haproxyDir      string
+	haproxyTemplate string
+	haproxyCheckCmd string
+	haproxyReload   string
+	nginxDir        string
+	nginxCheckCmd   string
+	nginxReload     string
+	webhookSecret   string
+	webhookTimeout  time.Duration
+	webhookRetries  int
+	pluginsDir      string
+	dnsServer       string
+	dnsTsigKey      string
+	dnsTtl          uint
+	dnsTimeout      time.Duration
+	pluginTimeout   time.Duration
+	dryRun          bool
+	logJSON         bool
+	logLevel        string
+	shutdownTimeout time.Duration
+	refreshInterval time.Duration
+	reapInterval    time.Duration
+	reapGrace       time.Duration
 }
 
 func init() {
+	flag.StringVar(&config.apiAddr, "api-addr", "", "Admin api listen address (disabled if empty)")
+	flag.StringVar(&config.dnsServerAddr, "dns-addr", "", "Embedded DNS server listen address, serving the dns and route53 load balancers members (disabled if empty)")
+	flag.StringVar(&config.dnsServerZones, "dns-zones", "", "Comma separated list of zones the embedded DNS server is authoritative for")
+	flag.UintVar(&config.dnsServerTtl, "dns-ttl", 30, "TTL of the records served by the embedded DNS server")
+	flag.StringVar(&config.configStore, "config-store", "etcd", "Config store (etcd|etcdv3|consul|file), etcdv3 uses the etcd v3 API through its JSON gateway")
+	flag.StringVar(&config.configFile, "config-file", "", "JSON or YAML file holding the configuration tree, used with -config-store=file")
+	flag.StringVar(&config.consulAddr, "consul-addr", "http://localhost:8500", "Consul agent address, used with -config-store=consul")
+	flag.StringVar(&config.consulToken, "consul-token", "", "Consul ACL token (read from CONSUL_HTTP_TOKEN if empty)")
+	flag.BoolVar(&config.leaderLock, "leader-lock", false, "Manage the load balancers only while holding the leader lock in the config store (consul), so that several instances can run")
 	flag.StringVar(&config.etcdHost, "etcd-host", "http://localhost:2379", "Etcd service address")
 	flag.StringVar(&config.etcdPath, "config-path", "/lbManager", "Configuration path")
+	flag.StringVar(&config.etcdCAFile, "etcd-ca-file", "", "CA certificate used to verify the etcd servers")
+	flag.StringVar(&config.etcdCertFile, "etcd-cert-file", "", "Client certificate used to connect to etcd")
+	flag.StringVar(&config.etcdKeyFile, "etcd-key-file", "", "Client certificate key used to connect to etcd")
+	flag.StringVar(&config.etcdUsername, "etcd-username", "", "Etcd username (the password is read from ETCD_PASSWORD if -etcd-password isn't provided)")
+	flag.StringVar(&config.etcdPassword, "etcd-password", "", "Etcd password")
 	flag.StringVar(&config.awsAccessKey, "aws-access-key", "", "AWS access key")
 	flag.StringVar(&config.awsSecretKey, "aws-secret-key", "", "AWS secret key")
+	flag.StringVar(&config.awsProfile, "aws-profile", "", "Profile used from the AWS shared credentials file (AWS_PROFILE or default if empty)")
+	flag.StringVar(&config.awsEndpoints, "aws-endpoints", "", "AWS endpoints overrides, as a comma separated list of SERVICE[/REGION]=URL (services: ec2|elb|route53|sts)")
+	flag.StringVar(&config.awsMetadataUrl, "aws-metadata-url", "http://169.254.169.254/latest", "EC2 instance metadata service address, used to get the instance role credentials")
+	flag.StringVar(&config.haproxyDir, "haproxy-dir", "/etc/haproxy/backends", "Directory where the HAProxy backend files are written, one per backend")
+	flag.StringVar(&config.haproxyTemplate, "haproxy-template", "", "Go template used to render the HAProxy backend files (a backend with a server per member if empty)")
+	flag.StringVar(&config.haproxyCheckCmd, "haproxy-check-cmd", "haproxy -c -f /etc/haproxy/haproxy.cfg -f /etc/haproxy/backends", "Command validating the HAProxy configuration after a backend file changes")
+	flag.StringVar(&config.haproxyReload, "haproxy-reload-cmd", "systemctl reload haproxy", "Command reloading HAProxy after a backend file changes")
+	flag.StringVar(&config.nginxDir, "nginx-dir", "/etc/nginx/upstreams", "Directory where the nginx upstream files are written, one per upstream")
+	flag.StringVar(&config.nginxCheckCmd, "nginx-check-cmd", "nginx -t", "Command testing the nginx configuration after an upstream file changes")
+	flag.StringVar(&config.nginxReload, "nginx-reload-cmd", "nginx -s reload", "Command reloading nginx after an upstream file changes")
+	flag.StringVar(&config.webhookSecret, "webhook-secret", "", "Key used to sign the webhook requests (read from LBMANAGER_WEBHOOK_SECRET if empty)")
+	flag.DurationVar(&config.webhookTimeout, "webhook-timeout", 10*time.Second, "Timeout of the webhook requests")
+	flag.IntVar(&config.webhookRetries, "webhook-retries", 3, "Number of times failed webhook requests are retried")
+	flag.StringVar(&config.pluginsDir, "plugins-dir", "", "Directory holding the plugins managing load balancers, named as the load balancer types they manage (disabled if empty)")
+	flag.DurationVar(&config.pluginTimeout, "plugin-timeout", 30*time.Second, "Time plugins are given to run before being killed")
+	flag.StringVar(&config.dnsServer, "dnsupdate-server", "127.0.0.1:53", "DNS server receiving the dnsupdate load balancers updates, unless set in the options of their zone")
+	flag.StringVar(&config.dnsTsigKey, "dnsupdate-tsig-key", "", "TSIG key signing the DNS updates, as [ALGORITHM:]NAME:SECRET (read from LBMANAGER_TSIG_KEY if empty, unsigned if not set)")
+	flag.UintVar(&config.dnsTtl, "dnsupdate-ttl", 60, "TTL of the records set by the dnsupdate load balancers")
+	flag.DurationVar(&config.dnsTimeout, "dnsupdate-timeout", 10*time.Second, "Timeout of the DNS queries and updates")
+	flag.DurationVar(&config.refreshInterval, "instance-refresh-interval", time.Minute, "Interval between checks of the addresses of the route53 members set as instance ids (disabled if 0)")
+	flag.DurationVar(&config.reapInterval, "reap-interval", 0, "Interval between checks of the instances of the elb and route53 members, removing the keys of the terminated ones (disabled if 0)")
+	flag.DurationVar(&config.reapGrace, "reap-grace", 10*time.Minute, "Time the instances of the members must have been terminated or missing before their keys are removed")
+	flag.StringVar(&config.logLevel, "log-level", "info", "Log level (error|warn|info|debug)")
+	flag.BoolVar(&config.logJSON, "log-json", false, "Write log entries in JSON format")
+	flag.BoolVar(&config.dryRun, "dry-run", false, "Log the changes needed in the load balancers without applying them")
+	flag.DurationVar(&config.shutdownTimeout, "shutdown-timeout", 25*time.Second, "Maximum time to wait for pending syncs on shutdown")
+}
+
+// Setup logger's level and format from the flags provided
+func setupLogger() error {
+	level, ok := log.LevelAtoi[config.logLevel]
+	if !ok {
+		return fmt.Errorf("invalid log level: %s", config.logLevel)
+	}
+	logger.SetLevel(level)
+	if defaultLogger, ok := logger.(*log.DefaultLogger); ok {
+		if config.logJSON {
+			defaultLogger.SetFormatter(log.NewJSONFormatter("lbmanager"))
+		} else {
+			defaultLogger.SetFormatter(log.NewTextFormatter("lbmanager"))
+		}
+	}
+	return nil
 }
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
+	if err := setupLogger(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	var err error
+	if awsEndpoints, err = parseEndpoints(config.awsEndpoints); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	// Instantiates the CoreRoller updater to check periodically for version update.
-	if updater, err := updater.New(30*time.Second, syscall.SIGTERM); err == nil {
-		go updater.Start()
+	if haproxySettings, err = newHaproxyOptions(config.haproxyDir, config.haproxyTemplate, config.haproxyCheckCmd, config.haproxyReload); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	nginxSettings = &nginxOptions{checkCmd: config.nginxCheckCmd, dir: config.nginxDir, reloadCmd: config.nginxReload}
+	if config.webhookSecret == "" {
+		config.webhookSecret = os.Getenv("LBMANAGER_WEBHOOK_SECRET")
+	}
+	webhookSettings = &webhookOptions{
+		client:     &http.Client{Timeout: config.webhookTimeout},
+		retries:    config.webhookRetries,
+		retryDelay: time.Second,
+		secret:     config.webhookSecret,
+	}
+	execSettings = &execOptions{dir: config.pluginsDir, timeout: config.pluginTimeout}
+	if config.dnsTsigKey == "" {
+		config.dnsTsigKey = os.Getenv("LBMANAGER_TSIG_KEY")
+	}
+	dnsUpdateSettings = &dnsUpdateOptions{server: config.dnsServer, timeout: config.dnsTimeout, ttl: uint32(config.dnsTtl)}
+	if config.dnsTsigKey != "" {
+		if dnsUpdateSettings.tsig, err = parseTsigKey(config.dnsTsigKey); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
 	}
 
-	awsAuth, err := aws.GetAuth(config.awsAccessKey, config.awsSecretKey)
+	if config.etcdPassword == "" {
+		config.etcdPassword = os.Getenv("ETCD_PASSWORD")
+	}
+	options := &storeOptions{
+		caFile:   config.etcdCAFile,
+		certFile: config.etcdCertFile,
+		keyFile:  config.etcdKeyFile,
+		machines: strings.Split(config.etcdHost, ","),
+		password: config.etcdPassword,
+		username: config.etcdUsername,
+	}
+	switch config.configStore {
+	case "consul":
+		if config.consulToken == "" {
+			config.consulToken = os.Getenv("CONSUL_HTTP_TOKEN")
+		}
+		options = &storeOptions{machines: strings.Split(config.consulAddr, ","), token: config.consulToken}
+	case "file":
+		options = &storeOptions{file: config.configFile, root: config.etcdPath}
+	}
+	store, err := newConfigStore(config.configStore, options)
 	if err != nil {
-		log.Println(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
 
 	manager := &Manager{
-		configPath: config.etcdPath,
-		etcdClient: etcd.NewClient(strings.Split(config.etcdHost, ",")),
-		awsAuth:    awsAuth,
+		configPath:      config.etcdPath,
+		dryRun:          config.dryRun,
+		store:           store,
+		awsCredentials:  newAwsCredentials(config.awsAccessKey, config.awsSecretKey, config.awsProfile, config.awsMetadataUrl),
+		refreshInterval: config.refreshInterval,
 	}
 
-	log.Println("Running load balancers manager...")
-	go manager.Start()
+	if flag.NArg() == 0 {
+		runManager(manager)
+		return
+	}
+	cmd, exists := commands[flag.Arg(0)]
+	if !exists {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	// The agent runs until stopped, logging its changes like the manager
+	if !flagProvided("log-level") && flag.Arg(0) != "agent" {
+		logger.SetLevel(log.LevelWarn)
+	}
+	// Commands only read the load balancers' state, changes are always applied by the manager
+	manager.dryRun = true
+	os.Exit(cmd.run(manager, flag.Args()[1:]))
+}
+
+// Print usage information
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command [command flags] [args]]\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintf(os.Stderr, "  %-8s %s\n", "(none)", "Run the load balancers manager")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s COMMAND -h' for details on a command.\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	flag.PrintDefaults()
+}
 
-	// Wait for signal to terminate
+// Check if a flag was explicitly provided in the command line
+func flagProvided(name string) (provided bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			provided = true
+		}
+	})
+	return
+}
+
+// Run the load balancers manager until a signal to terminate is received
+func runManager(manager *Manager) {
+	// Instantiates the CoreRoller updater to check periodically for version update.
+	if updater, err := updater.New(30*time.Second, syscall.SIGTERM); err == nil {
+		go updater.Start()
+	}
+
+	if manager.dryRun {
+		logger.Warn("running in dry run mode, no changes will be applied", "action", "start")
+	}
+	logger.Info("running load balancers manager", "action", "start")
+	if err := checkStore(manager.store, manager.configPath); err != nil {
+		logger.Error("error connecting to the config store, check its address, certificates and credentials", "action", "start", "error", err.Error())
+		os.Exit(1)
+	}
+	if _, err := manager.awsCredentials.Get(); err != nil {
+		logger.Error("error getting AWS credentials", "action", "getCredentials", "error", err.Error())
+	}
 	signalsCh := make(chan os.Signal, 1)
 	signal.Notify(signalsCh, os.Interrupt, syscall.SIGTERM)
-	<-signalsCh
+	var lockLostCh chan bool
+	if config.leaderLock {
+		var acquired bool
+		if lockLostCh, acquired = acquireLeaderLock(manager, signalsCh); !acquired {
+			return
+		}
+	}
+	go manager.Start()
+
+	if config.apiAddr != "" {
+		apiServer := &ApiServer{
+			Addr:    config.apiAddr,
+			Manager: manager,
+		}
+		go apiServer.Start()
+	}
+
+	if config.dnsServerAddr != "" {
+		dnsServer := &DnsServer{
+			Addr:    config.dnsServerAddr,
+			Manager: manager,
+			Ttl:     uint32(config.dnsServerTtl),
+			Zones:   []string{},
+		}
+		for _, zone := range strings.Split(config.dnsServerZones, ",") {
+			if zone = strings.ToLower(strings.Trim(strings.TrimSpace(zone), ".")); zone != "" {
+				dnsServer.Zones = append(dnsServer.Zones, zone)
+			}
+		}
+		go dnsServer.Start()
+	}
+
+	if config.reapInterval > 0 {
+		reaper := &Reaper{
+			Grace:    config.reapGrace,
+			Interval: config.reapInterval,
+			Manager:  manager,
+		}
+		go reaper.Start()
+	}
+
+	// Wait for signal to terminate, or for the leader lock to be lost
+	select {
+	case sig := <-signalsCh:
+		logger.Info("signal received, shutting down", "action", "shutdown", "signal", sig.String())
+	case <-lockLostCh:
+		logger.Error("leader lock lost, shutting down", "action", "shutdown")
+		manager.Stop(config.shutdownTimeout)
+		os.Exit(1)
+	}
+
+	applied := manager.Stop(config.shutdownTimeout)
+	if config.leaderLock {
+		if err := manager.store.(lockingStore).Unlock(manager.configPath + "/" + leaderLockKey); err != nil {
+			logger.Error("error releasing leader lock", "action", "shutdown", "error", err.Error())
+		}
+	}
+	if !applied {
+		logger.Error("shutdown finished with changes not applied", "action", "shutdown")
+		os.Exit(1)
+	}
+	logger.Info("shutdown finished, all changes applied", "action", "shutdown")
+}
+
+// Wait until the leader lock is acquired, returning the channel closed when it's lost. Returns false if a
+// signal to terminate was received first.
+func acquireLeaderLock(manager *Manager, signalsCh chan os.Signal) (chan bool, bool) {
+	locker, ok := manager.store.(lockingStore)
+	if !ok {
+		logger.Error("the config store doesn't support locks, -leader-lock can't be used", "action", "lock", "store", config.configStore)
+		os.Exit(2)
+	}
+	logger.Info("waiting for the leader lock", "action", "lock")
+	stopCh, lockedCh := make(chan bool), make(chan error, 1)
+	var lostCh chan bool
+	go func() {
+		var err error
+		lostCh, err = locker.Lock(manager.configPath+"/"+leaderLockKey, stopCh)
+		lockedCh <- err
+	}()
+	select {
+	case sig := <-signalsCh:
+		logger.Info("signal received while waiting for the leader lock, shutting down", "action", "shutdown", "signal", sig.String())
+		close(stopCh)
+		<-lockedCh
+		return nil, false
+	case err := <-lockedCh:
+		if err != nil {
+			logger.Error("error acquiring leader lock", "action", "lock", "error", err.Error())
+			os.Exit(1)
+		}
+	}
+	logger.Info("leader lock acquired, managing load balancers", "action", "lock")
+	return lostCh, true
 }
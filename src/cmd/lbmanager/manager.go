@@ -1,200 +1,539 @@
 package main
 
 import (
-	"github.com/coreos/go-etcd/etcd"
-	"github.com/mitchellh/goamz/aws"
-	"github.com/mitchellh/goamz/route53"
-	"log"
-	"regexp"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 type LoadBalancer interface {
 	AddMember(member string)
+	Diff() (*LBDiff, error)
+	MemberKeys() []string
 	RemoveMember(member string)
 	SetClass(class string)
 	Setup(metadata map[string]string)
+	Status() LBStatus
 	Sync()
 }
 
 type configEntry struct {
-	action     string
-	memberId   string
-	lbType     string
-	lbId       string
-	lbMetadata map[string]string
+	action      string
+	memberId    string
+	memberValue string
+	lbType      string
+	lbId        string
+	lbMetadata  map[string]string
+}
+
+// Load balancers using the value of the member keys
+type memberValueSetter interface {
+	SetMemberValue(member string, value string)
+}
+
+// Load balancers whose members are resolved to addresses that may change, checked periodically
+type addressRefresher interface {
+	addressesChanged() bool
 }
 
 type Manager struct {
-	configPath       string
-	etcdClient       *etcd.Client
-	awsAuth          aws.Auth
-	loadBalancers    map[string]LoadBalancer
-	zonesUpdatersChs map[string]chan *route53.Change
+	configPath      string
+	dryRun          bool
+	store           ConfigStore
+	awsCredentials  *credentials.Credentials
+	holds           map[string]bool
+	loadBalancers   map[string]LoadBalancer
+	mu              sync.RWMutex
+	once            sync.Once
+	refreshInterval time.Duration
+	stopCh          chan bool
+	stoppedCh       chan bool
+	tracker         *syncTracker
+	zonesUpdaters   map[string]*ZoneUpdater
+
+	// Options keys are looked up from the load balancers' goroutines, so they use their own lock
+	accountsCredentials map[string]*credentials.Credentials
+	options             map[string]*lbOptions
+	optionsMu           sync.Mutex
+}
+
+// Initialize manager's internal state
+func (m *Manager) init() {
+	m.once.Do(func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.accountsCredentials = make(map[string]*credentials.Credentials)
+		m.holds = make(map[string]bool)
+		m.loadBalancers = make(map[string]LoadBalancer)
+		m.options = make(map[string]*lbOptions)
+		m.stopCh = make(chan bool)
+		m.stoppedCh = make(chan bool)
+		m.tracker = newSyncTracker()
+		m.zonesUpdaters = make(map[string]*ZoneUpdater)
+	})
 }
 
 func (m *Manager) Start() {
-	m.loadBalancers = make(map[string]LoadBalancer)
-	m.zonesUpdatersChs = make(map[string]chan *route53.Change)
-	readConfigCh, readConfigDoneCh := m.readConfig()
-	watchConfigCh := m.watchConfig()
+	m.init()
+	defer close(m.stoppedCh)
+	readConfigCh, readConfigDoneCh := m.readConfig(m.configPath)
+	// The watch starts once the config has been read, resuming from the changes following the ones read.
+	// The config is read again when those changes are no longer available.
+	var watchConfigCh chan *storeNode
+	var watchErrCh chan error
+	// Addresses are checked once the whole config has been read, skipping the checks due while the
+	// previous one is still running
+	var refreshCh <-chan time.Time
+	var refreshDoneCh chan bool
 
 	for {
 		select {
+		case <-m.stopCh:
+			logger.Info("stopped processing config changes", "action", "stop")
+			return
 		case configEntry := <-readConfigCh:
 			m.processConfigEntry(configEntry)
-		case response, ok := <-watchConfigCh:
+		case node, ok := <-watchConfigCh:
 			if !ok {
-				watchConfigCh = m.watchConfig()
+				if m.stopping() {
+					continue
+				}
+				metrics.add("lbmanager_etcd_watch_reconnects_total", 1)
+				if err := <-watchErrCh; err == errWatchIndexLost {
+					logger.Warn("config changes lost, reading the config again", "action", "watchConfig")
+					watchConfigCh = nil
+					readConfigCh, readConfigDoneCh = m.rereadConfig()
+					continue
+				}
+				watchConfigCh, watchErrCh = m.watchConfig()
 				continue
 			}
-			configEntry := m.processNodeKey(response.Node.Key, response.Action)
+			if m.processHoldKey(node.key, node.action) || m.processOptionsKey(node) {
+				continue
+			}
+			configEntry := m.processNodeKey(node.key, node.action)
 			if configEntry != nil {
+				configEntry.memberValue = node.value
 				m.processConfigEntry(configEntry)
 			}
-		case <-readConfigDoneCh:
-			for _, lb := range m.loadBalancers {
-				lb.Sync()
+		case err := <-readConfigDoneCh:
+			watchConfigCh, watchErrCh = m.watchConfig()
+			if err == nil {
+				m.SyncAll()
+				if refreshCh == nil && m.refreshInterval > 0 {
+					ticker := time.NewTicker(m.refreshInterval)
+					defer ticker.Stop()
+					refreshCh = ticker.C
+				}
+			}
+		case <-refreshCh:
+			if refreshDoneCh != nil {
+				logger.Debug("addresses refresh still running, skipping this one", "action", "refreshAddresses")
+				continue
 			}
+			refreshDoneCh = make(chan bool)
+			go func(doneCh chan bool) {
+				m.refreshAddresses()
+				close(doneCh)
+			}(refreshDoneCh)
+		case <-refreshDoneCh:
+			refreshDoneCh = nil
 		}
 	}
 }
 
-// Read configuration from etcd
-func (m *Manager) readConfig() (readConfigCh chan *configEntry, doneCh chan bool) {
-	readConfigCh, doneCh = make(chan *configEntry), make(chan bool)
+// Read configuration from the config store, starting at the path provided
+func (m *Manager) readConfig(path string) (readConfigCh chan *configEntry, doneCh chan error) {
+	m.init()
+	readConfigCh, doneCh = make(chan *configEntry), make(chan error, 1)
 	go func() {
-		response, err := m.etcdClient.Get(m.configPath, true, true)
+		nodes, err := m.snapshot(path)
 		if err != nil {
-			log.Println("Initial config not present. Monitoring changes on it from now on..")
+			logger.Warn("initial config not present, monitoring changes on it from now on", "action", "readConfig", "error", err.Error())
 		} else {
-			action := "readingConfig"
-			m.processNode(response.Node, action, readConfigCh)
-			doneCh <- true
+			for _, node := range nodes {
+				node.action = "readingConfig"
+				m.processNode(node, readConfigCh)
+			}
 		}
+		doneCh <- err
 	}()
 	return
 }
 
-// Process config nodes recursively
-func (m *Manager) processNode(node *etcd.Node, action string, readConfigCh chan *configEntry) {
-	if configEntry := m.processNodeKey(node.Key, action); configEntry != nil {
-		readConfigCh <- configEntry
-	}
-	for _, child := range node.Nodes {
-		m.processNode(child, action, readConfigCh)
-	}
+// Read the configuration again once the changes following the state read are no longer available,
+// removing the members, holds and options deleted meanwhile
+func (m *Manager) rereadConfig() (readConfigCh chan *configEntry, doneCh chan error) {
+	readConfigCh, doneCh = make(chan *configEntry), make(chan error, 1)
+	go func() {
+		nodes, err := m.snapshot(m.configPath)
+		if err != nil && err != errKeyNotFound {
+			logger.Error("error reading config again, monitoring changes on it from now on", "action", "readConfig", "error", err.Error())
+			doneCh <- err
+			return
+		}
+		keys := make(map[string]bool, len(nodes))
+		for _, node := range nodes {
+			keys[node.key] = true
+			node.action = "readingConfig"
+			m.processNode(node, readConfigCh)
+		}
+		for _, key := range m.deletedKeys(keys) {
+			m.processNode(&storeNode{action: "delete", key: key}, readConfigCh)
+		}
+		doneCh <- nil
+	}()
+	return
 }
 
-// Check if this node's key is a config entry we might be interested in
-func (m *Manager) processNodeKey(key string, action string) (entry *configEntry) {
-	entry = nil
-	elbRe, _ := regexp.Compile(m.configPath + "/elb/(.*)/(.*)/(.*)/(.*)")
-	route53Re, _ := regexp.Compile(m.configPath + "/route53/(.*)/(.*)/(.*)/(.*)/(.*)")
-	regexps := map[string]*regexp.Regexp{
-		"elb":     elbRe,
-		"route53": route53Re,
+// Get the keys of the members, holds and options in the manager state that aren't among the ones provided
+func (m *Manager) deletedKeys(keys map[string]bool) []string {
+	deleted := []string{}
+	m.mu.RLock()
+	lbs := make([]LoadBalancer, 0, len(m.loadBalancers))
+	for _, lb := range m.loadBalancers {
+		lbs = append(lbs, lb)
 	}
-	for lbType, re := range regexps {
-		if r := re.FindStringSubmatch(key); len(r) > 0 {
-			entry = &configEntry{
-				action:     action,
-				lbType:     lbType,
-				lbMetadata: map[string]string{"region": r[1]},
-			}
-			switch lbType {
-			case "elb":
-				name, class, instance := r[2], r[3], r[4]
-				entry.lbId = lbType + "_" + entry.lbMetadata["region"] + "_" + name
-				entry.memberId = instance
-				entry.lbMetadata["class"] = class
-				entry.lbMetadata["name"] = name
-			case "route53":
-				hostedZone, fqdn, class, ip := r[2], r[3], r[4], r[5]
-				entry.lbId = lbType + "_" + hostedZone + "_" + fqdn
-				entry.memberId = ip
-				entry.lbMetadata["class"] = class
-				entry.lbMetadata["name"] = fqdn
-				entry.lbMetadata["hostedZone"] = hostedZone
+	for lbId := range m.holds {
+		if key := m.configPath + "/" + holdsDir + "/" + lbId; !keys[key] {
+			deleted = append(deleted, key)
+		}
+	}
+	m.mu.RUnlock()
+	for _, lb := range lbs {
+		for _, key := range lb.MemberKeys() {
+			if !keys[key] {
+				deleted = append(deleted, key)
 			}
 		}
 	}
-	return
+	m.optionsMu.Lock()
+	for scope := range m.options {
+		if key := scope + "/" + optionsKey; !keys[key] {
+			deleted = append(deleted, key)
+		}
+	}
+	m.optionsMu.Unlock()
+	sort.Strings(deleted)
+	return deleted
+}
+
+// Read all the keys under a path, resuming the next watch from the changes following them when the
+// store supports it
+func (m *Manager) snapshot(path string) ([]*storeNode, error) {
+	if store, ok := m.store.(snapshotStore); ok {
+		return store.Snapshot(path)
+	}
+	return m.store.List(path)
 }
 
-// Watch etcd for changes in configuration tree
-func (m *Manager) watchConfig() (watchConfigCh chan *etcd.Response) {
-	watchConfigCh = make(chan *etcd.Response)
+// Process a config node read from the config store
+func (m *Manager) processNode(node *storeNode, readConfigCh chan *configEntry) {
+	if m.processHoldKey(node.key, node.action) || m.processOptionsKey(node) {
+		return
+	}
+	if configEntry := m.processNodeKey(node.key, node.action); configEntry != nil {
+		configEntry.memberValue = node.value
+		readConfigCh <- configEntry
+	}
+}
+
+// Check if this node's key is a config entry we might be interested in, that is, a member key of a
+// load balancer type having a backend
+func (m *Manager) processNodeKey(key string, action string) *configEntry {
+	if !strings.HasPrefix(key, m.configPath+"/") {
+		return nil
+	}
+	segments := strings.Split(strings.TrimPrefix(key, m.configPath+"/"), "/")
+	backend := lookupBackend(segments[0])
+	if backend == nil {
+		return nil
+	}
+	entry := backend.parseKey(segments)
+	if entry != nil {
+		entry.action = action
+	}
+	return entry
+}
+
+// Watch the config store for changes in configuration tree. The watch error is sent once the changes
+// channel is closed.
+func (m *Manager) watchConfig() (watchConfigCh chan *storeNode, errCh chan error) {
+	watchConfigCh, errCh = make(chan *storeNode), make(chan error, 1)
 	go func() {
-		_, err := m.etcdClient.Watch(m.configPath, 0, true, watchConfigCh, nil)
-		if err != nil {
-			// go-etcd produces this error when the watcher times out
-			// Just avoiding to print it very often, I don't like this (TODO)
-			if err.Error() != "unexpected end of JSON input" {
-				log.Println(err)
-			}
+		err := m.store.Watch(m.configPath, watchConfigCh, m.stopCh)
+		if err != nil && err != errWatchIndexLost {
+			logger.Error("error watching config", "action", "watchConfig", "error", err.Error())
 		}
+		errCh <- err
 	}()
 	return
 }
 
 // Get a lb from the load balancers registry, creating a new one if it doesn't exist
 func (m *Manager) getLoadBalancer(configEntry *configEntry) (lb LoadBalancer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	var exists bool
 	if lb, exists = m.loadBalancers[configEntry.lbId]; !exists {
-		lbConfig := LB{
-			AwsAuth:    m.awsAuth,
-			ConfigPath: m.configPath,
-			EtcdClient: m.etcdClient,
-			Id:         configEntry.lbId,
-			Type:       configEntry.lbType,
-		}
-		switch configEntry.lbType {
-		case "elb":
-			lb = &Elb{LB: lbConfig}
-		case "route53":
-			zoneUpdaterCh := m.getZoneUpdaterCh(configEntry.lbMetadata["hostedZone"], configEntry.lbMetadata["region"])
-			lb = &Route53{
-				LB:            lbConfig,
-				ZoneUpdaterCh: zoneUpdaterCh,
-			}
+		backend := lookupBackend(configEntry.lbType)
+		if backend == nil {
+			// Plugin removed after its key was processed, its syncs will fail until it's back
+			backend = execBackend
 		}
+		lb = backend.build(m, configEntry)
 		lb.Setup(configEntry.lbMetadata)
 		m.loadBalancers[configEntry.lbId] = lb
 	}
 	return
 }
 
+// Build the common load balancer configuration for a config entry
+func (m *Manager) newLB(configEntry *configEntry) LB {
+	return LB{
+		AwsCredentials: m.credentialsGetter(m.optionsScopes(configEntry.lbType, configEntry.lbMetadata)...),
+		ConfigPath:     m.configPath,
+		DryRun:         m.dryRun,
+		Store:          m.store,
+		Id:             configEntry.lbId,
+		Tracker:        m.tracker,
+		Type:           configEntry.lbType,
+	}
+}
+
+// Stop processing config changes and drain the pending syncs, waiting for them at most the timeout
+// provided. Returns true if all syncs finished in time and the latest sync of every load balancer succeeded.
+func (m *Manager) Stop(timeout time.Duration) bool {
+	m.init()
+	deadline := time.Now().Add(timeout)
+	logger.Info("stopping load balancers manager", "action", "stop", "timeout", timeout.String())
+	close(m.stopCh)
+	select {
+	case <-m.stoppedCh:
+	case <-time.After(timeout):
+		logger.Warn("timeout waiting for config processing to stop", "action", "stop")
+	}
+
+	applied := m.tracker.drain(deadline)
+	if !applied {
+		logger.Error("timeout draining pending syncs", "action", "stop", "pending", m.tracker.pendingSyncs())
+	}
+	for _, status := range m.LoadBalancersStatus() {
+		if status.LastError != "" {
+			logger.Error("latest sync failed", "lb", status.Id, "type", status.Type, "action", "stop", "error", status.LastError)
+			applied = false
+		}
+	}
+	return applied
+}
+
+// Check if the manager is stopping
+func (m *Manager) stopping() bool {
+	select {
+	case <-m.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
 // Process configuration entry received, triggering necessary actions in the load balancer affected
 func (m *Manager) processConfigEntry(configEntry *configEntry) {
 	lb := m.getLoadBalancer(configEntry)
 	lb.SetClass(configEntry.lbMetadata["class"])
+	if setter, ok := lb.(memberValueSetter); ok && (configEntry.action == "readingConfig" || configEntry.action == "set") {
+		setter.SetMemberValue(configEntry.memberId, configEntry.memberValue)
+	}
 	switch configEntry.action {
 	case "readingConfig":
 		lb.AddMember(configEntry.memberId)
 	case "set":
 		lb.AddMember(configEntry.memberId)
-		lb.Sync()
+		m.syncUnlessHeld(configEntry.lbId, lb)
 	case "delete":
 		lb.RemoveMember(configEntry.memberId)
-		lb.Sync()
+		m.syncUnlessHeld(configEntry.lbId, lb)
+	}
+}
+
+// Check if this node's key is a hold on a load balancer, holding or releasing it as needed. While a
+// load balancer is held its state is updated from the config, but it's not synced.
+func (m *Manager) processHoldKey(key string, action string) bool {
+	holdsPath := m.configPath + "/" + holdsDir + "/"
+	if !strings.HasPrefix(key, holdsPath) {
+		return false
+	}
+	lbId := strings.TrimPrefix(key, holdsPath)
+	switch action {
+	case "delete", "expire", "compareAndDelete":
+		m.mu.Lock()
+		delete(m.holds, lbId)
+		lb, exists := m.loadBalancers[lbId]
+		m.mu.Unlock()
+		logger.Info("load balancer released", "lb", lbId, "action", "release")
+		if exists {
+			lb.Sync()
+		}
+	default:
+		m.mu.Lock()
+		m.holds[lbId] = true
+		m.mu.Unlock()
+		logger.Info("load balancer held, syncs paused", "lb", lbId, "action", "hold")
+	}
+	return true
+}
+
+// Sync a load balancer, unless it's being held
+func (m *Manager) syncUnlessHeld(lbId string, lb LoadBalancer) {
+	m.mu.RLock()
+	held := m.holds[lbId]
+	m.mu.RUnlock()
+	if held {
+		logger.Debug("load balancer held, not syncing", "lb", lbId, "action", "sync")
+		return
 	}
+	lb.Sync()
 }
 
-// Get the zone updater channel given a hostedZoneId, creating a new zone updater and a new channel if needed
-func (m *Manager) getZoneUpdaterCh(hostedZoneId string, region string) (zoneUpdaterCh chan *route53.Change) {
+// Get the zone updater given a hostedZoneId, creating a new zone updater if needed
+func (m *Manager) getZoneUpdater(hostedZoneId string, region string) (zoneUpdater *ZoneUpdater) {
 	var exists bool
-	if zoneUpdaterCh, exists = m.zonesUpdatersChs[hostedZoneId]; !exists {
-		log.Printf("-> ZONEUPDATER:%s:settingUpZoneUpdater\n", hostedZoneId)
-		zoneUpdaterCh = make(chan *route53.Change)
-		zoneUpdater := &ZoneUpdater{
-			AwsClient:  route53.New(m.awsAuth, aws.Regions[region]),
-			HostedZone: hostedZoneId,
-			UpdatesCh:  zoneUpdaterCh,
+	if zoneUpdater, exists = m.zonesUpdaters[hostedZoneId]; !exists {
+		logger.Info("setting up zone updater", "action", "setupZoneUpdater", "hostedZone", hostedZoneId)
+		awsRegion, _ := awsEndpoints.region(region)
+		if !awsEndpoints.validRegion("route53", region) {
+			logger.Warn("unknown region and no endpoint provided for it, AWS calls will fail", "action", "setupZoneUpdater", "hostedZone", hostedZoneId, "region", region)
+		}
+		zoneUpdater = &ZoneUpdater{
+			AwsCredentials: m.credentialsGetter(m.optionsScopes("route53", map[string]string{"hostedZone": hostedZoneId, "region": region})...),
+			DryRun:         m.dryRun,
+			HostedZone:     hostedZoneId,
+			Region:         awsRegion,
+			Tracker:        m.tracker,
+			UpdatesCh:      make(chan *zoneUpdate, zoneUpdaterQueueSize),
 		}
 		go func() {
 			zoneUpdater.listen()
 		}()
+		m.zonesUpdaters[hostedZoneId] = zoneUpdater
 	}
-	m.zonesUpdatersChs[hostedZoneId] = zoneUpdaterCh
 	return
 }
+
+// Find a load balancer in the registry by its id
+func (m *Manager) findLoadBalancer(id string) (lb LoadBalancer, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	lb, exists := m.loadBalancers[id]
+	if !exists {
+		err = fmt.Errorf("load balancer not found: %s", id)
+	}
+	return
+}
+
+// Get the state of all the load balancers in the registry, sorted by id
+func (m *Manager) LoadBalancersStatus() []LBStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	statuses := []LBStatus{}
+	for _, lb := range m.loadBalancers {
+		statuses = append(statuses, lb.Status())
+	}
+	sort.Sort(lbStatusesById(statuses))
+	return statuses
+}
+
+// Get the state of all the zone updaters, sorted by hosted zone
+func (m *Manager) ZoneUpdatersStatus() []ZoneUpdaterStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	statuses := []ZoneUpdaterStatus{}
+	for _, zoneUpdater := range m.zonesUpdaters {
+		statuses = append(statuses, zoneUpdater.Status())
+	}
+	sort.Sort(zoneUpdaterStatusesByZone(statuses))
+	return statuses
+}
+
+// Trigger a sync in the load balancer with the given id
+func (m *Manager) SyncLoadBalancer(id string) error {
+	lb, err := m.findLoadBalancer(id)
+	if err != nil {
+		return err
+	}
+	lb.Sync()
+	return nil
+}
+
+// Trigger a sync in all the load balancers in the registry
+func (m *Manager) SyncAll() {
+	m.mu.RLock()
+	lbs := make(map[string]LoadBalancer, len(m.loadBalancers))
+	for lbId, lb := range m.loadBalancers {
+		lbs[lbId] = lb
+	}
+	m.mu.RUnlock()
+	for lbId, lb := range lbs {
+		m.syncUnlessHeld(lbId, lb)
+	}
+}
+
+// Sync the load balancers whose members addresses changed since their latest sync
+func (m *Manager) refreshAddresses() {
+	m.mu.RLock()
+	refreshers := make(map[string]LoadBalancer)
+	for lbId, lb := range m.loadBalancers {
+		if _, ok := lb.(addressRefresher); ok {
+			refreshers[lbId] = lb
+		}
+	}
+	m.mu.RUnlock()
+	for lbId, lb := range refreshers {
+		if lb.(addressRefresher).addressesChanged() && !m.stopping() {
+			logger.Info("members addresses changed", "lb", lbId, "action", "refreshAddresses")
+			m.syncUnlessHeld(lbId, lb)
+		}
+	}
+}
+
+// Get the differences between desired and actual state for the load balancer with the given id
+func (m *Manager) Diff(id string) (*LBDiff, error) {
+	lb, err := m.findLoadBalancer(id)
+	if err != nil {
+		return nil, err
+	}
+	return lb.Diff()
+}
+
+// Update the metrics computed from the current state of load balancers and zone updaters
+func (m *Manager) updateMetrics() {
+	metrics.reset("lbmanager_seconds_since_last_successful_sync")
+	metrics.reset("lbmanager_zone_updater_queue_depth")
+	for _, status := range m.LoadBalancersStatus() {
+		metrics.set("lbmanager_lb_members", float64(len(status.Members)), "lb", status.Id, "type", status.Type, "state", "desired")
+		if !status.LastSuccessfulSync.IsZero() {
+			elapsed := time.Since(status.LastSuccessfulSync).Seconds()
+			metrics.set("lbmanager_seconds_since_last_successful_sync", elapsed, "lb", status.Id, "type", status.Type)
+		}
+	}
+	for _, status := range m.ZoneUpdatersStatus() {
+		for lbId, queued := range status.QueuedByLb {
+			metrics.set("lbmanager_zone_updater_queue_depth", float64(queued), "lb", lbId, "hosted_zone", status.HostedZone)
+		}
+	}
+}
+
+type lbStatusesById []LBStatus
+
+func (s lbStatusesById) Len() int           { return len(s) }
+func (s lbStatusesById) Less(i, j int) bool { return s[i].Id < s[j].Id }
+func (s lbStatusesById) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type zoneUpdaterStatusesByZone []ZoneUpdaterStatus
+
+func (s zoneUpdaterStatusesByZone) Len() int           { return len(s) }
+func (s zoneUpdaterStatusesByZone) Less(i, j int) bool { return s[i].HostedZone < s[j].HostedZone }
+func (s zoneUpdaterStatusesByZone) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
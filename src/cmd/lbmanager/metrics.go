@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mitchellh/goamz/ec2"
+	"github.com/mitchellh/goamz/elb"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics registry exposed in Prometheus text format
+var metrics = newMetricsRegistry()
+
+func init() {
+	metrics.register("lbmanager_lb_members", "gauge", "Number of members per load balancer, as desired in the config and as seen in the real service.")
+	metrics.register("lbmanager_syncs_total", "counter", "Number of sync operations performed per load balancer.")
+	metrics.register("lbmanager_sync_errors_total", "counter", "Number of sync operations that failed per load balancer.")
+	metrics.register("lbmanager_sync_duration_seconds", "summary", "Duration of the sync operations per load balancer.")
+	metrics.register("lbmanager_seconds_since_last_successful_sync", "gauge", "Seconds elapsed since the last successful sync per load balancer.")
+	metrics.register("lbmanager_aws_api_calls_total", "counter", "Number of AWS api calls by operation and result code.")
+	metrics.register("lbmanager_zone_updater_queue_depth", "gauge", "Number of pending updates queued per load balancer in its Route53 hosted zone.")
+	metrics.register("lbmanager_etcd_watch_reconnects_total", "counter", "Number of times the config store watch has been restarted. Not labelled per load balancer, as a single watch covers the whole config tree.")
+	metrics.register("lbmanager_reaped_members_total", "counter", "Number of member keys removed per load balancer as their instances were dead.")
+}
+
+type metricsRegistry struct {
+	families map[string]*metricFamily
+	mu       sync.Mutex
+}
+
+type metricFamily struct {
+	help    string
+	kind    string
+	name    string
+	samples map[string]float64
+}
+
+// Create a new empty metrics registry
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{families: make(map[string]*metricFamily)}
+}
+
+// Register a new metric family
+func (r *metricsRegistry) register(name, kind, help string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families[name] = &metricFamily{
+		help:    help,
+		kind:    kind,
+		name:    name,
+		samples: make(map[string]float64),
+	}
+}
+
+// Add a value to a metric sample (labels are provided as key/value pairs)
+func (r *metricsRegistry) add(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	family, key := r.lookup(name, labels)
+	family.samples[key] += value
+}
+
+// Set a metric sample's value (labels are provided as key/value pairs)
+func (r *metricsRegistry) set(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	family, key := r.lookup(name, labels)
+	family.samples[key] = value
+}
+
+// Remove all samples of a metric family, used for the gauges computed on every scrape
+func (r *metricsRegistry) reset(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families[name].samples = make(map[string]float64)
+}
+
+// Find the family a sample belongs to and the key used to store it (summaries' _sum and _count
+// samples are stored in the summary family, keeping the suffix in the key)
+func (r *metricsRegistry) lookup(name string, labels []string) (*metricFamily, string) {
+	if family, exists := r.families[name]; exists {
+		return family, formatLabels(labels)
+	}
+	for _, suffix := range []string{"_sum", "_count"} {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		if family, exists := r.families[strings.TrimSuffix(name, suffix)]; exists {
+			return family, suffix + formatLabels(labels)
+		}
+	}
+	panic("metric not registered: " + name)
+}
+
+// Record a sync operation's outcome for the given load balancer
+func (r *metricsRegistry) observeSync(lbId, lbType string, seconds float64, err error) {
+	r.add("lbmanager_syncs_total", 1, "lb", lbId, "type", lbType)
+	r.add("lbmanager_sync_duration_seconds_sum", seconds, "lb", lbId, "type", lbType)
+	r.add("lbmanager_sync_duration_seconds_count", 1, "lb", lbId, "type", lbType)
+	if err != nil {
+		r.add("lbmanager_sync_errors_total", 1, "lb", lbId, "type", lbType)
+	}
+}
+
+// Record an AWS api call's result for the given load balancer
+func (r *metricsRegistry) observeAwsCall(lbId, operation string, err error) {
+	r.add("lbmanager_aws_api_calls_total", 1, "lb", lbId, "operation", operation, "code", awsResultCode(err))
+}
+
+// Write all metrics in Prometheus text format
+func (r *metricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var written int64
+	for _, name := range names {
+		family := r.families[name]
+		lines := []string{
+			fmt.Sprintf("# HELP %s %s", family.name, family.help),
+			fmt.Sprintf("# TYPE %s %s", family.name, family.kind),
+		}
+		samples := []string{}
+		for key, value := range family.samples {
+			samples = append(samples, fmt.Sprintf("%s%s %v", family.name, key, value))
+		}
+		sort.Strings(samples)
+		n, err := io.WriteString(w, strings.Join(append(lines, samples...), "\n")+"\n")
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Format labels key/value pairs as expected by Prometheus
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var route53StatusCodeRe = regexp.MustCompile(`got status code: (\d+)`)
+
+// Get the result code of an AWS api call from the error returned
+func awsResultCode(err error) string {
+	switch e := err.(type) {
+	case nil:
+		return "OK"
+	case *elb.Error:
+		if e.Code != "" {
+			return e.Code
+		}
+		return fmt.Sprintf("%d", e.StatusCode)
+	case *ec2.Error:
+		if e.Code != "" {
+			return e.Code
+		}
+		return fmt.Sprintf("%d", e.StatusCode)
+	}
+	if r := route53StatusCodeRe.FindStringSubmatch(err.Error()); len(r) > 0 {
+		return r[1]
+	}
+	return "Error"
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Address of the server rendered in upstreams without members, as nginx requires at least one
+const nginxPlaceholderServer = "127.0.0.1:1"
+
+// Nginx settings shared by all the nginx load balancers
+type nginxOptions struct {
+	checkCmd  string
+	dir       string
+	reloadCmd string
+}
+
+var nginxSettings = &nginxOptions{}
+
+// Serializes the writes, checks and reloads of the nginx configuration
+var nginxMu = &sync.Mutex{}
+
+var nginxUpstreamRe = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+func init() {
+	registerBackend("nginx", &lbBackend{
+		fields:        []string{"name", "class", "member"},
+		usage:         []string{"UPSTREAM", "LB_CLASS", "IP:PORT"},
+		idFields:      []string{"name"},
+		optionsScopes: [][]string{{"name"}},
+		validate: func(k *memberKey) error {
+			if !nginxUpstreamRe.MatchString(k.name) {
+				return fmt.Errorf("invalid nginx upstream name: %s", k.name)
+			}
+			if k.member != "" && !validHostPort(k.member) {
+				return fmt.Errorf("invalid member: %s (IP:PORT)", k.member)
+			}
+			return nil
+		},
+		build: func(m *Manager, configEntry *configEntry) LoadBalancer {
+			return &Nginx{LB: m.newLB(configEntry)}
+		},
+	})
+}
+
+// Load balancer writing a nginx upstream block in its own file. Member keys values may hold the server
+// parameters, as in "weight=3 max_fails=2 backup". After a render changes the file the configuration
+// is tested (restoring the previous file if invalid) and nginx is reloaded.
+type Nginx struct {
+	LB
+	file   *hostConfigFile
+	params map[string]string
+	syncCh chan int
+}
+
+// Setup nginx upstream based load balancer
+func (lb *Nginx) Setup(meta map[string]string) {
+	logger.Info("setting up load balancer state", lb.logFields("action", "setup", "name", meta["name"])...)
+	lb.class = meta["class"]
+	lb.configKey = lb.ConfigPath + "/nginx/" + meta["name"] + "/"
+	lb.file = &hostConfigFile{
+		checkCmd:  nginxSettings.checkCmd,
+		mu:        nginxMu,
+		path:      filepath.Join(nginxSettings.dir, meta["name"]+".conf"),
+		reloadCmd: nginxSettings.reloadCmd,
+	}
+	lb.name = meta["name"]
+	lb.params = make(map[string]string)
+	lb.syncCh = make(chan int)
+	go func() {
+		lb.sync()
+	}()
+}
+
+// Set the server parameters of a member from its key value, ignoring them if they are invalid
+func (lb *Nginx) SetMemberValue(member string, value string) {
+	params, err := parseNginxParams(value)
+	if err != nil {
+		logger.Warn("invalid server parameters, ignoring them", lb.logFields("action", "addMember", "member", member, "error", err.Error())...)
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.params[member] = params
+}
+
+// Remove a member from the load balancer state, along with its server parameters
+func (lb *Nginx) RemoveMember(member string) {
+	lb.LB.RemoveMember(member)
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	delete(lb.params, member)
+}
+
+// Sync state of the load balancer instance with the real service
+func (lb *Nginx) Sync() {
+	if !lb.Tracker.begin() {
+		logger.Warn("shutting down, sync discarded", lb.logFields("action", "sync")...)
+		return
+	}
+	lb.syncCh <- 1
+}
+
+// Get the differences between the load balancer state and the members in the upstream file
+func (lb *Nginx) Diff() (*LBDiff, error) {
+	rendered, err := lb.file.members()
+	if err != nil {
+		return nil, err
+	}
+	return lb.buildDiff(lb.Members(), rendered), nil
+}
+
+// Render the upstream block for the members provided, sorted
+func (lb *Nginx) render(sorted []string) []byte {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "upstream %s {\n", lb.name)
+	for _, member := range sorted {
+		if params := lb.params[member]; params != "" {
+			fmt.Fprintf(buf, "\tserver %s %s;\n", member, params)
+		} else {
+			fmt.Fprintf(buf, "\tserver %s;\n", member)
+		}
+	}
+	if len(sorted) == 0 {
+		fmt.Fprintf(buf, "\t# No members\n\tserver %s down;\n", nginxPlaceholderServer)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// Sync state of the load balancer instance with the real service
+func (lb *Nginx) sync() {
+	for _ = range lb.syncCh {
+		if lb.Tracker.cancelled() {
+			lb.recordSync(time.Now(), errSyncCancelled)
+			lb.Tracker.end()
+			continue
+		}
+		startedAt := time.Now()
+		members := lb.Members()
+		sort.Strings(members)
+		logger.Debug("syncing", lb.logFields("action", "sync", "members", members)...)
+		changed, err := lb.file.apply(&lb.LB, members, lb.render(members))
+		if err != nil {
+			logger.Error("error syncing nginx upstream", lb.logFields("action", "sync", "error", err.Error())...)
+		} else {
+			if changed {
+				logger.Info("nginx upstream updated", lb.logFields("action", "sync", "members", members)...)
+			}
+			lb.recordActualMembers(len(members))
+		}
+		lb.recordSync(startedAt, err)
+		lb.Tracker.end()
+	}
+}
+
+// Parse the server parameters supported in member key values (weight, max_fails and backup), returning
+// them normalized
+func parseNginxParams(value string) (string, error) {
+	params := []string{}
+	for _, field := range strings.Fields(value) {
+		name, arg := field, ""
+		if i := strings.Index(field, "="); i >= 0 {
+			name, arg = field[:i], field[i+1:]
+		}
+		switch name {
+		case "weight":
+			if n, err := strconv.Atoi(arg); err != nil || n < 1 {
+				return "", fmt.Errorf("invalid weight: %s", arg)
+			}
+		case "max_fails":
+			if n, err := strconv.Atoi(arg); err != nil || n < 0 {
+				return "", fmt.Errorf("invalid max_fails: %s", arg)
+			}
+		case "backup":
+			if arg != "" {
+				return "", fmt.Errorf("backup doesn't take a value")
+			}
+		default:
+			return "", fmt.Errorf("unsupported parameter: %s (weight|max_fails|backup)", name)
+		}
+		params = append(params, field)
+	}
+	return strings.Join(params, " "), nil
+}
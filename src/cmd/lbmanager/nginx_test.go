@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestNginxRemoveMemberParams(t *testing.T) {
+	lb := &Nginx{LB: LB{class: "multiple", name: "api"}, params: make(map[string]string)}
+	lb.SetMemberValue("10.0.0.1:80", "weight=2")
+	lb.AddMember("10.0.0.1:80")
+	lb.RemoveMember("10.0.0.1:80")
+	if _, exists := lb.params["10.0.0.1:80"]; exists {
+		t.Errorf("got params %v, want the removed member's ones deleted", lb.params)
+	}
+	// A member added back without a value doesn't get its old parameters
+	lb.AddMember("10.0.0.1:80")
+	want := "upstream api {\n\tserver 10.0.0.1:80;\n}\n"
+	if got := string(lb.render(lb.Members())); got != want {
+		t.Errorf("got upstream:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// Name of the keys holding the options of a region, load balancer or hosted zone in the configuration tree
+const optionsKey = "_options"
+
+// Options set in an options key, as JSON: the AWS account used, the webhook load balancers URL and the
+// DNS server, TSIG key and records TTL of the dnsupdate zones
+type lbOptions struct {
+	DnsServer       string `json:"dnsServer"`
+	DnsTsigKey      string `json:"dnsTsigKey"`
+	DnsTtl          uint32 `json:"dnsTtl"`
+	ExternalId      string `json:"externalId"`
+	InstanceAddress string `json:"instanceAddress"`
+	Profile         string `json:"profile"`
+	RoleArn         string `json:"roleArn"`
+	WebhookUrl      string `json:"webhookUrl"`
+}
+
+// Process the node provided if it's an options key, returning true in that case
+func (m *Manager) processOptionsKey(node *storeNode) bool {
+	if !strings.HasPrefix(node.key, m.configPath+"/") {
+		return false
+	}
+	switch node.action {
+	case "delete", "expire", "compareAndDelete":
+		// Deleting a directory removes the options set in it as well
+		scope := strings.TrimSuffix(node.key, "/"+optionsKey)
+		m.optionsMu.Lock()
+		for s := range m.options {
+			if s == scope || strings.HasPrefix(s, node.key+"/") {
+				delete(m.options, s)
+				logger.Info("options removed", "action", "setOptions", "scope", s)
+			}
+		}
+		m.optionsMu.Unlock()
+		return strings.HasSuffix(node.key, "/"+optionsKey)
+	}
+	if node.dir || !strings.HasSuffix(node.key, "/"+optionsKey) {
+		return false
+	}
+	scope := strings.TrimSuffix(node.key, "/"+optionsKey)
+	options := &lbOptions{}
+	if err := json.Unmarshal([]byte(node.value), options); err != nil {
+		logger.Error("invalid options", "action", "setOptions", "scope", scope, "error", err.Error())
+		return true
+	}
+	m.optionsMu.Lock()
+	m.options[scope] = options
+	m.optionsMu.Unlock()
+	logger.Info("options set", "action", "setOptions", "scope", scope, "profile", options.Profile, "role", options.RoleArn)
+	return true
+}
+
+// Read the options keys in the configuration tree, for commands accessing AWS without running the manager
+func (m *Manager) loadOptions() error {
+	m.init()
+	nodes, err := m.store.List(m.configPath)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		m.processOptionsKey(node)
+	}
+	return nil
+}
+
+// Get the AWS credentials to use in the scopes provided (paths in the configuration tree, from the most
+// specific one), following the options set in the first of them having them
+func (m *Manager) credentialsFor(scopes ...string) *credentials.Credentials {
+	m.optionsMu.Lock()
+	defer m.optionsMu.Unlock()
+	var options *lbOptions
+	for _, scope := range scopes {
+		if options = m.options[scope]; options != nil {
+			break
+		}
+	}
+	if options == nil || (options.Profile == "" && options.RoleArn == "") {
+		return m.awsCredentials
+	}
+	cacheKey := options.Profile + "|" + options.RoleArn + "|" + options.ExternalId
+	if creds, exists := m.accountsCredentials[cacheKey]; exists {
+		return creds
+	}
+	creds := m.awsCredentials
+	if options.Profile != "" {
+		creds = credentials.NewCredentials(&credentials.SharedCredentialsProvider{Profile: options.Profile})
+	}
+	if options.RoleArn != "" {
+		creds = credentials.NewCredentials(&assumeRoleProvider{
+			client:     newStsClient(creds),
+			externalId: options.ExternalId,
+			roleArn:    options.RoleArn,
+		})
+	}
+	m.accountsCredentials[cacheKey] = creds
+	return creds
+}
+
+// Get the paths in the configuration tree whose options apply to a load balancer, from the most specific one,
+// as declared by its backend
+func (m *Manager) optionsScopes(lbType string, meta map[string]string) []string {
+	backend := lookupBackend(lbType)
+	if backend == nil {
+		backend = execBackend
+	}
+	return backend.scopes(m.configPath, lbType, meta)
+}
+
+// Get the options set in the first of the scopes provided having them, or nil if there are none
+func (m *Manager) optionsFor(scopes ...string) *lbOptions {
+	m.optionsMu.Lock()
+	defer m.optionsMu.Unlock()
+	for _, scope := range scopes {
+		if options := m.options[scope]; options != nil {
+			return options
+		}
+	}
+	return nil
+}
+
+// Build the function getting the credentials for a load balancer or zone updater, looked up when used so
+// that options changes are applied
+func (m *Manager) credentialsGetter(scopes ...string) func() *credentials.Credentials {
+	return func() *credentials.Credentials {
+		return m.credentialsFor(scopes...)
+	}
+}
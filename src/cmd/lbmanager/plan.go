@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Read the configuration starting at the path provided and compute the changes needed in every load
+// balancer found, without applying them
+func (m *Manager) Plan(path string) ([]*LBDiff, error) {
+	m.init()
+	m.dryRun = true
+	if path != m.configPath {
+		// Options may be set in parent paths
+		if err := m.loadOptions(); err != nil {
+			return nil, err
+		}
+	}
+	readConfigCh, readConfigDoneCh := m.readConfig(path)
+	for {
+		select {
+		case configEntry := <-readConfigCh:
+			m.processConfigEntry(configEntry)
+		case err := <-readConfigDoneCh:
+			if err != nil {
+				return nil, err
+			}
+			diffs := []*LBDiff{}
+			for _, status := range m.LoadBalancersStatus() {
+				diff, err := m.Diff(status.Id)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s", status.Id, err)
+				}
+				diffs = append(diffs, diff)
+			}
+			return diffs, nil
+		}
+	}
+}
+
+// Print the changes that would be applied to every load balancer
+func printPlan(w io.Writer, m *Manager, diffs []*LBDiff) {
+	changes := 0
+	for _, diff := range diffs {
+		lb, err := m.findLoadBalancer(diff.Id)
+		if err != nil {
+			continue
+		}
+		status := lb.Status()
+		fmt.Fprintf(w, "%s (%s, %s)\n", diff.Id, diff.Type, status.Class)
+		if len(diff.ToAdd) == 0 && len(diff.ToRemove) == 0 {
+			fmt.Fprintf(w, "  = no changes %v\n", diff.Actual)
+			continue
+		}
+		changes++
+		switch diff.Type {
+		case "route53":
+			fmt.Fprintf(w, "  ~ upsert A %s [%s]\n", status.Name, strings.Join(diff.Desired, " "))
+			for _, member := range diff.ToAdd {
+				fmt.Fprintf(w, "    + %s\n", member)
+			}
+			for _, member := range diff.ToRemove {
+				fmt.Fprintf(w, "    - %s\n", member)
+			}
+		default:
+			for _, member := range diff.ToAdd {
+				fmt.Fprintf(w, "  + register %s\n", member)
+			}
+			for _, member := range diff.ToRemove {
+				fmt.Fprintf(w, "  - deregister %s\n", member)
+			}
+		}
+	}
+	fmt.Fprintf(w, "\n%d load balancers, %d with changes\n", len(diffs), changes)
+}
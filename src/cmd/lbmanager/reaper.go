@@ -0,0 +1,234 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// Load balancers whose members are EC2 instances, set as instance ids or as addresses of the instances.
+// Members are checked by the reaper with the DescribeInstances filters returned for each of them.
+type reapable interface {
+	reapFilters() (lb *LB, filters map[string][]string)
+}
+
+// States of the instances whose members are reaped
+var reapedStates = map[string]bool{"shutting-down": true, "terminated": true}
+
+// Removes the member keys of the instances terminated, or no longer found, for longer than the grace
+// period, as their keys are left behind when they die without running their cleanup. Members set as
+// addresses are only reaped once they have been seen on an instance, as they may not belong to EC2
+// instances at all.
+type Reaper struct {
+	Grace     time.Duration
+	Interval  time.Duration
+	Manager   *Manager
+	deadSince map[string]time.Time
+	instances map[string]string
+}
+
+// Start checking the members of the load balancers periodically
+func (r *Reaper) Start() {
+	r.deadSince = make(map[string]time.Time)
+	r.instances = make(map[string]string)
+	logger.Info("reaper running", "action", "startReaper", "interval", r.Interval.String(), "grace", r.Grace.String())
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for _ = range ticker.C {
+		if r.Manager.stopping() {
+			return
+		}
+		r.reap()
+	}
+}
+
+// Check the members of the load balancers whose members are EC2 instances, removing the keys of the ones
+// whose instances have been dead for longer than the grace period
+func (r *Reaper) reap() {
+	r.Manager.mu.RLock()
+	lbs := []reapable{}
+	for _, lb := range r.Manager.loadBalancers {
+		if lb, ok := lb.(reapable); ok {
+			lbs = append(lbs, lb)
+		}
+	}
+	r.Manager.mu.RUnlock()
+	checked := make(map[string]bool)
+	for _, reapableLb := range lbs {
+		lb, filters := reapableLb.reapFilters()
+		for member := range filters {
+			checked[lb.Id+"/"+member] = true
+		}
+		dead, err := r.deadMembers(lb, filters)
+		if err != nil {
+			logger.Error("error checking members instances", lb.logFields("action", "reap", "error", err.Error())...)
+			continue
+		}
+		for member := range filters {
+			key := lb.Id + "/" + member
+			instance, isDead := dead[member]
+			if !isDead {
+				delete(r.deadSince, key)
+				continue
+			}
+			state := "missing"
+			if instance.State.Name != "" {
+				state = instance.State.Name
+			}
+			since, exists := r.deadSince[key]
+			if !exists {
+				logger.Info("member instance dead, reaping it after the grace period", lb.logFields("action", "reap", "member", member, "instance", instance.InstanceId, "state", state)...)
+				r.deadSince[key] = time.Now()
+			} else if time.Since(since) >= r.Grace && r.reapMember(lb, member, instance.InstanceId, state) {
+				delete(r.deadSince, key)
+			}
+		}
+	}
+	for key := range r.deadSince {
+		if !checked[key] {
+			delete(r.deadSince, key)
+		}
+	}
+}
+
+// Get the members of a load balancer whose instances are terminated or no longer exist, along with their
+// instances (only their id is set when they no longer exist)
+func (r *Reaper) deadMembers(lb *LB, filters map[string][]string) (map[string]ec2.Instance, error) {
+	// Instances matching each member, by filter and value
+	values := make(map[string][]string)
+	for member, memberFilters := range filters {
+		for _, filterName := range memberFilters {
+			values[filterName] = append(values[filterName], member)
+		}
+	}
+	matches := make(map[string]map[string]ec2.Instance)
+	for filterName := range values {
+		if err := r.describe(lb, filterName, values[filterName], matches); err != nil {
+			return nil, err
+		}
+	}
+	// Members set as addresses not found on a live instance are checked against the instance they were
+	// last seen on
+	found := make(map[string]ec2.Instance)
+	recheck := []string{}
+	for member, memberFilters := range filters {
+		for _, filterName := range memberFilters {
+			if instance, ok := matches[filterName][member]; ok && (found[member].InstanceId == "" || reapedStates[found[member].State.Name]) {
+				found[member] = instance
+			}
+		}
+		instance, ok := found[member]
+		if ok && !reapedStates[instance.State.Name] {
+			r.instances[lb.region+"/"+member] = instance.InstanceId
+		} else if instanceId := r.instances[lb.region+"/"+member]; instanceId != "" && instanceId != member {
+			recheck = append(recheck, instanceId)
+		}
+	}
+	if len(recheck) > 0 {
+		if err := r.describe(lb, "instance-id", recheck, matches); err != nil {
+			return nil, err
+		}
+	}
+	dead := make(map[string]ec2.Instance)
+	for member := range filters {
+		instance, ok := found[member]
+		if ok && !reapedStates[instance.State.Name] {
+			continue
+		}
+		if instanceId := r.instances[lb.region+"/"+member]; instanceId != "" && instanceId != member {
+			if instance, ok = matches["instance-id"][instanceId]; !ok {
+				instance = ec2.Instance{InstanceId: instanceId}
+			}
+			if !reapedStates[instance.State.Name] && instance.State.Name != "" {
+				continue
+			}
+		} else if !ok && !instanceIdRe.MatchString(member) {
+			continue
+		} else if !ok {
+			instance = ec2.Instance{InstanceId: member}
+		}
+		dead[member] = instance
+	}
+	return dead, nil
+}
+
+// Describe the instances matching the values of a filter in any state, adding them to the matches
+// provided, by filter and value. Live instances are kept over dead ones having the same address.
+func (r *Reaper) describe(lb *LB, filterName string, values []string, matches map[string]map[string]ec2.Instance) error {
+	instances, err := describeInstances(lb, filterName, values)
+	if err != nil {
+		return err
+	}
+	if matches[filterName] == nil {
+		matches[filterName] = make(map[string]ec2.Instance)
+	}
+	for _, instance := range instances {
+		value := instanceFilterValue(instance, filterName)
+		if existing, ok := matches[filterName][value]; !ok || reapedStates[existing.State.Name] {
+			matches[filterName][value] = instance
+		}
+	}
+	return nil
+}
+
+// Remove the key of a member whose instance is dead, returning true if it's removed
+func (r *Reaper) reapMember(lb *LB, member string, instanceId string, state string) bool {
+	key := lb.configKey + lb.Status().Class + "/" + member
+	if r.Manager.dryRun {
+		logger.Info("dry run, not reaping member", lb.logFields("action", "reap", "member", member, "instance", instanceId, "state", state, "key", key)...)
+		return false
+	}
+	if err := r.Manager.store.Delete(key, false); err != nil {
+		logger.Error("error reaping member", lb.logFields("action", "reap", "member", member, "key", key, "error", err.Error())...)
+		return false
+	}
+	logger.Info("member reaped", lb.logFields("action", "reap", "member", member, "instance", instanceId, "state", state, "key", key)...)
+	metrics.add("lbmanager_reaped_members_total", 1, "lb", lb.Id, "type", lb.Type)
+	return true
+}
+
+// Get the value of an instance matched by a DescribeInstances filter
+func instanceFilterValue(instance ec2.Instance, filterName string) string {
+	switch filterName {
+	case "instance-id":
+		return instance.InstanceId
+	case "ip-address":
+		return instance.PublicIpAddress
+	case "private-ip-address":
+		return instance.PrivateIpAddress
+	default:
+		return instance.PrivateDNSName
+	}
+}
+
+// Get the filters matching the instances of ELB members, set as instance ids, private IPs or private
+// DNS names
+func (lb *Elb) reapFilters() (*LB, map[string][]string) {
+	filters := make(map[string][]string)
+	for _, member := range lb.Members() {
+		switch {
+		case instanceIdRe.MatchString(member):
+			filters[member] = []string{"instance-id"}
+		case net.ParseIP(member) != nil:
+			filters[member] = []string{"private-ip-address"}
+		default:
+			filters[member] = []string{"private-dns-name"}
+		}
+	}
+	return &lb.LB, filters
+}
+
+// Get the filters matching the instances of Route53 members, set as instance ids or as their public or
+// private IPs
+func (lb *Route53) reapFilters() (*LB, map[string][]string) {
+	filters := make(map[string][]string)
+	for _, member := range lb.Members() {
+		if instanceIdRe.MatchString(member) {
+			filters[member] = []string{"instance-id"}
+		} else {
+			filters[member] = []string{"ip-address", "private-ip-address"}
+		}
+	}
+	return &lb.LB, filters
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReaperDeadMembers(t *testing.T) {
+	fake := newFakeAws(t)
+	lb := &LB{AwsCredentials: fakeAwsCredentials, Id: "elb_local-1_web", region: fakeAwsRegion}
+
+	tests := []struct {
+		name      string
+		instances []fakeInstance
+		filters   map[string][]string
+		seen      map[string]string
+		dead      []string
+		wantSeen  map[string]string
+		requests  int
+	}{
+		{
+			name:      "instance terminated",
+			instances: []fakeInstance{{id: "i-11111111", state: "terminated"}},
+			filters:   map[string][]string{"i-11111111": {"instance-id"}},
+			dead:      []string{"i-11111111=i-11111111/terminated"},
+			requests:  1,
+		},
+		{
+			name:      "instance running",
+			instances: []fakeInstance{{id: "i-11111111", state: "running"}},
+			filters:   map[string][]string{"i-11111111": {"instance-id"}},
+			wantSeen:  map[string]string{"i-11111111": "i-11111111"},
+			requests:  1,
+		},
+		{
+			name:     "instance missing entirely",
+			filters:  map[string][]string{"i-11111111": {"instance-id"}},
+			dead:     []string{"i-11111111=i-11111111/"},
+			requests: 1,
+		},
+		{
+			name:     "address never seen on an instance",
+			filters:  map[string][]string{"10.0.0.1": {"private-ip-address"}},
+			requests: 1,
+		},
+		{
+			name:      "address of a terminated instance",
+			instances: []fakeInstance{{id: "i-11111111", state: "terminated", privateIp: "10.0.0.1"}},
+			filters:   map[string][]string{"10.0.0.1": {"private-ip-address"}},
+			dead:      []string{"10.0.0.1=i-11111111/terminated"},
+			requests:  1,
+		},
+		{
+			name: "address reused by a new live instance",
+			instances: []fakeInstance{
+				{id: "i-11111111", state: "terminated", privateIp: "10.0.0.1"},
+				{id: "i-22222222", state: "running", privateIp: "10.0.0.1"},
+			},
+			filters:  map[string][]string{"10.0.0.1": {"private-ip-address"}},
+			seen:     map[string]string{"10.0.0.1": "i-11111111"},
+			wantSeen: map[string]string{"10.0.0.1": "i-22222222"},
+			requests: 1,
+		},
+		{
+			name:      "public address of a live instance",
+			instances: []fakeInstance{{id: "i-11111111", state: "running", privateIp: "10.0.0.1", publicIp: "54.0.0.1"}},
+			filters:   map[string][]string{"54.0.0.1": {"ip-address", "private-ip-address"}},
+			wantSeen:  map[string]string{"54.0.0.1": "i-11111111"},
+			requests:  2,
+		},
+		{
+			name:      "recheck against the last seen instance, terminated",
+			instances: []fakeInstance{{id: "i-11111111", state: "terminated"}},
+			filters:   map[string][]string{"10.0.0.1": {"private-ip-address"}},
+			seen:      map[string]string{"10.0.0.1": "i-11111111"},
+			dead:      []string{"10.0.0.1=i-11111111/terminated"},
+			wantSeen:  map[string]string{"10.0.0.1": "i-11111111"},
+			requests:  2,
+		},
+		{
+			name:      "recheck against the last seen instance, stopped",
+			instances: []fakeInstance{{id: "i-11111111", state: "stopped", privateIp: "10.0.0.2"}},
+			filters:   map[string][]string{"10.0.0.1": {"private-ip-address"}},
+			seen:      map[string]string{"10.0.0.1": "i-11111111"},
+			wantSeen:  map[string]string{"10.0.0.1": "i-11111111"},
+			requests:  2,
+		},
+		{
+			name:     "recheck against the last seen instance, missing entirely",
+			filters:  map[string][]string{"10.0.0.1": {"private-ip-address"}},
+			seen:     map[string]string{"10.0.0.1": "i-11111111"},
+			dead:     []string{"10.0.0.1=i-11111111/"},
+			wantSeen: map[string]string{"10.0.0.1": "i-11111111"},
+			requests: 2,
+		},
+	}
+	for _, test := range tests {
+		fake.setInstances(test.instances...)
+		r := &Reaper{deadSince: make(map[string]time.Time), instances: make(map[string]string)}
+		for member, instanceId := range test.seen {
+			r.instances[fakeAwsRegion+"/"+member] = instanceId
+		}
+		dead, err := r.deadMembers(lb, test.filters)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		got := []string{}
+		for member, instance := range dead {
+			got = append(got, fmt.Sprintf("%s=%s/%s", member, instance.InstanceId, instance.State.Name))
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(test.dead, " ") {
+			t.Errorf("%s: got dead members %v, want %v", test.name, got, test.dead)
+		}
+		wantSeen := map[string]string{}
+		for member, instanceId := range test.wantSeen {
+			wantSeen[fakeAwsRegion+"/"+member] = instanceId
+		}
+		if fmt.Sprint(r.instances) != fmt.Sprint(wantSeen) {
+			t.Errorf("%s: got instances seen %v, want %v", test.name, r.instances, wantSeen)
+		}
+		if requests := fake.takeRequests(); len(requests) != test.requests {
+			t.Errorf("%s: got requests %v, want %d DescribeInstances calls", test.name, requests, test.requests)
+		}
+	}
+}
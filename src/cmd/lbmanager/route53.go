@@ -1,45 +1,291 @@
 package main
 
 import (
+	"fmt"
 	"github.com/mitchellh/goamz/route53"
-	"log"
+	"net"
+	"regexp"
+	"strings"
+	"time"
 )
 
+var (
+	hostedZoneRe = regexp.MustCompile(`^[A-Z0-9]{1,32}$`)
+	fqdnRe       = regexp.MustCompile(`^(\*\.)?([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z][a-z0-9-]*[a-z0-9]$`)
+)
+
+func init() {
+	registerBackend("route53", &lbBackend{
+		fields:   []string{"region", "hostedZone", "name", "class", "member"},
+		usage:    []string{"REGION", "HOSTED_ZONE", "FQDN", "LB_CLASS", "MEMBER"},
+		idFields: []string{"hostedZone", "name"},
+		// Updates are applied per hosted zone, so they use the options of their hosted zone
+		optionsScopes: [][]string{{"region", "hostedZone"}, {"region"}},
+		validate: func(k *memberKey) error {
+			if err := k.validateRegion(); err != nil {
+				return err
+			}
+			if !hostedZoneRe.MatchString(k.hostedZone) {
+				return fmt.Errorf("invalid hosted zone id: %s", k.hostedZone)
+			}
+			if !fqdnRe.MatchString(k.name) {
+				return fmt.Errorf("invalid fqdn: %s (lowercase and without trailing dot)", k.name)
+			}
+			if ip := net.ParseIP(k.member); k.member != "" && (ip == nil || ip.To4() == nil) && !instanceIdRe.MatchString(k.member) {
+				return fmt.Errorf("invalid member: %s (IPv4 address or instance id)", k.member)
+			}
+			return nil
+		},
+		build: func(m *Manager, configEntry *configEntry) LoadBalancer {
+			scopes := m.optionsScopes(configEntry.lbType, configEntry.lbMetadata)
+			return &Route53{
+				LB:          m.newLB(configEntry),
+				Options:     func() *lbOptions { return m.optionsFor(scopes...) },
+				ZoneUpdater: m.getZoneUpdater(configEntry.lbMetadata["hostedZone"], configEntry.lbMetadata["region"]),
+			}
+		},
+	})
+}
+
+// Load balancer keeping an A record set in a Route53 hosted zone. Members may be set as instance ids,
+// resolved to the public or private IPs of the instances (as set in the instanceAddress option) on every
+// sync, before queuing the update, and checked periodically for changes.
 type Route53 struct {
 	LB
-	ZoneUpdaterCh chan *route53.Change
-	hostedZone    string
+	Options     func() *lbOptions
+	ZoneUpdater *ZoneUpdater
+	addresses   []string
+	hostedZone  string
+	queued      uint64
+	syncCh      chan int
 }
 
 // Setup Route53 dns based load balancer
 func (lb *Route53) Setup(meta map[string]string) {
-	log.Printf("-> ROUTE53:%s:%s:settingUpLoadBalancerState\n", meta["hostedZone"], meta["name"])
+	logger.Info("setting up load balancer state", lb.logFields("action", "setup", "name", meta["name"], "hostedZone", meta["hostedZone"])...)
 	lb.class = meta["class"]
 	lb.configKey = lb.ConfigPath + "/route53/" + meta["region"] + "/" + meta["hostedZone"] + "/" + meta["name"] + "/"
 	lb.hostedZone = meta["hostedZone"]
 	lb.name = meta["name"]
 	lb.region = meta["region"]
+	lb.syncCh = make(chan int)
+	go func() {
+		lb.sync()
+	}()
 }
 
 // Sync state of the load balancer instance with the real service
 func (lb *Route53) Sync() {
-	if len(lb.members) > 0 {
-		log.Printf("-- ROUTE53:%s:syncing:%s\n", lb.name, lb.members)
-		lb.ZoneUpdaterCh <- lb.getRecordSet()
-	} else {
-		log.Printf("-- ROUTE53:%s:syncing:noMembersInLB\n", lb.name)
+	if len(lb.Members()) == 0 {
+		logger.Debug("no members in load balancer, nothing to sync", lb.logFields("action", "sync")...)
+		return
+	}
+	if !lb.Tracker.begin() {
+		logger.Warn("shutting down, sync discarded", lb.logFields("action", "sync")...)
+		return
+	}
+	lb.syncCh <- 1
+}
+
+// Queue the updates of the record set in the zone updater, resolving the members set as instance ids
+// first so that the updates of other load balancers in the hosted zone don't wait for them
+func (lb *Route53) sync() {
+	for _ = range lb.syncCh {
+		if lb.Tracker.cancelled() {
+			lb.recordSync(time.Now(), errSyncCancelled)
+			lb.Tracker.end()
+			continue
+		}
+		members := lb.Members()
+		logger.Debug("syncing", lb.logFields("action", "sync", "members", members)...)
+		update := &zoneUpdate{change: lb.getRecordSet(members), lbId: lb.Id}
+		var unresolvedErr error
+		if hasInstanceIds(members) {
+			startedAt := time.Now()
+			addresses, unresolved, err := lb.resolveAddresses(members)
+			if err != nil {
+				logger.Error("error resolving instances addresses", lb.logFields("action", "sync", "error", err.Error())...)
+				lb.recordSync(startedAt, err)
+				lb.Tracker.end()
+				continue
+			}
+			lb.recordUnresolved(unresolved)
+			if len(unresolved) > 0 {
+				unresolvedErr = fmt.Errorf("instances not found in %s or without a %s IP: %s", lb.region, lb.addressKind(), strings.Join(unresolved, " "))
+				logger.Warn("instances not found, not setting their addresses", lb.logFields("action", "sync", "members", unresolved)...)
+			}
+			if len(addresses) == 0 {
+				// Record sets are left untouched when there are no members to set in them
+				lb.recordSync(startedAt, unresolvedErr)
+				lb.Tracker.end()
+				continue
+			}
+			update.change.Record.Records = addresses
+		} else {
+			lb.recordUnresolved(nil)
+		}
+		// Updates are applied in the order they are queued, but the addresses of an update still queued
+		// may be outdated by the time it's picked up, so only the latest one is applied
+		lb.mu.Lock()
+		lb.queued++
+		queued := lb.queued
+		lb.mu.Unlock()
+		update.superseded = func() bool {
+			lb.mu.Lock()
+			defer lb.mu.Unlock()
+			return lb.queued != queued
+		}
+		update.done = func(startedAt time.Time, actualMembers int, err error) {
+			if err == errUpdateSuperseded {
+				// The sync is recorded by the update superseding this one
+				lb.Tracker.end()
+				return
+			}
+			if err == nil {
+				lb.mu.Lock()
+				lb.addresses = update.change.Record.Records
+				lb.mu.Unlock()
+				err = unresolvedErr
+			}
+			lb.recordActualMembers(actualMembers)
+			lb.recordSync(startedAt, err)
+			lb.Tracker.end()
+		}
+		lb.ZoneUpdater.enqueue(update)
+	}
+}
+
+// Get a snapshot of the load balancer's state, including the addresses set in the record set when
+// members are set as instance ids
+func (lb *Route53) Status() LBStatus {
+	status := lb.LB.Status()
+	if hasInstanceIds(status.Members) {
+		lb.mu.Lock()
+		status.Addresses = append([]string{}, lb.addresses...)
+		lb.mu.Unlock()
+	}
+	return status
+}
+
+// Get the differences between the load balancer state and the record set in AWS Route53
+func (lb *Route53) Diff() (*LBDiff, error) {
+	resourceRecords, err := lb.ZoneUpdater.getResourceRecords(lb.Id, lb.name)
+	if err != nil {
+		return nil, err
+	}
+	if resourceRecords == nil {
+		resourceRecords = []string{}
+	}
+	members := lb.Members()
+	if hasInstanceIds(members) {
+		if members, _, err = lb.resolveAddresses(members); err != nil {
+			return nil, err
+		}
+	}
+	diff := lb.buildDiff(members, resourceRecords)
+	if len(diff.Desired) == 0 {
+		// Record sets are left untouched when there are no members in the load balancer
+		diff.ToAdd, diff.ToRemove = []string{}, []string{}
+	}
+	return diff, nil
+}
+
+// Resolve the members set as instance ids to the current addresses of their instances, returning the
+// addresses of the members along with the instances not found
+func (lb *Route53) resolveAddresses(members []string) (addresses []string, unresolved []string, err error) {
+	instanceIds := []string{}
+	for _, member := range members {
+		if instanceIdRe.MatchString(member) {
+			instanceIds = append(instanceIds, member)
+		}
+	}
+	resolved := map[string]string{}
+	if len(instanceIds) > 0 {
+		var private bool
+		if private, err = lb.privateAddresses(); err != nil {
+			return nil, nil, err
+		}
+		if resolved, unresolved, err = instanceAddresses(&lb.LB, instanceIds, private); err != nil {
+			return nil, nil, err
+		}
+	}
+	addresses = []string{}
+	for _, member := range members {
+		if instanceIdRe.MatchString(member) {
+			if member = resolved[member]; member == "" {
+				continue
+			}
+		}
+		if !lb.memberExists(member, addresses) {
+			addresses = append(addresses, member)
+		}
+	}
+	return addresses, unresolved, nil
+}
+
+// Get the address a member is set as in the record set
+func (lb *Route53) resolveMember(member string) (string, error) {
+	addresses, _, err := lb.resolveAddresses([]string{member})
+	if err != nil || len(addresses) == 0 {
+		return member, err
+	}
+	return addresses[0], nil
+}
+
+// Check if the addresses of the members set as instance ids changed since the latest update of the
+// record set
+func (lb *Route53) addressesChanged() bool {
+	members := lb.Members()
+	if !hasInstanceIds(members) {
+		return false
+	}
+	addresses, _, err := lb.resolveAddresses(members)
+	if err != nil {
+		logger.Error("error resolving instances addresses", lb.logFields("action", "refreshAddresses", "error", err.Error())...)
+		return false
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return len(addresses) > 0 && !sameRecords(addresses, lb.addresses)
+}
+
+// Check if the instances addresses to use are the private ones, as set in the instanceAddress option
+func (lb *Route53) privateAddresses() (bool, error) {
+	switch kind := lb.addressKind(); kind {
+	case "public", "private":
+		return kind == "private", nil
+	default:
+		return false, fmt.Errorf("invalid instanceAddress option: %s (public or private)", kind)
+	}
+}
+
+// Get the kind of instances addresses set in the instanceAddress option, public by default
+func (lb *Route53) addressKind() string {
+	if options := lb.Options(); options != nil && options.InstanceAddress != "" {
+		return options.InstanceAddress
+	}
+	return "public"
+}
+
+// Check if any of the members provided is set as an instance id
+func hasInstanceIds(members []string) bool {
+	for _, member := range members {
+		if instanceIdRe.MatchString(member) {
+			return true
+		}
 	}
+	return false
 }
 
 // Generate a record set change that represents current load balancer's state
-func (lb *Route53) getRecordSet() *route53.Change {
+func (lb *Route53) getRecordSet(members []string) *route53.Change {
 	return &route53.Change{
 		Action: "UPSERT",
 		Record: route53.ResourceRecordSet{
 			Name:    lb.name,
 			Type:    "A",
 			TTL:     60,
-			Records: lb.members,
+			Records: members,
 		},
 	}
 }
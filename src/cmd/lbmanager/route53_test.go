@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoute53ResolveAddresses(t *testing.T) {
+	fake := newFakeAws(t)
+	fake.setInstances(
+		fakeInstance{id: "i-11111111", state: "running", privateIp: "10.0.0.1", publicIp: "203.0.113.1"},
+		fakeInstance{id: "i-22222222", state: "pending", privateIp: "10.0.0.2"},
+		fakeInstance{id: "i-33333333", state: "terminated", privateIp: "10.0.0.3", publicIp: "203.0.113.3"},
+	)
+	members := []string{"i-11111111", "i-22222222", "i-33333333", "i-44444444", "10.0.0.1", "198.51.100.1"}
+
+	tests := []struct {
+		name            string
+		instanceAddress string
+		addresses       []string
+		unresolved      []string
+		err             string
+	}{
+		{
+			name:       "public addresses by default",
+			addresses:  []string{"203.0.113.1", "10.0.0.1", "198.51.100.1"},
+			unresolved: []string{"i-22222222", "i-33333333", "i-44444444"},
+		},
+		{
+			name:            "private addresses",
+			instanceAddress: "private",
+			addresses:       []string{"10.0.0.1", "10.0.0.2", "198.51.100.1"},
+			unresolved:      []string{"i-33333333", "i-44444444"},
+		},
+		{
+			name:            "invalid address kind",
+			instanceAddress: "elastic",
+			err:             "invalid instanceAddress option: elastic (public or private)",
+		},
+	}
+	for _, test := range tests {
+		options := &lbOptions{InstanceAddress: test.instanceAddress}
+		lb := &Route53{
+			LB:      LB{AwsCredentials: fakeAwsCredentials, Id: "route53_Z1_www.example.com", region: fakeAwsRegion},
+			Options: func() *lbOptions { return options },
+		}
+		addresses, unresolved, err := lb.resolveAddresses(members)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if strings.Join(addresses, " ") != strings.Join(test.addresses, " ") {
+			t.Errorf("%s: got addresses %v, want %v", test.name, addresses, test.addresses)
+		}
+		if strings.Join(unresolved, " ") != strings.Join(test.unresolved, " ") {
+			t.Errorf("%s: got unresolved %v, want %v", test.name, unresolved, test.unresolved)
+		}
+	}
+	if requests := fake.takeRequests(); len(requests) != 2 {
+		t.Errorf("got requests %v, want a DescribeInstances call per resolution", requests)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Error reported for the syncs that were still queued when the shutdown deadline expired
+var errSyncCancelled = errors.New("sync cancelled on shutdown")
+
+// Keeps track of the sync operations requested but not finished yet, so that they can be drained on shutdown
+type syncTracker struct {
+	cancelCh chan bool
+	mu       sync.Mutex
+	pending  int
+	stopping bool
+}
+
+// Create a new sync tracker
+func newSyncTracker() *syncTracker {
+	return &syncTracker{cancelCh: make(chan bool)}
+}
+
+// Register a new sync operation, returns false if no new syncs are accepted because we are shutting down
+func (t *syncTracker) begin() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopping {
+		return false
+	}
+	t.pending++
+	return true
+}
+
+// Mark a sync operation as finished
+func (t *syncTracker) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending--
+}
+
+// Check if the syncs that haven't started yet must be cancelled
+func (t *syncTracker) cancelled() bool {
+	select {
+	case <-t.cancelCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Get the number of sync operations pending
+func (t *syncTracker) pendingSyncs() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pending
+}
+
+// Stop accepting new syncs and wait for the pending ones to finish until the deadline provided, cancelling
+// the ones not started yet once it expires. Returns true if all pending syncs finished in time.
+func (t *syncTracker) drain(deadline time.Time) bool {
+	t.mu.Lock()
+	t.stopping = true
+	t.mu.Unlock()
+
+	for t.pendingSyncs() > 0 {
+		if time.Now().After(deadline) {
+			close(t.cancelCh)
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Key/value store holding the configuration tree
+type ConfigStore interface {
+	// Get all the keys under a path recursively, sorted by key, or errKeyNotFound if there are none
+	List(path string) ([]*storeNode, error)
+	// Set a key, removing it automatically after ttl seconds unless ttl is 0
+	Set(key string, value string, ttl uint64) error
+	// Delete a key, along with the keys under it when recursive
+	Delete(key string, recursive bool) error
+	// Send the changes under a path to the channel provided until stopCh is closed or the watch fails,
+	// closing the channel on return. Changes are resumed from the last one seen by a previous watch, or
+	// from the ones following the state read by Snapshot in the stores supporting it. Returns
+	// errWatchIndexLost when the changes to resume from are no longer available.
+	Watch(path string, nodesCh chan *storeNode, stopCh chan bool) error
+}
+
+// Config stores whose watches can resume from the state read, so that the changes made between the read
+// and the watch aren't lost
+type snapshotStore interface {
+	// Get all the keys under a path as List does, resuming the next watch from the changes following them
+	Snapshot(path string) ([]*storeNode, error)
+}
+
+// Key read from the config store or changed in it. Actions follow the etcd v2 naming (set, delete,
+// expire...), index is the store index of the latest change of the key.
+type storeNode struct {
+	action string
+	dir    bool
+	index  uint64
+	key    string
+	value  string
+}
+
+type storeNodesByIndex []*storeNode
+
+func (n storeNodesByIndex) Len() int           { return len(n) }
+func (n storeNodesByIndex) Less(i, j int) bool { return n[i].index < n[j].index }
+func (n storeNodesByIndex) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+
+var (
+	errKeyNotFound    = errors.New("key not found")
+	errWatchIndexLost = errors.New("changes to resume the watch from are no longer available")
+)
+
+// Config stores supporting locks, held while the process holding them is alive
+type lockingStore interface {
+	// Acquire a lock, waiting until it's acquired or stopCh is closed. The channel returned is closed if
+	// the lock is lost.
+	Lock(key string, stopCh chan bool) (lostCh chan bool, err error)
+	// Release a lock acquired previously
+	Unlock(key string) error
+}
+
+// Config stores supporting refreshing the ttl of a key without notifying its watchers
+type refreshingStore interface {
+	// Refresh the ttl of a key, or return errKeyNotFound if it no longer exists
+	Refresh(key string, ttl uint64) error
+}
+
+// Key of the lock held by the lbManager instance managing the load balancers, in the configuration tree
+const leaderLockKey = "_leader"
+
+var errLockStopped = errors.New("stopped while waiting for lock")
+
+// Connection options of the config store
+type storeOptions struct {
+	caFile   string
+	certFile string
+	file     string
+	keyFile  string
+	machines []string
+	password string
+	root     string
+	token    string
+	username string
+}
+
+// Create the config store of the type provided
+func newConfigStore(storeType string, options *storeOptions) (ConfigStore, error) {
+	switch storeType {
+	case "etcd":
+		return newEtcdStore(options)
+	case "etcdv3":
+		return newEtcdV3Store(options)
+	case "consul":
+		return newConsulStore(options)
+	case "file":
+		return newFileStore(options)
+	}
+	return nil, fmt.Errorf("invalid config store: %s (etcd|etcdv3|consul|file)", storeType)
+}
+
+// Check that the store can be reached and the configuration path read
+func checkStore(store ConfigStore, path string) error {
+	if _, err := store.List(path); err != nil && err != errKeyNotFound {
+		return err
+	}
+	return nil
+}
+
+// Build the TLS configuration, or nil if no certificates were provided
+func (o *storeOptions) tlsConfig() (*tls.Config, error) {
+	if o.caFile == "" && o.certFile == "" && o.keyFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+	if o.certFile != "" || o.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if o.caFile != "" {
+		ca, err := ioutil.ReadFile(o.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading CA certificate: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("error loading CA certificate: no certificates found in %s", o.caFile)
+		}
+	}
+	return tlsConfig, nil
+}
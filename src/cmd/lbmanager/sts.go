@@ -0,0 +1,104 @@
+package main
+
+import (
+	"time"
+
+	sdkaws "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol/query"
+	"github.com/aws/aws-sdk-go/private/signer/v4"
+)
+
+// Duration requested for the credentials obtained assuming a role
+const assumeRoleDuration = time.Hour
+
+// Name of the sessions opened assuming a role, as shown in CloudTrail
+const assumeRoleSessionName = "lbmanager"
+
+// Minimal STS client, supporting just the AssumeRole operation
+type stsClient struct {
+	*client.Client
+}
+
+type assumeRoleInput struct {
+	DurationSeconds *int64  `type:"integer"`
+	ExternalId      *string `type:"string"`
+	RoleArn         *string `type:"string"`
+	RoleSessionName *string `type:"string"`
+}
+
+type assumeRoleOutput struct {
+	Credentials *stsCredentials `type:"structure"`
+}
+
+type stsCredentials struct {
+	AccessKeyId     *string    `type:"string"`
+	Expiration      *time.Time `type:"timestamp" timestampFormat:"iso8601"`
+	SecretAccessKey *string    `type:"string"`
+	SessionToken    *string    `type:"string"`
+}
+
+// Create a STS client signing its requests with the credentials provided
+func newStsClient(creds *credentials.Credentials) *stsClient {
+	cfg := &sdkaws.Config{Credentials: creds, Region: sdkaws.String("us-east-1")}
+	if endpoint := awsEndpoints.lookup("sts", ""); endpoint != "" {
+		cfg.Endpoint = sdkaws.String(endpoint)
+	}
+	c := session.New().ClientConfig("sts", cfg)
+	svc := &stsClient{
+		Client: client.New(*c.Config, metadata.ClientInfo{
+			ServiceName:   "sts",
+			SigningRegion: c.SigningRegion,
+			Endpoint:      c.Endpoint,
+			APIVersion:    "2011-06-15",
+		}, c.Handlers),
+	}
+	svc.Handlers.Sign.PushBack(v4.Sign)
+	svc.Handlers.Build.PushBack(query.Build)
+	svc.Handlers.Unmarshal.PushBack(query.Unmarshal)
+	svc.Handlers.UnmarshalMeta.PushBack(query.UnmarshalMeta)
+	svc.Handlers.UnmarshalError.PushBack(query.UnmarshalError)
+	return svc
+}
+
+// Get temporary credentials for the role provided
+func (c *stsClient) assumeRole(input *assumeRoleInput) (*assumeRoleOutput, error) {
+	output := &assumeRoleOutput{}
+	req := c.NewRequest(&request.Operation{Name: "AssumeRole", HTTPMethod: "POST", HTTPPath: "/"}, input, output)
+	return output, req.Send()
+}
+
+// Credentials provider assuming a role using another set of credentials
+type assumeRoleProvider struct {
+	credentials.Expiry
+	client     *stsClient
+	externalId string
+	roleArn    string
+}
+
+// Retrieve new temporary credentials for the role
+func (p *assumeRoleProvider) Retrieve() (credentials.Value, error) {
+	input := &assumeRoleInput{
+		DurationSeconds: sdkaws.Int64(int64(assumeRoleDuration / time.Second)),
+		RoleArn:         sdkaws.String(p.roleArn),
+		RoleSessionName: sdkaws.String(assumeRoleSessionName),
+	}
+	if p.externalId != "" {
+		input.ExternalId = sdkaws.String(p.externalId)
+	}
+	output, err := p.client.assumeRole(input)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	logger.Info("role assumed", "action", "assumeRole", "role", p.roleArn, "expiration", output.Credentials.Expiration.String())
+	p.SetExpiration(*output.Credentials.Expiration, credentialsExpiryWindow)
+	return credentials.Value{
+		AccessKeyID:     *output.Credentials.AccessKeyId,
+		SecretAccessKey: *output.Credentials.SecretAccessKey,
+		SessionToken:    *output.Credentials.SessionToken,
+	}, nil
+}
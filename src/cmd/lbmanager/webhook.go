@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Header holding the HMAC-SHA256 signature of the webhook requests body
+const webhookSignatureHeader = "X-LbManager-Signature"
+
+// Webhook settings shared by all the webhook load balancers
+type webhookOptions struct {
+	client     *http.Client
+	retries    int
+	retryDelay time.Duration
+	secret     string
+}
+
+var webhookSettings = &webhookOptions{client: http.DefaultClient, retryDelay: time.Second}
+
+// Returned by webhooks not providing the actual members of the load balancer
+var errWebhookStateUnknown = errors.New("the webhook doesn't provide the actual members")
+
+func init() {
+	registerBackend("webhook", &lbBackend{
+		fields:        []string{"name", "class", "member"},
+		usage:         []string{"NAME", "LB_CLASS", "MEMBER"},
+		idFields:      []string{"name"},
+		optionsScopes: [][]string{{"name"}},
+		validate:      validateNamedKey,
+		build: func(m *Manager, configEntry *configEntry) LoadBalancer {
+			scopes := m.optionsScopes(configEntry.lbType, configEntry.lbMetadata)
+			return &Webhook{
+				LB:      m.newLB(configEntry),
+				Options: func() *lbOptions { return m.optionsFor(scopes...) },
+			}
+		},
+	})
+}
+
+// Load balancer managed through a webhook. Syncs POST the desired members as JSON to the URL set in the
+// load balancer options. If a GET to the same URL returns the actual members, only changes are posted.
+type Webhook struct {
+	LB
+	Options func() *lbOptions
+	syncCh  chan int
+}
+
+// Body of the requests sent to the webhook
+type webhookRequest struct {
+	Id        string   `json:"id"`
+	Name      string   `json:"name"`
+	Class     string   `json:"class"`
+	Members   []string `json:"members"`
+	ToAdd     []string `json:"toAdd"`
+	ToRemove  []string `json:"toRemove"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+// Body of the responses to the webhook GET requests
+type webhookState struct {
+	Members []string `json:"members"`
+}
+
+// Error response from a webhook, retried if it's a server error or the webhook is throttling requests
+type webhookError struct {
+	message   string
+	retryable bool
+}
+
+func (e *webhookError) Error() string { return e.message }
+
+// Setup webhook based load balancer
+func (lb *Webhook) Setup(meta map[string]string) {
+	logger.Info("setting up load balancer state", lb.logFields("action", "setup", "name", meta["name"])...)
+	lb.class = meta["class"]
+	lb.configKey = lb.ConfigPath + "/webhook/" + meta["name"] + "/"
+	lb.name = meta["name"]
+	lb.syncCh = make(chan int)
+	go func() {
+		lb.sync()
+	}()
+}
+
+// Sync state of the load balancer instance with the real service
+func (lb *Webhook) Sync() {
+	if !lb.Tracker.begin() {
+		logger.Warn("shutting down, sync discarded", lb.logFields("action", "sync")...)
+		return
+	}
+	lb.syncCh <- 1
+}
+
+// Get the differences between the load balancer state and the members returned by the webhook
+func (lb *Webhook) Diff() (*LBDiff, error) {
+	actual, err := lb.getActualMembers()
+	if err != nil {
+		return nil, err
+	}
+	return lb.buildDiff(lb.Members(), actual), nil
+}
+
+// Get the webhook URL from the load balancer options
+func (lb *Webhook) url() (string, error) {
+	if options := lb.Options(); options != nil && options.WebhookUrl != "" {
+		return options.WebhookUrl, nil
+	}
+	return "", fmt.Errorf("webhook URL not set, set webhookUrl in %s%s", lb.configKey, optionsKey)
+}
+
+// Get the actual members of the load balancer from the webhook
+func (lb *Webhook) getActualMembers() ([]string, error) {
+	url, err := lb.url()
+	if err != nil {
+		return nil, err
+	}
+	state := &webhookState{}
+	if err := lb.request("GET", url, nil, state); err != nil {
+		return nil, err
+	}
+	if state.Members == nil {
+		state.Members = []string{}
+	}
+	return state.Members, nil
+}
+
+// Post the desired members to the webhook
+func (lb *Webhook) postMembers(diff *LBDiff) error {
+	url, err := lb.url()
+	if err != nil {
+		return err
+	}
+	if lb.DryRun {
+		logger.Info("dry run, not posting members to webhook", lb.logFields("action", "postMembers", "members", diff.Desired)...)
+		return nil
+	}
+	logger.Info("posting members to webhook", lb.logFields("action", "postMembers", "members", diff.Desired, "toAdd", diff.ToAdd, "toRemove", diff.ToRemove)...)
+	body, _ := json.Marshal(&webhookRequest{
+		Id:        lb.Id,
+		Name:      lb.name,
+		Class:     lb.Status().Class,
+		Members:   diff.Desired,
+		ToAdd:     diff.ToAdd,
+		ToRemove:  diff.ToRemove,
+		Timestamp: time.Now().Unix(),
+	})
+	return lb.request("POST", url, body, nil)
+}
+
+// Send a signed request to the webhook, retrying it on network and server errors with an exponential
+// backoff, and decoding the JSON response into resp if provided
+func (lb *Webhook) request(method string, url string, body []byte, resp interface{}) (err error) {
+	delay := webhookSettings.retryDelay
+	for attempt := 0; ; attempt++ {
+		if err = lb.doRequest(method, url, body, resp); err == nil {
+			return nil
+		}
+		if webhookErr, ok := err.(*webhookError); (ok && !webhookErr.retryable) || err == errWebhookStateUnknown ||
+			attempt >= webhookSettings.retries || lb.Tracker.cancelled() {
+			return err
+		}
+		logger.Warn("webhook request failed, retrying", lb.logFields("action", "webhookRequest", "method", method, "delay", delay.String(), "error", err.Error())...)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Send a single request to the webhook
+func (lb *Webhook) doRequest(method string, url string, body []byte, resp interface{}) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return &webhookError{message: err.Error()}
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if webhookSettings.secret != "" {
+		mac := hmac.New(sha256.New, []byte(webhookSettings.secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	httpResp, err := webhookSettings.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	data, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return err
+	}
+	switch {
+	case method == "GET" && (httpResp.StatusCode == http.StatusNotFound || httpResp.StatusCode == http.StatusMethodNotAllowed || httpResp.StatusCode == http.StatusNotImplemented):
+		return errWebhookStateUnknown
+	case httpResp.StatusCode < 200 || httpResp.StatusCode > 299:
+		return &webhookError{
+			message:   fmt.Sprintf("got status code: %d (%s)", httpResp.StatusCode, strings.TrimSpace(string(data))),
+			retryable: httpResp.StatusCode >= 500 || httpResp.StatusCode == http.StatusTooManyRequests,
+		}
+	}
+	if resp == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return &webhookError{message: "invalid response: " + err.Error()}
+	}
+	return nil
+}
+
+// Sync state of the load balancer instance with the real service
+func (lb *Webhook) sync() {
+	for _ = range lb.syncCh {
+		if lb.Tracker.cancelled() {
+			lb.recordSync(time.Now(), errSyncCancelled)
+			lb.Tracker.end()
+			continue
+		}
+		startedAt := time.Now()
+		members := lb.Members()
+		sort.Strings(members)
+		logger.Debug("syncing", lb.logFields("action", "sync", "members", members)...)
+		actual, err := lb.getActualMembers()
+		if err != nil && err != errWebhookStateUnknown {
+			logger.Error("error getting members from webhook", lb.logFields("action", "sync", "error", err.Error())...)
+			lb.recordSync(startedAt, err)
+			lb.Tracker.end()
+			continue
+		}
+		diff := lb.buildDiff(members, actual)
+		if err == nil && len(diff.ToAdd) == 0 && len(diff.ToRemove) == 0 {
+			lb.recordActualMembers(len(actual))
+			lb.recordSync(startedAt, nil)
+			lb.Tracker.end()
+			continue
+		}
+		if err == errWebhookStateUnknown {
+			// Without the actual members the desired ones are always posted
+			diff.ToAdd, diff.ToRemove = []string{}, []string{}
+		}
+		if err = lb.postMembers(diff); err != nil {
+			logger.Error("error posting members to webhook", lb.logFields("action", "sync", "error", err.Error())...)
+		} else if !lb.DryRun {
+			lb.recordActualMembers(len(members))
+		}
+		lb.recordSync(startedAt, err)
+		lb.Tracker.end()
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookSync(t *testing.T) {
+	previous := webhookSettings
+	webhookSettings = &webhookOptions{client: http.DefaultClient, retries: 2, retryDelay: time.Millisecond, secret: "secret"}
+	defer func() { webhookSettings = previous }()
+
+	tests := []struct {
+		name     string
+		actual   []string
+		statuses []int
+		requests []string
+		toAdd    []string
+		err      string
+	}{
+		{
+			name:     "members matching",
+			actual:   []string{"b", "a"},
+			requests: []string{"GET signed=true"},
+		},
+		{
+			name:     "members changed",
+			actual:   []string{"a", "c"},
+			requests: []string{"GET signed=true", "POST signed=true"},
+			toAdd:    []string{"b"},
+		},
+		{
+			name:     "actual members unknown",
+			requests: []string{"GET signed=true", "POST signed=true"},
+			toAdd:    []string{},
+		},
+		{
+			name:     "server errors retried",
+			actual:   []string{},
+			statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+			requests: []string{"GET signed=true", "POST signed=true", "POST signed=true", "POST signed=true"},
+			toAdd:    []string{"a", "b"},
+		},
+		{
+			name:     "retries exhausted",
+			actual:   []string{},
+			statuses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			requests: []string{"GET signed=true", "POST signed=true", "POST signed=true", "POST signed=true"},
+			toAdd:    []string{"a", "b"},
+			err:      "got status code: 502",
+		},
+		{
+			name:     "client errors not retried",
+			actual:   []string{},
+			statuses: []int{http.StatusBadRequest},
+			requests: []string{"GET signed=true", "POST signed=true"},
+			toAdd:    []string{"a", "b"},
+			err:      "got status code: 400",
+		},
+	}
+	for _, test := range tests {
+		fake := newFakeWebhook(t, test.actual, test.statuses)
+		lb := &Webhook{
+			LB:      LB{Id: "webhook_web", Tracker: newSyncTracker(), Type: "webhook"},
+			Options: func() *lbOptions { return &lbOptions{WebhookUrl: fake.url} },
+		}
+		lb.Setup(map[string]string{"class": "multiple", "name": "web"})
+		lb.AddMember("a")
+		lb.AddMember("b")
+		status := syncAndWait(t, lb, lb.Tracker)
+
+		if !strings.HasPrefix(status.LastError, test.err) || (test.err == "" && status.LastError != "") {
+			t.Errorf("%s: got error %q, want %q", test.name, status.LastError, test.err)
+		}
+		if strings.Join(fake.requests, ", ") != strings.Join(test.requests, ", ") {
+			t.Errorf("%s: got requests %v, want %v", test.name, fake.requests, test.requests)
+		}
+		for _, post := range fake.posts {
+			if post.Id != "webhook_web" || strings.Join(post.Members, " ") != "a b" || strings.Join(post.ToAdd, " ") != strings.Join(test.toAdd, " ") {
+				t.Errorf("%s: got request %+v, want members [a b] adding %v", test.name, post, test.toAdd)
+			}
+		}
+	}
+}
@@ -1,50 +1,204 @@
 package main
 
 import (
-	"fmt"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/mitchellh/goamz/aws"
 	"github.com/mitchellh/goamz/route53"
-	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Maximum number of pending updates queued per hosted zone
+const zoneUpdaterQueueSize = 100
+
+// Error reported for the updates skipped because a newer one of the same load balancer was queued
+var errUpdateSuperseded = errors.New("update superseded by a newer one")
+
 type ZoneUpdater struct {
-	AwsClient  *route53.Route53
-	HostedZone string
-	UpdatesCh  chan *route53.Change
+	AwsCredentials func() *credentials.Credentials
+	DryRun         bool
+	HostedZone     string
+	Region         aws.Region
+	Tracker        *syncTracker
+	UpdatesCh      chan *zoneUpdate
+	inProgress     string
+	lastError      error
+	lastUpdate     time.Time
+	mu             sync.Mutex
+	queuedByLb     map[string]int
+}
+
+// Record set change queued in a zone updater, along with a callback to report its result (the number
+// of records actually set in Route53 is -1 when unknown, and startedAt is the time the zone updater
+// picked it up, so that the time spent queued isn't counted in the sync duration) and an optional one
+// checking if a newer update of the same load balancer was queued after it
+type zoneUpdate struct {
+	change     *route53.Change
+	done       func(startedAt time.Time, actualMembers int, err error)
+	lbId       string
+	superseded func() bool
+}
+
+// Snapshot of a zone updater's state, as exposed by the admin api
+type ZoneUpdaterStatus struct {
+	HostedZone string         `json:"hostedZone"`
+	Queued     int            `json:"queued"`
+	QueuedByLb map[string]int `json:"queuedByLb"`
+	InProgress string         `json:"inProgress"`
+	LastUpdate time.Time      `json:"lastUpdate"`
+	LastError  string         `json:"lastError"`
+}
+
+// Queue an update, counting the updates pending per load balancer
+func (z *ZoneUpdater) enqueue(update *zoneUpdate) {
+	z.mu.Lock()
+	if z.queuedByLb == nil {
+		z.queuedByLb = make(map[string]int)
+	}
+	z.queuedByLb[update.lbId]++
+	z.mu.Unlock()
+	z.UpdatesCh <- update
 }
 
 // Process updates, updating records sets in AWS Route53
 func (z *ZoneUpdater) listen() {
-	for change := range z.UpdatesCh {
-		resourceRecords := z.getResourceRecords(change.Record.Name)
-		if fmt.Sprintf("%v", resourceRecords) != fmt.Sprintf("%v", change.Record.Records) {
-			log.Printf("-- ZONEUPDATER:%s:updating:%s:%s\n", z.HostedZone, change.Record.Name, change.Record.Records)
+	for update := range z.UpdatesCh {
+		z.dequeued(update.lbId)
+		startedAt := time.Now()
+		change := update.change
+		if z.Tracker.cancelled() {
+			logger.Warn("shutting down, update cancelled", z.logFields(update.lbId, "action", "updateRecords")...)
+			update.done(startedAt, -1, errSyncCancelled)
+			continue
+		}
+		if update.superseded != nil && update.superseded() {
+			logger.Debug("newer update queued, skipping this one", z.logFields(update.lbId, "action", "updateRecords")...)
+			update.done(startedAt, -1, errUpdateSuperseded)
+			continue
+		}
+		z.setInProgress(change.Record.Name)
+		resourceRecords, err := z.getResourceRecords(update.lbId, change.Record.Name)
+		actualMembers := len(resourceRecords)
+		if err != nil {
+			logger.Error("error listing resource records", z.logFields(update.lbId, "action", "listRecords", "error", err.Error())...)
+			actualMembers = -1
+		}
+		if z.DryRun {
+			if !sameRecords(resourceRecords, change.Record.Records) {
+				logger.Info("dry run, not updating record set", z.logFields(update.lbId, "action", "updateRecords", "members", change.Record.Records)...)
+			}
+		} else if !sameRecords(resourceRecords, change.Record.Records) {
+			logger.Info("updating record set", z.logFields(update.lbId, "action", "updateRecords", "members", change.Record.Records)...)
 			req := &route53.ChangeResourceRecordSetsRequest{
 				Comment: "lbManager",
 				Changes: []route53.Change{*change},
 			}
-			_, err := z.AwsClient.ChangeResourceRecordSets(z.HostedZone, req)
+			var awsClient *route53.Route53
+			if awsClient, err = z.awsClient(); err == nil {
+				_, err = awsClient.ChangeResourceRecordSets(z.HostedZone, req)
+				metrics.observeAwsCall(update.lbId, "ChangeResourceRecordSets", err)
+			}
 			if err != nil {
-				log.Println(err)
+				logger.Error("error updating record set", z.logFields(update.lbId, "action", "updateRecords", "error", err.Error())...)
+			} else {
+				actualMembers = len(change.Record.Records)
 			}
 		} else {
-			log.Printf("-- ZONEUPDATER:%s:nothingToUpdate", z.HostedZone)
+			logger.Debug("nothing to update", z.logFields(update.lbId, "action", "updateRecords")...)
 		}
+		z.recordUpdate(err)
+		update.done(startedAt, actualMembers, err)
+	}
+}
+
+// Build a Route53 client using the current AWS credentials
+func (z *ZoneUpdater) awsClient() (*route53.Route53, error) {
+	auth, err := getAwsAuth(z.AwsCredentials())
+	if err != nil {
+		return nil, err
 	}
+	return route53.New(auth, z.Region), nil
+}
+
+// Build the key/value pairs identifying the zone updater and the load balancer in log entries, followed by the ones provided
+func (z *ZoneUpdater) logFields(lbId string, fields ...interface{}) []interface{} {
+	return append([]interface{}{"lb", lbId, "type", "route53", "hostedZone", z.HostedZone}, fields...)
+}
+
+// Get a snapshot of the zone updater's state
+func (z *ZoneUpdater) Status() ZoneUpdaterStatus {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	status := ZoneUpdaterStatus{
+		HostedZone: z.HostedZone,
+		Queued:     len(z.UpdatesCh),
+		QueuedByLb: make(map[string]int),
+		InProgress: z.inProgress,
+		LastUpdate: z.lastUpdate,
+	}
+	for lbId, queued := range z.queuedByLb {
+		status.QueuedByLb[lbId] = queued
+	}
+	if z.lastError != nil {
+		status.LastError = z.lastError.Error()
+	}
+	return status
+}
+
+// Count an update as no longer pending. Load balancers are kept with no updates pending, so that their
+// queue depth is reported as 0.
+func (z *ZoneUpdater) dequeued(lbId string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.queuedByLb[lbId] > 0 {
+		z.queuedByLb[lbId]--
+	}
+}
+
+// Set the record name currently being updated
+func (z *ZoneUpdater) setInProgress(name string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.inProgress = name
+}
+
+// Record the result of the latest update processed
+func (z *ZoneUpdater) recordUpdate(err error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.inProgress = ""
+	z.lastUpdate = time.Now()
+	z.lastError = err
 }
 
 // Get resource records from Route53
-func (z *ZoneUpdater) getResourceRecords(name string) (resourceRecords []string) {
+func (z *ZoneUpdater) getResourceRecords(lbId string, name string) (resourceRecords []string, err error) {
 	lopts := &route53.ListOpts{
 		Name:     name,
 		MaxItems: 1,
 	}
-	resp, err := z.AwsClient.ListResourceRecordSets(z.HostedZone, lopts)
+	awsClient, err := z.awsClient()
 	if err != nil {
-		log.Println(err)
-	} else {
+		return
+	}
+	resp, err := awsClient.ListResourceRecordSets(z.HostedZone, lopts)
+	metrics.observeAwsCall(lbId, "ListResourceRecordSets", err)
+	if err == nil {
 		if len(resp.Records) > 0 && resp.Records[0].Name == name+"." {
 			resourceRecords = resp.Records[0].Records
 		}
 	}
 	return
 }
+
+// Check if two lists of records hold the same records, in any order, as Route53 doesn't keep the
+// order they were set in. Plans compare them the same way, through the load balancers diffs.
+func sameRecords(a []string, b []string) bool {
+	sortedA, sortedB := append([]string{}, a...), append([]string{}, b...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+	return strings.Join(sortedA, ",") == strings.Join(sortedB, ",")
+}
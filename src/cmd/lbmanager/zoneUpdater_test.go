@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/route53"
+)
+
+func TestZoneUpdaterSkipsSupersededUpdates(t *testing.T) {
+	z := &ZoneUpdater{HostedZone: "Z1", Tracker: newSyncTracker(), UpdatesCh: make(chan *zoneUpdate, 1)}
+	errCh := make(chan error, 1)
+	z.UpdatesCh <- &zoneUpdate{
+		change:     &route53.Change{Record: route53.ResourceRecordSet{Name: "www.example.com", Records: []string{"10.0.0.1"}}},
+		done:       func(startedAt time.Time, actualMembers int, err error) { errCh <- err },
+		lbId:       "route53/Z1/www.example.com",
+		superseded: func() bool { return true },
+	}
+	close(z.UpdatesCh)
+	z.listen()
+	if err := <-errCh; err != errUpdateSuperseded {
+		t.Errorf("got error %v, want the update skipped", err)
+	}
+	if status := z.Status(); !status.LastUpdate.IsZero() {
+		t.Errorf("got status %+v, want no update recorded", status)
+	}
+}
+
+func TestSameRecords(t *testing.T) {
+	if !sameRecords([]string{"10.0.0.2", "10.0.0.1"}, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Error("got records in another order different")
+	}
+	if sameRecords([]string{"10.0.0.1"}, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Error("got different records the same")
+	}
+}